@@ -1,8 +1,91 @@
 package broker
 
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/w-h-a/pkg/utils/retryutils"
+)
+
+const (
+	DeadLetterReasonHeader = "dead-letter-reason"
+	DeadLetterSourceHeader = "dead-letter-source"
+	DeadLetterGroupHeader  = "dead-letter-group"
+	CorrelationIdHeader    = "correlation-id"
+	ReplyToHeader          = "reply-to"
+)
+
+const (
+	CloudEventsSpecVersion  = "1.0"
+	CloudEventsContentType  = "application/cloudevents+json"
+	CloudEventsHeaderPrefix = "ce-"
+	ContentTypeHeader       = "content-type"
+)
+
+const (
+	waitInterval  = 10 * time.Millisecond
+	inFlightDelay = time.Second
+)
+
+var (
+	ErrMessageSettled     = errors.New("message was already acked or nacked")
+	ErrMessageInFlight    = errors.New("message is already being handled")
+	ErrNotCloudEvent      = errors.New("message is not a cloud event")
+	ErrInvalidCloudEvent  = errors.New("cloud event is missing required attributes")
+	ErrSchedulerRequired  = errors.New("delayed messages need a scheduler store on this broker")
+	ErrNoReplyTo          = errors.New("message has no reply-to topic")
+	ErrRequestUnsupported = errors.New("broker cannot subscribe to a reply topic of its own")
+	ErrRepliesClosed      = errors.New("replies were closed before the reply arrived")
+)
+
+var (
+	defaultBackoff = func(ctx context.Context, attempts int) (time.Duration, error) {
+		return retryutils.ExponentialBackoff(attempts), nil
+	}
+	defaultRetryCheck = func(ctx context.Context, retryCount int, err error) (bool, error) {
+		return IsTransient(err), nil
+	}
+	defaultRetryCount = 0
+)
+
 type Broker interface {
 	Options() BrokerOptions
 	Publish(data interface{}, options PublishOptions) error
-	Subscribe(callback func([]byte) error, options SubscribeOptions) Subscriber
+	Subscribe(callback func(*Message) error, options SubscribeOptions) Subscriber
 	String() string
 }
+
+// DeadLetterQueue is implemented by brokers that keep dead-lettered messages themselves
+type DeadLetterQueue interface {
+	DeadLetters(topic string) ([]*Message, error)
+	Replay(topic string, ids ...string) error
+}
+
+// BatchPublisher is implemented by brokers that send many messages in one call.
+// Implementations run every entry through the publish wrappers with WrapPublishBatch.
+type BatchPublisher interface {
+	PublishBatch(entries []BatchEntry) error
+}
+
+// TopicSubscriber is implemented by brokers whose subscribers only get the topic they asked for, which Request needs for its
+// replies. Brokers that read every topic from one queue, like snssqs, do not implement it.
+type TopicSubscriber interface {
+	SubscribesToTopic()
+}
+
+// Inspector is implemented by brokers that can report on their topics and consumer groups
+type Inspector interface {
+	Inspect(ctx context.Context) ([]TopicInfo, error)
+}
+
+// Drainer is implemented by brokers that deliver asynchronously
+type Drainer interface {
+	Drain(ctx context.Context) error
+}
+
+// Closer is implemented by brokers that poll in the background, which Close stops.
+// Subscribers are left running until they unsubscribe.
+type Closer interface {
+	Close() error
+}
@@ -0,0 +1,239 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/w-h-a/pkg/utils/retryutils"
+)
+
+// ContentMode is how a cloud event is laid out on a message
+type ContentMode string
+
+const (
+	// ContentModeStructured puts the whole event in the body as json
+	ContentModeStructured ContentMode = "structured"
+	// ContentModeBinary puts the attributes in the header and the data in the body
+	ContentModeBinary ContentMode = "binary"
+)
+
+// CloudEvent holds the attributes of a CloudEvents 1.0 event
+type CloudEvent struct {
+	Id              string
+	Source          string
+	Type            string
+	Subject         string
+	Time            time.Time
+	DataContentType string
+	Data            []byte
+	Extensions      map[string]string
+}
+
+type BatchEntry struct {
+	Data    interface{}
+	Options PublishOptions
+}
+
+// BatchError reports which messages of a batch failed, with Errors lined up with the entries and nil for the ones that were published
+type BatchError struct {
+	Errors []error
+}
+
+func (e *BatchError) Error() string {
+	failed := e.Unwrap()
+
+	if len(failed) == 0 {
+		return "batch publish failed"
+	}
+
+	return fmt.Sprintf("%d of %d messages failed to publish: %v", len(failed), len(e.Errors), failed[0])
+}
+
+func (e *BatchError) Unwrap() []error {
+	failed := []error{}
+
+	for _, err := range e.Errors {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+
+	return failed
+}
+
+type TopicInfo struct {
+	Topic  string
+	Groups []GroupInfo
+}
+
+// GroupInfo describes a consumer group of a topic. Lag is the number of messages waiting for the group and is only an estimate when Approximate is set.
+type GroupInfo struct {
+	Group       string
+	Subscribers []string
+	InFlight    int64
+	Lag         int64
+	Approximate bool
+}
+
+type Acknowledger interface {
+	Ack() error
+	Nack(delay time.Duration) error
+}
+
+// Deferrer is implemented by acknowledgers that can redeliver a message without counting the delivery against MaxDeliveries
+type Deferrer interface {
+	Defer(delay time.Duration) error
+}
+
+// Settlement records how a handler settled a message for brokers that hold on to the message and redeliver it themselves
+type Settlement struct {
+	acked    bool
+	nacked   bool
+	deferred bool
+	delay    time.Duration
+	mtx      sync.Mutex
+}
+
+func (s *Settlement) Ack() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.acked = true
+
+	return nil
+}
+
+func (s *Settlement) Nack(delay time.Duration) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.nacked = true
+	s.delay = delay
+
+	return nil
+}
+
+func (s *Settlement) Defer(delay time.Duration) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.nacked = true
+	s.deferred = true
+	s.delay = delay
+
+	return nil
+}
+
+// Deferred reports whether the redelivery should carry the same attempt count
+func (s *Settlement) Deferred() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.deferred
+}
+
+// Result reports whether the message is done with and otherwise how long to wait before redelivering it
+func (s *Settlement) Result(attempts int) (bool, time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.acked {
+		return true, 0
+	}
+
+	if s.nacked {
+		return false, s.delay
+	}
+
+	// the message was never settled (e.g., the commit or dead-letter failed)
+	return false, retryutils.ExponentialBackoff(attempts)
+}
+
+type Message struct {
+	Id           string
+	Topic        string
+	Group        string
+	Header       map[string]string
+	Body         []byte
+	Timestamp    time.Time
+	Attempts     int
+	Context      context.Context
+	acknowledger Acknowledger
+	settled      bool
+	mtx          sync.Mutex
+}
+
+// Ack tells the broker that the message was processed and should not be redelivered
+func (m *Message) Ack() error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.settled {
+		return ErrMessageSettled
+	}
+
+	m.settled = true
+
+	if m.acknowledger == nil {
+		return nil
+	}
+
+	return m.acknowledger.Ack()
+}
+
+// Nack tells the broker to redeliver the message once the delay has passed
+func (m *Message) Nack(delay time.Duration) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.settled {
+		return ErrMessageSettled
+	}
+
+	m.settled = true
+
+	if m.acknowledger == nil {
+		return nil
+	}
+
+	return m.acknowledger.Nack(delay)
+}
+
+// postpone redelivers the message once the delay has passed without counting the delivery when the broker can
+func (m *Message) postpone(delay time.Duration) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.settled {
+		return ErrMessageSettled
+	}
+
+	m.settled = true
+
+	if m.acknowledger == nil {
+		return nil
+	}
+
+	if d, ok := m.acknowledger.(Deferrer); ok {
+		return d.Defer(delay)
+	}
+
+	return m.acknowledger.Nack(delay)
+}
+
+func (m *Message) Settled() bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return m.settled
+}
+
+func NewMessage(acknowledger Acknowledger) *Message {
+	return &Message{
+		Header:       map[string]string{},
+		Context:      context.Background(),
+		acknowledger: acknowledger,
+	}
+}
@@ -0,0 +1,423 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/utils/datautils"
+)
+
+const (
+	defaultSegmentSize       = int64(16 << 20)
+	defaultRetentionInterval = time.Minute
+)
+
+type fileBroker struct {
+	options       broker.BrokerOptions
+	scheduler     *broker.Scheduler
+	dir           string
+	segmentSize   int64
+	retentionAge  time.Duration
+	retentionSize int64
+	exit          chan struct{}
+	wg            sync.WaitGroup
+	once          sync.Once
+	logs          map[string]*topicLog
+	groups        map[string]map[string]*group
+	patterns      []*subscriber
+	mtx           sync.RWMutex
+}
+
+func (b *fileBroker) Options() broker.BrokerOptions {
+	return b.options
+}
+
+func (b *fileBroker) Publish(data interface{}, options broker.PublishOptions) error {
+	return broker.WrapPublish(b.options, b.publish)(data, options)
+}
+
+func (b *fileBroker) publish(data interface{}, options broker.PublishOptions) error {
+	if broker.DeliveryDelay(options) > 0 {
+		if b.scheduler == nil {
+			return broker.ErrSchedulerRequired
+		}
+		return b.scheduler.Schedule(data, options)
+	}
+
+	bs, err := datautils.Stringify(data)
+	if err != nil {
+		return err
+	}
+
+	header := broker.InjectTraceHeaders(options.Context, options.Header)
+
+	return broker.RetryPublish(options, nil, func(ctx context.Context) error {
+		return b.append(options.Topic, header, bs)
+	})
+}
+
+func (b *fileBroker) Subscribe(callback func(*broker.Message) error, options broker.SubscribeOptions) broker.Subscriber {
+	handler := broker.WrapHandler(b.options, callback)
+
+	sub := &subscriber{
+		options: options,
+		id:      uuid.New().String(),
+		handler: handler,
+		broker:  b,
+	}
+
+	if err := b.subscribe(sub); err != nil {
+		log.Errorf("failed to subscribe to topic %s for group %s: %v", options.Topic, options.Group, err)
+	}
+
+	return sub
+}
+
+// Close stops polling the scheduler store and deleting expired segments
+func (b *fileBroker) Close() error {
+	b.once.Do(func() {
+		close(b.exit)
+	})
+
+	b.wg.Wait()
+
+	if b.scheduler != nil {
+		b.scheduler.Stop()
+	}
+
+	return nil
+}
+
+// SubscribesToTopic marks the broker as one that Request can take replies on
+func (b *fileBroker) SubscribesToTopic() {}
+
+func (b *fileBroker) String() string {
+	return "file"
+}
+
+func (b *fileBroker) append(topic string, header map[string]string, body []byte) error {
+	l, err := b.log(topic)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.append(header, body)
+
+	return err
+}
+
+func (b *fileBroker) subscribe(sub *subscriber) error {
+	topic, name := b.names(sub)
+
+	if !broker.IsTopicPattern(topic) {
+		return b.subscribeTopic(sub, topic, name, false)
+	}
+
+	// topics created from now on are picked up when their logs are opened
+	b.mtx.Lock()
+	b.patterns = append(b.patterns, sub)
+	b.mtx.Unlock()
+
+	topics, err := b.topics()
+	if err != nil {
+		return err
+	}
+
+	errs := []error{}
+
+	for _, t := range topics {
+		if broker.MatchTopic(topic, t) {
+			errs = append(errs, b.subscribeTopic(sub, t, name, false))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (b *fileBroker) subscribeTopic(sub *subscriber, topic, name string, fromStart bool) error {
+	l, err := b.log(topic)
+	if err != nil {
+		return err
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if _, ok := b.groups[topic]; !ok {
+		b.groups[topic] = map[string]*group{}
+	}
+
+	if g, ok := b.groups[topic][name]; ok {
+		g.add(sub)
+		return nil
+	}
+
+	// subscribers without a group get an ephemeral group that starts from the end of the log
+	g, err := newGroup(name, topic, l, len(sub.options.Group) > 0)
+	if err != nil {
+		return err
+	}
+
+	offset, err := g.offset(fromStart)
+	if err != nil {
+		return err
+	}
+
+	g.add(sub)
+
+	b.groups[topic][name] = g
+
+	go g.run(offset)
+
+	return nil
+}
+
+func (b *fileBroker) unsubscribe(ctx context.Context, sub *subscriber) error {
+	topic, name := b.names(sub)
+
+	topics := []string{topic}
+
+	b.mtx.Lock()
+
+	if broker.IsTopicPattern(topic) {
+		b.patterns = slices.DeleteFunc(b.patterns, func(s *subscriber) bool {
+			return s.id == sub.id
+		})
+
+		topics = []string{}
+
+		for t := range b.groups {
+			if broker.MatchTopic(topic, t) {
+				topics = append(topics, t)
+			}
+		}
+	}
+
+	stopped := []*group{}
+
+	for _, t := range topics {
+		g, ok := b.groups[t][name]
+		if !ok || !g.remove(sub) {
+			continue
+		}
+
+		close(g.exit)
+		delete(b.groups[t], name)
+
+		stopped = append(stopped, g)
+	}
+
+	b.mtx.Unlock()
+
+	// the last subscriber waits for the message in hand to be settled so that a new group with the same name starts after it
+	for _, g := range stopped {
+		select {
+		case <-g.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return broker.WaitFor(ctx, func() bool {
+		return sub.handling.Load() == 0
+	})
+}
+
+func (b *fileBroker) names(sub *subscriber) (string, string) {
+	topic := broker.SubscriptionTopic(sub.options)
+	name := broker.SubscriptionGroup(sub.options, sub.id)
+
+	// a pattern gets its own groups (and offsets) apart from the group of the same name on a single topic
+	if broker.IsTopicPattern(topic) {
+		name = name + "@" + topic
+	}
+
+	return topic, name
+}
+
+// topics lists the topics that have a log in the directory, including ones from earlier runs
+func (b *fileBroker) topics() ([]string, error) {
+	entries, err := os.ReadDir(b.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	topics := []string{}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		topic, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		topics = append(topics, topic)
+	}
+
+	return topics, nil
+}
+
+func (b *fileBroker) log(topic string) (*topicLog, error) {
+	b.mtx.RLock()
+	l, ok := b.logs[topic]
+	b.mtx.RUnlock()
+
+	if ok {
+		return l, nil
+	}
+
+	b.mtx.Lock()
+
+	if l, ok := b.logs[topic]; ok {
+		b.mtx.Unlock()
+		return l, nil
+	}
+
+	dir := filepath.Join(b.dir, escape(topic))
+
+	_, statErr := os.Stat(dir)
+	created := os.IsNotExist(statErr)
+
+	l, err := openLog(dir, b.segmentSize, b.retentionAge, b.retentionSize)
+	if err != nil {
+		b.mtx.Unlock()
+		return nil, err
+	}
+
+	b.logs[topic] = l
+
+	patterns := []*subscriber{}
+
+	for _, sub := range b.patterns {
+		if pattern, _ := b.names(sub); broker.MatchTopic(pattern, topic) {
+			patterns = append(patterns, sub)
+		}
+	}
+
+	b.mtx.Unlock()
+
+	// pattern subscribers read a brand new topic from its first message even if it was appended before they joined
+	for _, sub := range patterns {
+		_, name := b.names(sub)
+
+		if err := b.subscribeTopic(sub, topic, name, created); err != nil {
+			log.Errorf("failed to subscribe to topic %s for group %s: %v", topic, name, err)
+		}
+	}
+
+	return l, nil
+}
+
+// expire deletes segments past the retention age on a timer since topics that no longer receive messages never roll
+func (b *fileBroker) expire(interval time.Duration) {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.exit:
+			return
+		case <-ticker.C:
+		}
+
+		b.mtx.RLock()
+		logs := make(map[string]*topicLog, len(b.logs))
+		for topic, l := range b.logs {
+			logs[topic] = l
+		}
+		b.mtx.RUnlock()
+
+		for topic, l := range logs {
+			if err := l.expire(); err != nil {
+				log.Errorf("failed to delete expired segments of topic %s: %v", topic, err)
+			}
+		}
+	}
+}
+
+func (b *fileBroker) configure() error {
+	dir, ok := GetDirFromContext(b.options.Context)
+	if !ok || len(dir) == 0 {
+		return fmt.Errorf("a directory is required")
+	}
+
+	b.dir = dir
+
+	b.segmentSize = defaultSegmentSize
+	if n, ok := GetSegmentSizeFromContext(b.options.Context); ok && n > 0 {
+		b.segmentSize = n
+	}
+
+	if d, ok := GetRetentionAgeFromContext(b.options.Context); ok {
+		b.retentionAge = d
+	}
+
+	if n, ok := GetRetentionSizeFromContext(b.options.Context); ok {
+		b.retentionSize = n
+	}
+
+	return nil
+}
+
+// escape keeps topic and group names usable as file names that stay inside the directory
+func escape(name string) string {
+	escaped := url.PathEscape(name)
+
+	if strings.HasPrefix(escaped, ".") {
+		escaped = "%2E" + escaped[1:]
+	}
+
+	return escaped
+}
+
+func NewBroker(opts ...broker.BrokerOption) broker.Broker {
+	options := broker.NewBrokerOptions(opts...)
+
+	b := &fileBroker{
+		options: options,
+		logs:    map[string]*topicLog{},
+		exit:    make(chan struct{}),
+		groups:  map[string]map[string]*group{},
+		mtx:     sync.RWMutex{},
+	}
+
+	if err := b.configure(); err != nil {
+		log.Fatal(err)
+	}
+
+	if options.SchedulerStore != nil {
+		b.scheduler = broker.NewScheduler(options.SchedulerStore, b.publish)
+	}
+
+	if b.retentionAge > 0 {
+		interval := defaultRetentionInterval
+		if d, ok := GetRetentionIntervalFromContext(options.Context); ok && d > 0 {
+			interval = d
+		}
+
+		b.wg.Add(1)
+		go b.expire(interval)
+	}
+
+	return b
+}
@@ -0,0 +1,335 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLogger(memory.NewLog(memory.LogWithBuffer(memoryutils.NewBuffer())))
+
+	os.Exit(m.Run())
+}
+
+// tempDir is removed without failing the test because groups may still be committing offsets as the test ends
+func tempDir(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "file-broker-")
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	return dir
+}
+
+func receive(t *testing.T, ch chan *broker.Message) *broker.Message {
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("expected the message to be delivered")
+		return nil
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	b := NewBroker(FileWithDir(tempDir(t)))
+
+	received := make(chan *broker.Message, 1)
+
+	sub := b.Subscribe(func(msg *broker.Message) error {
+		received <- msg
+		return nil
+	}, broker.NewSubscribeOptions(
+		broker.SubscribeWithTopic("orders"),
+		broker.SubscribeWithGroup("billing"),
+	))
+	defer sub.Unsubscribe(context.Background())
+
+	err := b.Publish("hello", broker.NewPublishOptions(
+		broker.PublishWithTopic("orders"),
+		broker.PublishWithHeader("foo", "bar"),
+	))
+	require.NoError(t, err)
+
+	msg := receive(t, received)
+
+	require.Equal(t, "0", msg.Id)
+	require.Equal(t, "orders", msg.Topic)
+	require.Equal(t, []byte("hello"), msg.Body)
+	require.Equal(t, "bar", msg.Header["foo"])
+	require.Equal(t, 1, msg.Attempts)
+	require.False(t, msg.Timestamp.IsZero())
+}
+
+func TestRestart(t *testing.T) {
+	dir := tempDir(t)
+
+	received := make(chan *broker.Message, 3)
+
+	options := broker.NewSubscribeOptions(
+		broker.SubscribeWithTopic("orders"),
+		broker.SubscribeWithGroup("billing"),
+	)
+
+	b := NewBroker(FileWithDir(dir), FileWithSegmentSize(64))
+
+	sub := b.Subscribe(func(msg *broker.Message) error {
+		received <- msg
+		return nil
+	}, options)
+
+	for _, body := range []string{"a", "b", "c"} {
+		err := b.Publish(body, broker.NewPublishOptions(broker.PublishWithTopic("orders")))
+		require.NoError(t, err)
+	}
+
+	for _, body := range []string{"a", "b", "c"} {
+		require.Equal(t, []byte(body), receive(t, received).Body)
+	}
+
+	sub.Unsubscribe(context.Background())
+
+	err := b.Publish("d", broker.NewPublishOptions(broker.PublishWithTopic("orders")))
+	require.NoError(t, err)
+
+	// a torn write from a crash is dropped when the log is reopened
+	segments, err := filepath.Glob(filepath.Join(dir, "orders", "*"+segmentExt))
+	require.NoError(t, err)
+	require.Greater(t, len(segments), 1)
+
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 1})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	b = NewBroker(FileWithDir(dir), FileWithSegmentSize(64))
+
+	sub = b.Subscribe(func(msg *broker.Message) error {
+		received <- msg
+		return nil
+	}, options)
+	defer sub.Unsubscribe(context.Background())
+
+	msg := receive(t, received)
+
+	require.Equal(t, "3", msg.Id)
+	require.Equal(t, []byte("d"), msg.Body)
+
+	err = b.Publish("e", broker.NewPublishOptions(broker.PublishWithTopic("orders")))
+	require.NoError(t, err)
+
+	msg = receive(t, received)
+
+	require.Equal(t, "4", msg.Id)
+	require.Equal(t, []byte("e"), msg.Body)
+}
+
+func TestRetention(t *testing.T) {
+	dir := tempDir(t)
+
+	b := NewBroker(
+		FileWithDir(dir),
+		FileWithSegmentSize(64),
+		FileWithRetentionSize(256),
+	)
+
+	received := make(chan *broker.Message, 1)
+
+	// the group falls behind while the log is trimmed
+	sub := b.Subscribe(func(msg *broker.Message) error {
+		received <- msg
+		return nil
+	}, broker.NewSubscribeOptions(
+		broker.SubscribeWithTopic("orders"),
+		broker.SubscribeWithGroup("billing"),
+	))
+	sub.Unsubscribe(context.Background())
+
+	for i := 0; i < 20; i++ {
+		err := b.Publish("hello", broker.NewPublishOptions(broker.PublishWithTopic("orders")))
+		require.NoError(t, err)
+	}
+
+	segments, err := filepath.Glob(filepath.Join(dir, "orders", "*"+segmentExt))
+	require.NoError(t, err)
+
+	size := int64(0)
+
+	for _, segment := range segments[:len(segments)-1] {
+		info, err := os.Stat(segment)
+		require.NoError(t, err)
+		size += info.Size()
+	}
+
+	// retention runs when the log rolls, so only the inactive segments are held to the limit
+	require.LessOrEqual(t, size, int64(256))
+	require.NotContains(t, segments, filepath.Join(dir, "orders", "00000000000000000000"+segmentExt))
+
+	// only the first message matters and the handler must not block the group from stopping
+	sub = b.Subscribe(func(msg *broker.Message) error {
+		select {
+		case received <- msg:
+		default:
+		}
+		return nil
+	}, broker.NewSubscribeOptions(
+		broker.SubscribeWithTopic("orders"),
+		broker.SubscribeWithGroup("billing"),
+	))
+	defer sub.Unsubscribe(context.Background())
+
+	msg := receive(t, received)
+
+	require.NotEqual(t, "0", msg.Id)
+}
+
+func TestRetentionAge(t *testing.T) {
+	dir := tempDir(t)
+
+	b := NewBroker(
+		FileWithDir(dir),
+		FileWithRetentionAge(50*time.Millisecond),
+		FileWithRetentionInterval(10*time.Millisecond),
+	)
+	defer b.(broker.Closer).Close()
+
+	for i := 0; i < 3; i++ {
+		err := b.Publish("hello", broker.NewPublishOptions(broker.PublishWithTopic("orders")))
+		require.NoError(t, err)
+	}
+
+	// the topic goes quiet, so only the timer can remove its messages
+	require.Eventually(t, func() bool {
+		segments, err := filepath.Glob(filepath.Join(dir, "orders", "*"+segmentExt))
+		require.NoError(t, err)
+		return len(segments) == 1 && filepath.Base(segments[0]) == "00000000000000000003"+segmentExt
+	}, time.Second, 10*time.Millisecond)
+
+	received := make(chan *broker.Message, 1)
+
+	sub := b.Subscribe(func(msg *broker.Message) error {
+		received <- msg
+		return nil
+	}, broker.NewSubscribeOptions(
+		broker.SubscribeWithTopic("orders"),
+		broker.SubscribeWithGroup("billing"),
+	))
+	defer sub.Unsubscribe(context.Background())
+
+	err := b.Publish("hello", broker.NewPublishOptions(broker.PublishWithTopic("orders")))
+	require.NoError(t, err)
+
+	msg := receive(t, received)
+
+	require.Equal(t, "3", msg.Id)
+}
+
+func TestRedelivery(t *testing.T) {
+	b := NewBroker(FileWithDir(tempDir(t)))
+
+	dead := make(chan *broker.Message, 1)
+
+	dlq := b.Subscribe(func(msg *broker.Message) error {
+		dead <- msg
+		return nil
+	}, broker.NewSubscribeOptions(
+		broker.SubscribeWithTopic("orders-dlq"),
+		broker.SubscribeWithGroup("test"),
+	))
+	defer dlq.Unsubscribe(context.Background())
+
+	received := make(chan *broker.Message, 3)
+
+	sub := b.Subscribe(func(msg *broker.Message) error {
+		received <- msg
+		if string(msg.Body) == "a" {
+			return errors.New("boom")
+		}
+		return nil
+	}, broker.NewSubscribeOptions(
+		broker.SubscribeWithTopic("orders"),
+		broker.SubscribeWithGroup("test"),
+		broker.SubscribeWithMaxDeliveries(2),
+		broker.SubscribeWithDeadLetterTopic("orders-dlq"),
+	))
+	defer sub.Unsubscribe(context.Background())
+
+	for _, body := range []string{"a", "b"} {
+		err := b.Publish(body, broker.NewPublishOptions(broker.PublishWithTopic("orders")))
+		require.NoError(t, err)
+	}
+
+	msg := receive(t, received)
+	require.Equal(t, []byte("a"), msg.Body)
+	require.Equal(t, 1, msg.Attempts)
+
+	msg = receive(t, received)
+	require.Equal(t, []byte("a"), msg.Body)
+	require.Equal(t, 2, msg.Attempts)
+
+	msg = receive(t, received)
+	require.Equal(t, []byte("b"), msg.Body)
+	require.Equal(t, 1, msg.Attempts)
+
+	msg = receive(t, dead)
+	require.Equal(t, []byte("a"), msg.Body)
+	require.Equal(t, "boom", msg.Header[broker.DeadLetterReasonHeader])
+	require.Equal(t, "orders", msg.Header[broker.DeadLetterSourceHeader])
+}
+
+func TestTopicPatterns(t *testing.T) {
+	dir := tempDir(t)
+
+	b := NewBroker(FileWithDir(dir))
+
+	// the topic exists before the pattern subscription
+	err := b.Publish("old", broker.NewPublishOptions(broker.PublishWithTopic("orders.created")))
+	require.NoError(t, err)
+
+	received := make(chan *broker.Message, 3)
+
+	sub := b.Subscribe(func(msg *broker.Message) error {
+		received <- msg
+		return nil
+	}, broker.NewSubscribeOptions(
+		broker.SubscribeWithTopic("orders.*"),
+		broker.SubscribeWithGroup("audit"),
+	))
+	defer sub.Unsubscribe(context.Background())
+
+	for _, topic := range []string{"orders.created", "payments.created", "orders.paid"} {
+		err := b.Publish(topic, broker.NewPublishOptions(broker.PublishWithTopic(topic)))
+		require.NoError(t, err)
+	}
+
+	topics := map[string]string{}
+
+	for i := 0; i < 2; i++ {
+		msg := receive(t, received)
+		topics[msg.Topic] = string(msg.Body)
+	}
+
+	require.Equal(t, map[string]string{
+		"orders.created": "orders.created",
+		"orders.paid":    "orders.paid",
+	}, topics)
+
+	select {
+	case msg := <-received:
+		t.Fatalf("unexpected message %s from %s", msg.Body, msg.Topic)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
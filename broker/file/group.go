@@ -0,0 +1,243 @@
+package file
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/telemetry/log"
+)
+
+const (
+	readBackoff = time.Second
+)
+
+// group hands the messages of one topic to its subscribers one at a time and remembers how far it got
+type group struct {
+	name        string
+	topic       string
+	log         *topicLog
+	path        string
+	subscribers []*subscriber
+	cursor      int
+	exit        chan struct{}
+	done        chan struct{}
+	mtx         sync.RWMutex
+}
+
+// add ignores a subscriber that is already in the group since patterns may join a new topic twice
+func (g *group) add(sub *subscriber) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	for _, s := range g.subscribers {
+		if s.id == sub.id {
+			return
+		}
+	}
+
+	g.subscribers = append(g.subscribers, sub)
+}
+
+// remove reports whether the group is left without subscribers
+func (g *group) remove(sub *subscriber) bool {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	for i, s := range g.subscribers {
+		if s.id == sub.id {
+			g.subscribers = append(g.subscribers[:i], g.subscribers[i+1:]...)
+			break
+		}
+	}
+
+	return len(g.subscribers) == 0
+}
+
+func (g *group) next() *subscriber {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	if len(g.subscribers) == 0 {
+		return nil
+	}
+
+	sub := g.subscribers[g.cursor%len(g.subscribers)]
+
+	g.cursor++
+
+	return sub
+}
+
+func (g *group) run(offset uint64) {
+	defer close(g.done)
+
+	c := &cursor{log: g.log, offset: offset}
+	defer c.closeFile()
+
+	for {
+		select {
+		case <-g.exit:
+			return
+		default:
+		}
+
+		wait := g.log.wait()
+
+		rec, err := c.next()
+		if err != nil {
+			log.Errorf("failed to read topic %s for group %s: %v", g.topic, g.name, err)
+
+			select {
+			case <-g.exit:
+				return
+			case <-time.After(readBackoff):
+			}
+
+			continue
+		}
+
+		if rec == nil {
+			select {
+			case <-g.exit:
+				return
+			case <-wait:
+			}
+
+			continue
+		}
+
+		if !g.handle(rec) {
+			return
+		}
+	}
+}
+
+// handle redelivers the record until it is acked so that the committed offset never skips it
+func (g *group) handle(rec *record) bool {
+	attempts := 1
+
+	for {
+		sub := g.next()
+		if sub == nil {
+			return false
+		}
+
+		a := &acknowledger{group: g, offset: rec.Offset}
+
+		msg := broker.NewMessage(a)
+		msg.Id = strconv.FormatUint(rec.Offset, 10)
+		msg.Topic = g.topic
+		msg.Body = rec.Body
+		msg.Timestamp = rec.Timestamp
+		msg.Attempts = attempts
+
+		for k, v := range rec.Header {
+			msg.Header[k] = v
+		}
+
+		msg.Context = broker.ExtractTraceHeaders(context.Background(), msg.Header)
+
+		if err := sub.Handler(msg); err != nil {
+			log.Errorf("failed to handle message %s from group %s: %v", msg.Id, g.name, err)
+		}
+
+		acked, delay := a.Result(attempts)
+		if acked {
+			return true
+		}
+
+		if !a.Deferred() {
+			attempts++
+		}
+
+		select {
+		case <-g.exit:
+			return false
+		case <-time.After(delay):
+		}
+	}
+}
+
+// commit stores the offset of the next message the group should read
+func (g *group) commit(offset uint64) error {
+	if len(g.path) == 0 {
+		return nil
+	}
+
+	tmp := g.path + ".tmp"
+
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(offset, 10)), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, g.path)
+}
+
+// offset loads the committed offset of a durable group, and new groups start at the end of the log unless fromStart is set
+func (g *group) offset(fromStart bool) (uint64, error) {
+	start := g.log.end()
+	if fromStart {
+		start = 0
+	}
+
+	if len(g.path) == 0 {
+		return start, nil
+	}
+
+	bs, err := os.ReadFile(g.path)
+	if os.IsNotExist(err) {
+		return start, g.commit(start)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(bs)), 10, 64)
+}
+
+func newGroup(name, topic string, l *topicLog, durable bool) (*group, error) {
+	g := &group{
+		name:        name,
+		topic:       topic,
+		log:         l,
+		subscribers: []*subscriber{},
+		exit:        make(chan struct{}),
+		done:        make(chan struct{}),
+		mtx:         sync.RWMutex{},
+	}
+
+	if !durable {
+		return g, nil
+	}
+
+	dir := filepath.Join(l.dir, "groups")
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	g.path = filepath.Join(dir, escape(name)+".offset")
+
+	return g, nil
+}
+
+type acknowledger struct {
+	broker.Settlement
+	group  *group
+	offset uint64
+}
+
+func (a *acknowledger) Ack() error {
+	if err := a.group.commit(a.offset + 1); err != nil {
+		return err
+	}
+
+	return a.Settlement.Ack()
+}
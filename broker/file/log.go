@@ -0,0 +1,416 @@
+package file
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentExt = ".log"
+	// every record is framed by its length and checksum
+	frameSize = 8
+)
+
+var (
+	ErrCorruptRecord = errors.New("corrupt record")
+)
+
+type record struct {
+	Offset    uint64            `json:"offset"`
+	Header    map[string]string `json:"header"`
+	Body      []byte            `json:"body"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+type topicLog struct {
+	dir           string
+	segmentSize   int64
+	retentionAge  time.Duration
+	retentionSize int64
+	segments      []uint64
+	active        *os.File
+	activeSize    int64
+	next          uint64
+	notify        chan struct{}
+	mtx           sync.RWMutex
+}
+
+func (l *topicLog) append(header map[string]string, body []byte) (uint64, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	bs, err := encodeRecord(record{
+		Offset:    l.next,
+		Header:    header,
+		Body:      body,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if l.activeSize > 0 && l.activeSize+int64(len(bs)) > l.segmentSize {
+		if err := l.roll(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := l.active.Write(bs)
+	if err != nil {
+		return 0, err
+	}
+
+	offset := l.next
+
+	l.next++
+	l.activeSize += int64(n)
+
+	// wake up every group waiting on the end of the log
+	close(l.notify)
+	l.notify = make(chan struct{})
+
+	return offset, nil
+}
+
+// wait returns a channel that is closed once the next message is appended
+func (l *topicLog) wait() <-chan struct{} {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+
+	return l.notify
+}
+
+func (l *topicLog) end() uint64 {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+
+	return l.next
+}
+
+func (l *topicLog) roll() error {
+	if err := l.active.Close(); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(l.segmentPath(l.next), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	l.segments = append(l.segments, l.next)
+	l.active = f
+	l.activeSize = 0
+
+	return l.retain()
+}
+
+// retain deletes the oldest inactive segments that are past the retention age or size
+func (l *topicLog) retain() error {
+	if l.retentionAge <= 0 && l.retentionSize <= 0 {
+		return nil
+	}
+
+	sizes := make([]int64, len(l.segments))
+	modTimes := make([]time.Time, len(l.segments))
+
+	total := int64(0)
+
+	for i, base := range l.segments {
+		info, err := os.Stat(l.segmentPath(base))
+		if err != nil {
+			return err
+		}
+		sizes[i] = info.Size()
+		modTimes[i] = info.ModTime()
+		total += info.Size()
+	}
+
+	removed := 0
+
+	for i := 0; i < len(l.segments)-1; i++ {
+		expired := l.retentionAge > 0 && time.Since(modTimes[i]) > l.retentionAge
+		oversized := l.retentionSize > 0 && total > l.retentionSize
+
+		if !expired && !oversized {
+			break
+		}
+
+		if err := os.Remove(l.segmentPath(l.segments[i])); err != nil {
+			return err
+		}
+
+		total -= sizes[i]
+		removed++
+	}
+
+	l.segments = l.segments[removed:]
+
+	return nil
+}
+
+// expire rolls an active segment that is past the retention age so that the logs of quiet topics are removed as well
+func (l *topicLog) expire() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.retentionAge <= 0 {
+		return nil
+	}
+
+	if l.activeSize > 0 {
+		info, err := l.active.Stat()
+		if err != nil {
+			return err
+		}
+
+		if time.Since(info.ModTime()) > l.retentionAge {
+			return l.roll()
+		}
+	}
+
+	return l.retain()
+}
+
+func (l *topicLog) segmentPath(base uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d%s", base, segmentExt))
+}
+
+// segmentFor finds the segment that holds the offset, moving past segments that retention removed
+func (l *topicLog) segmentFor(offset uint64) (uint64, uint64) {
+	if offset < l.segments[0] {
+		return l.segments[0], l.segments[0]
+	}
+
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i] > offset
+	})
+
+	return l.segments[i-1], offset
+}
+
+// recover truncates a torn record left at the end of the active segment by a crash
+func (l *topicLog) recover() error {
+	base := l.segments[len(l.segments)-1]
+
+	f, err := os.OpenFile(l.segmentPath(base), os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+
+	size := int64(0)
+	next := base
+
+	for {
+		rec, n, err := decodeRecord(r)
+		if err != nil {
+			break
+		}
+		size += int64(n)
+		next = rec.Offset + 1
+	}
+
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	l.active = f
+	l.activeSize = size
+	l.next = next
+
+	return nil
+}
+
+func openLog(dir string, segmentSize int64, retentionAge time.Duration, retentionSize int64) (*topicLog, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &topicLog{
+		dir:           dir,
+		segmentSize:   segmentSize,
+		retentionAge:  retentionAge,
+		retentionSize: retentionSize,
+		segments:      []uint64{},
+		notify:        make(chan struct{}),
+		mtx:           sync.RWMutex{},
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		l.segments = append(l.segments, base)
+	}
+
+	if len(l.segments) == 0 {
+		f, err := os.OpenFile(l.segmentPath(0), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+
+		f.Close()
+
+		l.segments = append(l.segments, 0)
+	}
+
+	sort.Slice(l.segments, func(i, j int) bool {
+		return l.segments[i] < l.segments[j]
+	})
+
+	if err := l.recover(); err != nil {
+		return nil, err
+	}
+
+	if err := l.retain(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// cursor reads a topic log from a given offset onwards
+type cursor struct {
+	log    *topicLog
+	offset uint64
+	base   uint64
+	file   *os.File
+	reader *bufio.Reader
+}
+
+// next returns the record at the cursor's offset or nil when the cursor reached the end of the log
+func (c *cursor) next() (*record, error) {
+	c.log.mtx.RLock()
+	defer c.log.mtx.RUnlock()
+
+	for c.offset < c.log.next {
+		base, offset := c.log.segmentFor(c.offset)
+
+		if c.file == nil || base != c.base || offset != c.offset {
+			if err := c.open(base); err != nil {
+				return nil, err
+			}
+			c.offset = offset
+		}
+
+		rec, _, err := decodeRecord(c.reader)
+		if err == io.EOF {
+			c.closeFile()
+			return nil, fmt.Errorf("%w: offset %d is missing from segment %d", ErrCorruptRecord, c.offset, base)
+		}
+
+		if err != nil {
+			c.closeFile()
+			return nil, err
+		}
+
+		if rec.Offset < c.offset {
+			continue
+		}
+
+		c.offset = rec.Offset + 1
+
+		return rec, nil
+	}
+
+	return nil, nil
+}
+
+func (c *cursor) open(base uint64) error {
+	c.closeFile()
+
+	f, err := os.Open(c.log.segmentPath(base))
+	if err != nil {
+		return err
+	}
+
+	c.base = base
+	c.file = f
+	c.reader = bufio.NewReader(f)
+
+	return nil
+}
+
+func (c *cursor) closeFile() {
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+		c.reader = nil
+	}
+}
+
+func encodeRecord(rec record) ([]byte, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	bs := make([]byte, frameSize+len(payload))
+
+	binary.BigEndian.PutUint32(bs[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(bs[4:8], crc32.ChecksumIEEE(payload))
+
+	copy(bs[frameSize:], payload)
+
+	return bs, nil
+}
+
+func decodeRecord(r io.Reader) (*record, int, error) {
+	frame := make([]byte, frameSize)
+
+	if _, err := io.ReadFull(r, frame); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, ErrCorruptRecord
+		}
+		return nil, 0, err
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint32(frame[0:4]))
+
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, ErrCorruptRecord
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(frame[4:8]) {
+		return nil, 0, ErrCorruptRecord
+	}
+
+	rec := &record{}
+
+	if err := json.Unmarshal(payload, rec); err != nil {
+		return nil, 0, ErrCorruptRecord
+	}
+
+	return rec, frameSize + len(payload), nil
+}
@@ -0,0 +1,74 @@
+package file
+
+import (
+	"context"
+	"time"
+
+	"github.com/w-h-a/pkg/broker"
+)
+
+type dirKey struct{}
+type segmentSizeKey struct{}
+type retentionAgeKey struct{}
+type retentionSizeKey struct{}
+type retentionIntervalKey struct{}
+
+// FileWithDir sets the directory that holds the topic logs and group offsets
+func FileWithDir(dir string) broker.BrokerOption {
+	return func(o *broker.BrokerOptions) {
+		o.Context = context.WithValue(o.Context, dirKey{}, dir)
+	}
+}
+
+func GetDirFromContext(ctx context.Context) (string, bool) {
+	dir, ok := ctx.Value(dirKey{}).(string)
+	return dir, ok
+}
+
+// FileWithSegmentSize sets the size in bytes at which a topic log rolls over to a new segment
+func FileWithSegmentSize(n int64) broker.BrokerOption {
+	return func(o *broker.BrokerOptions) {
+		o.Context = context.WithValue(o.Context, segmentSizeKey{}, n)
+	}
+}
+
+func GetSegmentSizeFromContext(ctx context.Context) (int64, bool) {
+	n, ok := ctx.Value(segmentSizeKey{}).(int64)
+	return n, ok
+}
+
+// FileWithRetentionAge deletes segments once their newest message is older than the given age
+func FileWithRetentionAge(d time.Duration) broker.BrokerOption {
+	return func(o *broker.BrokerOptions) {
+		o.Context = context.WithValue(o.Context, retentionAgeKey{}, d)
+	}
+}
+
+func GetRetentionAgeFromContext(ctx context.Context) (time.Duration, bool) {
+	d, ok := ctx.Value(retentionAgeKey{}).(time.Duration)
+	return d, ok
+}
+
+// FileWithRetentionSize deletes the oldest segments once a topic log grows past the given size in bytes
+func FileWithRetentionSize(n int64) broker.BrokerOption {
+	return func(o *broker.BrokerOptions) {
+		o.Context = context.WithValue(o.Context, retentionSizeKey{}, n)
+	}
+}
+
+func GetRetentionSizeFromContext(ctx context.Context) (int64, bool) {
+	n, ok := ctx.Value(retentionSizeKey{}).(int64)
+	return n, ok
+}
+
+// FileWithRetentionInterval sets how often topic logs are checked for segments past the retention age
+func FileWithRetentionInterval(d time.Duration) broker.BrokerOption {
+	return func(o *broker.BrokerOptions) {
+		o.Context = context.WithValue(o.Context, retentionIntervalKey{}, d)
+	}
+}
+
+func GetRetentionIntervalFromContext(ctx context.Context) (time.Duration, bool) {
+	d, ok := ctx.Value(retentionIntervalKey{}).(time.Duration)
+	return d, ok
+}
@@ -0,0 +1,49 @@
+package file
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/utils/retryutils"
+)
+
+type subscriber struct {
+	options  broker.SubscribeOptions
+	id       string
+	handler  broker.HandlerFunc
+	broker   *fileBroker
+	handling atomic.Int64
+}
+
+func (s *subscriber) Options() broker.SubscribeOptions {
+	return s.options
+}
+
+func (s *subscriber) Id() string {
+	return s.id
+}
+
+func (s *subscriber) Handler(msg *broker.Message) error {
+	s.handling.Add(1)
+	defer s.handling.Add(-1)
+
+	// the group waits on this message so that ordering is kept
+	return broker.HandleMessage(s.options, msg, s.handler, retry, s.deadLetter)
+}
+
+func (s *subscriber) Unsubscribe(ctx context.Context) error {
+	return s.broker.unsubscribe(ctx, s)
+}
+
+func (s *subscriber) String() string {
+	return "file"
+}
+
+func (s *subscriber) deadLetter(topic string, msg *broker.Message, header map[string]string) error {
+	return s.broker.append(topic, header, msg.Body)
+}
+
+func retry(msg *broker.Message) error {
+	return msg.Nack(retryutils.ExponentialBackoff(msg.Attempts))
+}
@@ -0,0 +1,18 @@
+package kafka
+
+import (
+	"context"
+
+	"github.com/segmentio/kafka-go"
+)
+
+type Writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+type Reader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
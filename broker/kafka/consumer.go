@@ -0,0 +1,124 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/telemetry/log"
+)
+
+const (
+	fetchBackoff = time.Second
+)
+
+type consumer struct {
+	sub    *subscriber
+	reader Reader
+}
+
+func (c *consumer) run() {
+	defer c.sub.wg.Done()
+
+	defer c.reader.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		<-c.sub.exit
+		cancel()
+	}()
+
+	for {
+		kmsg, err := c.reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.Errorf("failed to fetch message for group %s: %v", c.sub.options.Group, err)
+
+			select {
+			case <-c.sub.exit:
+				return
+			case <-time.After(fetchBackoff):
+			}
+
+			continue
+		}
+
+		// a message fetched as the subscriber left is not committed, so the group gets it again
+		select {
+		case <-c.sub.exit:
+			return
+		default:
+		}
+
+		c.handle(kmsg)
+	}
+}
+
+// handle redelivers the message in place until it is acked so that later offsets are not committed past it
+func (c *consumer) handle(kmsg kafka.Message) {
+	attempts := 1
+
+	for {
+		a := &acknowledger{reader: c.reader, msg: kmsg}
+
+		msg := broker.NewMessage(a)
+		msg.Id = fmt.Sprintf("%d-%d", kmsg.Partition, kmsg.Offset)
+		msg.Topic = kmsg.Topic
+		msg.Body = kmsg.Value
+		msg.Timestamp = kmsg.Time
+		msg.Attempts = attempts
+
+		for _, h := range kmsg.Headers {
+			msg.Header[h.Key] = string(h.Value)
+		}
+
+		msg.Context = broker.ExtractTraceHeaders(context.Background(), msg.Header)
+
+		if err := c.sub.Handler(msg); err != nil {
+			log.Errorf("failed to handle message %s from group %s: %v", msg.Id, c.sub.options.Group, err)
+		}
+
+		acked, delay := a.Result(attempts)
+		if acked {
+			return
+		}
+
+		if !a.Deferred() {
+			attempts++
+		}
+
+		select {
+		case <-c.sub.exit:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func newConsumer(sub *subscriber, reader Reader) *consumer {
+	return &consumer{
+		sub:    sub,
+		reader: reader,
+	}
+}
+
+type acknowledger struct {
+	broker.Settlement
+	reader Reader
+	msg    kafka.Message
+}
+
+func (a *acknowledger) Ack() error {
+	if err := a.reader.CommitMessages(context.Background(), a.msg); err != nil {
+		return err
+	}
+
+	return a.Settlement.Ack()
+}
@@ -0,0 +1,179 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/segmentio/kafka-go"
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/utils/datautils"
+)
+
+const (
+	defaultBatchTimeout = 10 * time.Millisecond
+)
+
+type kafkaBroker struct {
+	options   broker.BrokerOptions
+	scheduler *broker.Scheduler
+	writer    Writer
+}
+
+func (b *kafkaBroker) Options() broker.BrokerOptions {
+	return b.options
+}
+
+func (b *kafkaBroker) Publish(data interface{}, options broker.PublishOptions) error {
+	return broker.WrapPublish(b.options, b.publish)(data, options)
+}
+
+func (b *kafkaBroker) publish(data interface{}, options broker.PublishOptions) error {
+	if broker.DeliveryDelay(options) > 0 {
+		if b.scheduler == nil {
+			return broker.ErrSchedulerRequired
+		}
+		return b.scheduler.Schedule(data, options)
+	}
+
+	bs, err := datautils.Stringify(data)
+	if err != nil {
+		return err
+	}
+
+	msg := kafka.Message{
+		Topic: options.Topic,
+		Value: bs,
+		Time:  time.Now(),
+	}
+
+	// messages without a key are spread across partitions
+	if len(options.Key) > 0 {
+		msg.Key = []byte(options.Key)
+	}
+
+	for k, v := range broker.InjectTraceHeaders(options.Context, options.Header) {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: k, Value: []byte(v)})
+	}
+
+	return broker.RetryPublish(options, retryCheck, func(ctx context.Context) error {
+		return b.writer.WriteMessages(ctx, msg)
+	})
+}
+
+func (b *kafkaBroker) Subscribe(callback func(*broker.Message) error, options broker.SubscribeOptions) broker.Subscriber {
+	handler := broker.WrapHandler(b.options, callback)
+
+	sub := &subscriber{
+		options: options,
+		id:      uuid.New().String(),
+		handler: handler,
+		writer:  b.writer,
+		exit:    make(chan struct{}),
+	}
+
+	sub.wg.Add(1)
+
+	go newConsumer(sub, b.reader(sub)).run()
+
+	return sub
+}
+
+// Close stops polling the scheduler store
+func (b *kafkaBroker) Close() error {
+	if b.scheduler != nil {
+		b.scheduler.Stop()
+	}
+
+	return nil
+}
+
+// SubscribesToTopic marks the broker as one that Request can take replies on
+func (b *kafkaBroker) SubscribesToTopic() {}
+
+func (b *kafkaBroker) String() string {
+	return "kafka"
+}
+
+func (b *kafkaBroker) reader(sub *subscriber) Reader {
+	if r, ok := GetReaderFromContext(sub.options.Context); ok {
+		return r
+	}
+
+	topic := broker.SubscriptionTopic(sub.options)
+	group := broker.SubscriptionGroup(sub.options, sub.id)
+
+	startOffset := kafka.LastOffset
+	if offset, ok := GetStartOffsetFromContext(sub.options.Context); ok {
+		startOffset = offset
+	}
+
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     b.options.Nodes,
+		GroupID:     group,
+		Topic:       topic,
+		StartOffset: startOffset,
+	})
+}
+
+func (b *kafkaBroker) configure() error {
+	if len(b.options.Nodes) == 0 {
+		return fmt.Errorf("broker addresses are required")
+	}
+
+	if w, ok := GetWriterFromContext(b.options.Context); ok {
+		b.writer = w
+		return nil
+	}
+
+	batchTimeout := defaultBatchTimeout
+	if d, ok := GetBatchTimeoutFromContext(b.options.Context); ok && d > 0 {
+		batchTimeout = d
+	}
+
+	b.writer = &kafka.Writer{
+		Addr:                   kafka.TCP(b.options.Nodes...),
+		Balancer:               &kafka.Hash{},
+		BatchTimeout:           batchTimeout,
+		RequiredAcks:           kafka.RequireAll,
+		AllowAutoTopicCreation: true,
+	}
+
+	return nil
+}
+
+// retryCheck looks into the per-message errors that the writer returns
+func retryCheck(ctx context.Context, retryCount int, err error) (bool, error) {
+	var errs kafka.WriteErrors
+	if errors.As(err, &errs) {
+		for _, err := range errs {
+			if broker.IsTransient(err) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	return broker.IsTransient(err), nil
+}
+
+func NewBroker(opts ...broker.BrokerOption) broker.Broker {
+	options := broker.NewBrokerOptions(opts...)
+
+	b := &kafkaBroker{
+		options: options,
+	}
+
+	if err := b.configure(); err != nil {
+		log.Fatal(err)
+	}
+
+	if options.SchedulerStore != nil {
+		b.scheduler = broker.NewScheduler(options.SchedulerStore, b.publish)
+	}
+
+	return b
+}
@@ -0,0 +1,185 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+)
+
+type mockWriter struct {
+	msgs []kafka.Message
+	mtx  sync.Mutex
+}
+
+func (w *mockWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.msgs = append(w.msgs, msgs...)
+
+	return nil
+}
+
+func (w *mockWriter) Close() error {
+	return nil
+}
+
+func (w *mockWriter) written() []kafka.Message {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	return append([]kafka.Message{}, w.msgs...)
+}
+
+type mockReader struct {
+	queue   chan kafka.Message
+	commits []kafka.Message
+	mtx     sync.Mutex
+}
+
+func (r *mockReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	case msg := <-r.queue:
+		return msg, nil
+	}
+}
+
+func (r *mockReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.commits = append(r.commits, msgs...)
+
+	return nil
+}
+
+func (r *mockReader) Close() error {
+	return nil
+}
+
+func (r *mockReader) committed() []kafka.Message {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return append([]kafka.Message{}, r.commits...)
+}
+
+func TestPublish(t *testing.T) {
+	writer := &mockWriter{}
+
+	b := NewBroker(
+		broker.BrokerWithNodes("localhost:9092"),
+		KafkaWithWriter(writer),
+	)
+
+	err := b.Publish("hello", broker.NewPublishOptions(
+		broker.PublishWithTopic("orders"),
+		broker.PublishWithKey("customer-1"),
+		broker.PublishWithHeader("foo", "bar"),
+	))
+	require.NoError(t, err)
+
+	msgs := writer.written()
+
+	require.Len(t, msgs, 1)
+	require.Equal(t, "orders", msgs[0].Topic)
+	require.Equal(t, []byte("customer-1"), msgs[0].Key)
+	require.Equal(t, []byte("hello"), msgs[0].Value)
+	require.Equal(t, []kafka.Header{{Key: "foo", Value: []byte("bar")}}, msgs[0].Headers)
+}
+
+func TestConsumer(t *testing.T) {
+	log.SetLogger(memory.NewLog(memory.LogWithBuffer(memoryutils.NewBuffer())))
+
+	t.Run("failed messages are redelivered in place before the next offset", func(t *testing.T) {
+		reader := &mockReader{queue: make(chan kafka.Message, 2)}
+
+		reader.queue <- kafka.Message{Topic: "orders", Partition: 0, Offset: 1, Value: []byte("a")}
+		reader.queue <- kafka.Message{Topic: "orders", Partition: 0, Offset: 2, Value: []byte("b")}
+
+		b := NewBroker(
+			broker.BrokerWithNodes("localhost:9092"),
+			KafkaWithWriter(&mockWriter{}),
+		)
+
+		received := make(chan string, 3)
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			received <- string(msg.Body)
+			if msg.Id == "0-1" && msg.Attempts == 1 {
+				return errors.New("boom")
+			}
+			return nil
+		}, broker.NewSubscribeOptions(
+			broker.SubscribeWithTopic("orders"),
+			broker.SubscribeWithGroup("test"),
+			KafkaWithReader(reader),
+		))
+		defer sub.Unsubscribe(context.Background())
+
+		for _, body := range []string{"a", "a", "b"} {
+			select {
+			case got := <-received:
+				require.Equal(t, body, got)
+			case <-time.After(time.Second):
+				t.Fatal("expected the message to be delivered")
+			}
+		}
+
+		require.Eventually(t, func() bool {
+			return len(reader.committed()) == 2
+		}, time.Second, 10*time.Millisecond)
+
+		commits := reader.committed()
+
+		require.Equal(t, int64(1), commits[0].Offset)
+		require.Equal(t, int64(2), commits[1].Offset)
+	})
+
+	t.Run("messages are dead-lettered after the max deliveries", func(t *testing.T) {
+		reader := &mockReader{queue: make(chan kafka.Message, 1)}
+
+		reader.queue <- kafka.Message{Topic: "orders", Partition: 0, Offset: 1, Value: []byte("a")}
+
+		writer := &mockWriter{}
+
+		b := NewBroker(
+			broker.BrokerWithNodes("localhost:9092"),
+			KafkaWithWriter(writer),
+		)
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			return errors.New("boom")
+		}, broker.NewSubscribeOptions(
+			broker.SubscribeWithTopic("orders"),
+			broker.SubscribeWithGroup("test"),
+			broker.SubscribeWithMaxDeliveries(2),
+			broker.SubscribeWithDeadLetterTopic("orders-dlq"),
+			KafkaWithReader(reader),
+		))
+		defer sub.Unsubscribe(context.Background())
+
+		require.Eventually(t, func() bool {
+			return len(reader.committed()) == 1
+		}, 2*time.Second, 10*time.Millisecond)
+
+		msgs := writer.written()
+
+		require.Len(t, msgs, 1)
+		require.Equal(t, "orders-dlq", msgs[0].Topic)
+		require.Equal(t, []byte("a"), msgs[0].Value)
+		require.Contains(t, msgs[0].Headers, kafka.Header{Key: broker.DeadLetterReasonHeader, Value: []byte("boom")})
+		require.Contains(t, msgs[0].Headers, kafka.Header{Key: broker.DeadLetterSourceHeader, Value: []byte("orders")})
+	})
+}
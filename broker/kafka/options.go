@@ -0,0 +1,60 @@
+package kafka
+
+import (
+	"context"
+	"time"
+
+	"github.com/w-h-a/pkg/broker"
+)
+
+type writerKey struct{}
+type batchTimeoutKey struct{}
+
+func KafkaWithWriter(w Writer) broker.BrokerOption {
+	return func(o *broker.BrokerOptions) {
+		o.Context = context.WithValue(o.Context, writerKey{}, w)
+	}
+}
+
+func GetWriterFromContext(ctx context.Context) (Writer, bool) {
+	w, ok := ctx.Value(writerKey{}).(Writer)
+	return w, ok
+}
+
+// KafkaWithBatchTimeout sets how long the writer waits to fill a batch before sending it
+func KafkaWithBatchTimeout(d time.Duration) broker.BrokerOption {
+	return func(o *broker.BrokerOptions) {
+		o.Context = context.WithValue(o.Context, batchTimeoutKey{}, d)
+	}
+}
+
+func GetBatchTimeoutFromContext(ctx context.Context) (time.Duration, bool) {
+	d, ok := ctx.Value(batchTimeoutKey{}).(time.Duration)
+	return d, ok
+}
+
+type readerKey struct{}
+type startOffsetKey struct{}
+
+func KafkaWithReader(r Reader) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		o.Context = context.WithValue(o.Context, readerKey{}, r)
+	}
+}
+
+func GetReaderFromContext(ctx context.Context) (Reader, bool) {
+	r, ok := ctx.Value(readerKey{}).(Reader)
+	return r, ok
+}
+
+// KafkaWithStartOffset sets where a group without committed offsets starts reading (kafka.FirstOffset or kafka.LastOffset)
+func KafkaWithStartOffset(offset int64) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		o.Context = context.WithValue(o.Context, startOffsetKey{}, offset)
+	}
+}
+
+func GetStartOffsetFromContext(ctx context.Context) (int64, bool) {
+	offset, ok := ctx.Value(startOffsetKey{}).(int64)
+	return offset, ok
+}
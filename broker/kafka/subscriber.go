@@ -0,0 +1,64 @@
+package kafka
+
+import (
+	"context"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/utils/retryutils"
+)
+
+type subscriber struct {
+	options broker.SubscribeOptions
+	id      string
+	handler broker.HandlerFunc
+	writer  Writer
+	wg      sync.WaitGroup
+	exit    chan struct{}
+}
+
+func (s *subscriber) Options() broker.SubscribeOptions {
+	return s.options
+}
+
+func (s *subscriber) Id() string {
+	return s.id
+}
+
+func (s *subscriber) Handler(msg *broker.Message) error {
+	// the partition waits on this message so that ordering is kept
+	return broker.HandleMessage(s.options, msg, s.handler, retry, s.deadLetter)
+}
+
+func (s *subscriber) Unsubscribe(ctx context.Context) error {
+	select {
+	case <-s.exit:
+	default:
+		close(s.exit)
+	}
+
+	return broker.WaitForGroup(ctx, &s.wg)
+}
+
+func (s *subscriber) String() string {
+	return "kafka"
+}
+
+func (s *subscriber) deadLetter(topic string, msg *broker.Message, header map[string]string) error {
+	dlq := kafka.Message{
+		Topic: topic,
+		Value: msg.Body,
+		Time:  msg.Timestamp,
+	}
+
+	for k, v := range header {
+		dlq.Headers = append(dlq.Headers, kafka.Header{Key: k, Value: []byte(v)})
+	}
+
+	return s.writer.WriteMessages(context.Background(), dlq)
+}
+
+func retry(msg *broker.Message) error {
+	return msg.Nack(retryutils.ExponentialBackoff(msg.Attempts))
+}
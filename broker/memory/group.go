@@ -0,0 +1,32 @@
+package memory
+
+// group load-balances messages across its subscribers and is guarded by the broker's lock
+type group struct {
+	subscribers []*subscriber
+	cursor      int
+}
+
+func (g *group) next() *subscriber {
+	if len(g.subscribers) == 0 {
+		return nil
+	}
+
+	sub := g.subscribers[g.cursor%len(g.subscribers)]
+
+	g.cursor++
+
+	return sub
+}
+
+func (g *group) remove(id string) {
+	subs := []*subscriber{}
+
+	for _, sub := range g.subscribers {
+		if sub.id == id {
+			continue
+		}
+		subs = append(subs, sub)
+	}
+
+	g.subscribers = subs
+}
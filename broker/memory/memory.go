@@ -1,16 +1,39 @@
 package memory
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/telemetry/log"
 	"github.com/w-h-a/pkg/utils/datautils"
 )
 
+const (
+	defaultQueueSize = 100
+	defaultWorkers   = 1
+)
+
+var (
+	ErrQueueFull     = errors.New("subscriber queue is full")
+	ErrBatchAborted  = errors.New("batch was not published because another message in it is invalid")
+	ErrNoSubscribers = errors.New("group has no subscribers")
+)
+
 type memory struct {
 	options     broker.BrokerOptions
-	subscribers map[string][]broker.Subscriber
+	async       bool
+	subscribers map[string]map[string]*group
+	deadLetters map[string][]*broker.Message
+	wheel       *timerWheel
+	inflight    atomic.Int64
 	mtx         sync.RWMutex
 }
 
@@ -19,76 +42,541 @@ func (b *memory) Options() broker.BrokerOptions {
 }
 
 func (b *memory) Publish(data interface{}, options broker.PublishOptions) error {
-	b.mtx.RLock()
-	subsOfThisTopic, ok := b.subscribers[options.Topic]
-	if !ok {
-		b.mtx.RUnlock()
+	return broker.WrapPublish(b.options, b.publish)(data, options)
+}
+
+func (b *memory) publish(data interface{}, options broker.PublishOptions) error {
+	return b.publishTo(data, options, "")
+}
+
+// publishTo delivers the message to one group of the topic, or to every group when group is empty
+func (b *memory) publishTo(data interface{}, options broker.PublishOptions, group string) error {
+	if options.Context != nil {
+		if err := options.Context.Err(); err != nil {
+			return err
+		}
+	}
+
+	if delay := broker.DeliveryDelay(options); delay > 0 {
+		return b.delay(data, options, delay)
+	}
+
+	b.mtx.Lock()
+	subs := b.pick(options.Topic, group)
+	b.mtx.Unlock()
+
+	if len(subs) == 0 {
+		if len(group) > 0 {
+			return ErrNoSubscribers
+		}
 		return nil
 	}
-	b.mtx.RUnlock()
 
 	bs, err := datautils.Stringify(data)
 	if err != nil {
 		return err
 	}
 
-	for _, sub := range subsOfThisTopic {
-		if err := sub.Handler(bs); err != nil {
-			return err
+	// a failing subscriber must not hide the message from the other groups
+	errs := []error{}
+
+	for _, m := range messages(subs, bs, options) {
+		sub := m.sub
+
+		// publish retries only cover queueing so that a failed handler is not run again by the publisher
+		if sub.queue == nil {
+			err = sub.deliver(options.Context, m.msg)
+		} else {
+			err = broker.RetryPublish(options, nil, func(ctx context.Context) error {
+				return sub.enqueue(ctx, m.msg)
+			})
+		}
+
+		if err != nil {
+			errs = append(errs, err)
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
+}
+
+// pick returns the next subscriber of every group that gets a message published to topic, or of only the named group,
+// and must be called with the broker's lock held
+func (b *memory) pick(topic, group string) []*subscriber {
+	subs := []*subscriber{}
+
+	// every group subscribed to the topic or to a pattern that matches it gets the message once
+	for t, groups := range b.subscribers {
+		if t != topic && !(broker.IsTopicPattern(t) && broker.MatchTopic(t, topic)) {
+			continue
+		}
+
+		for name, g := range groups {
+			if len(group) > 0 && name != group {
+				continue
+			}
+
+			if sub := g.next(); sub != nil {
+				subs = append(subs, sub)
+			}
+		}
+	}
+
+	return subs
+}
+
+// messages builds the copy of a published message that each of the subscribers gets
+func messages(subs []*subscriber, bs []byte, options broker.PublishOptions) []delivery {
+	id := uuid.New().String()
+
+	timestamp := time.Now()
+
+	header := broker.InjectTraceHeaders(options.Context, options.Header)
+
+	ds := make([]delivery, len(subs))
+
+	for i, sub := range subs {
+		msg := &broker.Message{
+			Id:        id,
+			Topic:     options.Topic,
+			Header:    header,
+			Body:      bs,
+			Timestamp: timestamp,
+			Attempts:  1,
+		}
+
+		ds[i] = delivery{sub: sub, msg: newMessage(sub, msg)}
+	}
+
+	return ds
 }
 
-func (b *memory) Subscribe(callback func([]byte) error, options broker.SubscribeOptions) broker.Subscriber {
+// PublishBatch checks every message before delivering any of them so that an invalid message stops the whole batch.
+// The subscribers of all the entries are picked at once, and in async mode every message is queued before any handler
+// runs or none is. In sync mode each handler runs as its entry is delivered, so a failing handler cannot take back the
+// entries delivered before it and only has its own entry reported.
+func (b *memory) PublishBatch(entries []broker.BatchEntry) error {
+	return broker.WrapPublishBatch(b.options, entries, b.publishBatch)
+}
+
+func (b *memory) publishBatch(entries []broker.BatchEntry) error {
+	errs := make([]error, len(entries))
+	bss := make([][]byte, len(entries))
+
+	failed := false
+
+	for i, entry := range entries {
+		if entry.Options.Context != nil {
+			if err := entry.Options.Context.Err(); err != nil {
+				errs[i] = err
+				failed = true
+				continue
+			}
+		}
+
+		bs, err := datautils.Stringify(entry.Data)
+		if err != nil {
+			errs[i] = err
+			failed = true
+			continue
+		}
+		bss[i] = bs
+	}
+
+	if failed {
+		return abort(errs)
+	}
+
 	b.mtx.Lock()
 
+	subs := make([][]*subscriber, len(entries))
+
+	for i, entry := range entries {
+		if broker.DeliveryDelay(entry.Options) > 0 {
+			continue
+		}
+		subs[i] = b.pick(entry.Options.Topic, "")
+	}
+
+	b.mtx.Unlock()
+
+	queued := []delivery{}
+	direct := [][]delivery{}
+
+	for i, entry := range entries {
+		ds := messages(subs[i], bss[i], entry.Options)
+
+		for _, d := range ds {
+			if d.sub.queue != nil {
+				queued = append(queued, d)
+			}
+		}
+
+		direct = append(direct, ds)
+	}
+
+	if len(queued) > 0 {
+		ctx, cancel := batchContext(entries)
+		err := enqueueBatch(ctx, queued)
+		cancel()
+
+		if err != nil {
+			for i := range errs {
+				errs[i] = err
+			}
+			return &broker.BatchError{Errors: errs}
+		}
+	}
+
+	for i, entry := range entries {
+		if delay := broker.DeliveryDelay(entry.Options); delay > 0 {
+			errs[i] = b.delay(bss[i], entry.Options, delay)
+			failed = failed || errs[i] != nil
+			continue
+		}
+
+		// a failing subscriber must not hide the message from the other groups
+		deliveryErrs := []error{}
+
+		for _, d := range direct[i] {
+			if d.sub.queue != nil {
+				continue
+			}
+			if err := d.sub.deliver(entry.Options.Context, d.msg); err != nil {
+				deliveryErrs = append(deliveryErrs, err)
+			}
+		}
+
+		if err := errors.Join(deliveryErrs...); err != nil {
+			errs[i] = err
+			failed = true
+		}
+	}
+
+	if failed {
+		return &broker.BatchError{Errors: errs}
+	}
+
+	return nil
+}
+
+// abort fails the entries that are fine with ErrBatchAborted alongside the ones that are not
+func abort(errs []error) error {
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = ErrBatchAborted
+		}
+	}
+
+	return &broker.BatchError{Errors: errs}
+}
+
+// batchContext is done as soon as the context of any entry is done
+func batchContext(entries []broker.BatchEntry) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	stops := []func() bool{}
+
+	for _, entry := range entries {
+		parent := entry.Options.Context
+		if parent == nil {
+			continue
+		}
+
+		stops = append(stops, context.AfterFunc(parent, func() {
+			cancel(context.Cause(parent))
+		}))
+	}
+
+	return ctx, func() {
+		for _, stop := range stops {
+			stop()
+		}
+		cancel(nil)
+	}
+}
+
+// delay holds the message on the timer wheel and publishes it to the subscribers of the topic at that time
+func (b *memory) delay(data interface{}, options broker.PublishOptions, delay time.Duration) error {
+	bs, err := datautils.Stringify(data)
+	if err != nil {
+		return err
+	}
+
+	// the publisher's context may be gone by the time the message is due
+	options.Header = broker.InjectTraceHeaders(options.Context, options.Header)
+	options.Context = context.Background()
+	options.Delay = 0
+	options.DeliverAt = time.Time{}
+
+	// the message counts as in flight while it waits so that Drain does not return ahead of it
+	b.inflight.Add(1)
+
+	b.wheel.schedule(delay, func() {
+		defer b.inflight.Add(-1)
+
+		if err := b.publish(bs, options); err != nil {
+			log.Errorf("failed to publish delayed message to topic %s: %v", options.Topic, err)
+		}
+	})
+
+	return nil
+}
+
+func (b *memory) Subscribe(callback func(*broker.Message) error, options broker.SubscribeOptions) broker.Subscriber {
+	handler := broker.WrapHandler(b.options, callback)
+
 	sub := &subscriber{
 		options: options,
 		id:      uuid.New().String(),
-		handler: callback,
+		handler: handler,
+		broker:  b,
 		exit:    make(chan struct{}, 1),
 	}
 
-	b.subscribers[options.Group] = append(b.subscribers[options.Group], sub)
+	if b.async {
+		size := defaultQueueSize
+		if n, ok := GetQueueSizeFromContext(options.Context); ok && n > 0 {
+			size = n
+		}
+
+		workers := defaultWorkers
+		if n, ok := GetWorkersFromContext(options.Context); ok && n > 0 {
+			workers = n
+		}
+
+		if p, ok := GetOverflowPolicyFromContext(options.Context); ok {
+			sub.policy = p
+		}
+
+		sub.queue = make(chan *broker.Message, size)
+
+		for i := 0; i < workers; i++ {
+			go sub.work()
+		}
+	}
+
+	sub.topic = broker.SubscriptionTopic(options)
+	sub.group = broker.SubscriptionGroup(options, sub.id)
+
+	b.mtx.Lock()
+
+	groups, ok := b.subscribers[sub.topic]
+	if !ok {
+		groups = map[string]*group{}
+		b.subscribers[sub.topic] = groups
+	}
+
+	g, ok := groups[sub.group]
+	if !ok {
+		g = &group{}
+		groups[sub.group] = g
+	}
+
+	g.subscribers = append(g.subscribers, sub)
 
 	b.mtx.Unlock()
 
-	go func() {
-		<-sub.exit
+	return sub
+}
+
+// Drain waits until every queued, in-flight, or pending redelivery has been handled
+func (b *memory) Drain(ctx context.Context) error {
+	return broker.WaitFor(ctx, func() bool {
+		return b.inflight.Load() == 0
+	})
+}
 
-		b.mtx.Lock()
+// Inspect reports the exact number of messages queued for and being handled by each group
+func (b *memory) Inspect(ctx context.Context) ([]broker.TopicInfo, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	topics := []broker.TopicInfo{}
+
+	for topic, groups := range b.subscribers {
+		info := broker.TopicInfo{
+			Topic:  topic,
+			Groups: []broker.GroupInfo{},
+		}
+
+		for name, g := range groups {
+			group := broker.GroupInfo{
+				Group:       name,
+				Subscribers: []string{},
+			}
+
+			for _, sub := range g.subscribers {
+				group.Subscribers = append(group.Subscribers, sub.id)
+				group.InFlight += sub.handling.Load()
+				group.Lag += int64(len(sub.queue))
+			}
+
+			info.Groups = append(info.Groups, group)
+		}
+
+		slices.SortFunc(info.Groups, func(a, b broker.GroupInfo) int {
+			return strings.Compare(a.Group, b.Group)
+		})
+
+		topics = append(topics, info)
+	}
+
+	slices.SortFunc(topics, func(a, b broker.TopicInfo) int {
+		return strings.Compare(a.Topic, b.Topic)
+	})
+
+	return topics, nil
+}
+
+func (b *memory) DeadLetters(topic string) ([]*broker.Message, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
 
-		newSubsForThisGroup := []broker.Subscriber{}
+	msgs := make([]*broker.Message, len(b.deadLetters[topic]))
 
-		for _, subscriber := range b.subscribers[options.Group] {
-			if subscriber.Id() == sub.id {
+	copy(msgs, b.deadLetters[topic])
+
+	return msgs, nil
+}
+
+// Replay republishes the dead letters to the groups that dead-lettered them and keeps the ones that fail to publish
+func (b *memory) Replay(topic string, ids ...string) error {
+	b.mtx.RLock()
+
+	replay := []*broker.Message{}
+
+	for _, msg := range b.deadLetters[topic] {
+		if len(ids) == 0 || slices.Contains(ids, msg.Id) {
+			replay = append(replay, msg)
+		}
+	}
+
+	b.mtx.RUnlock()
+
+	errs := []error{}
+
+	for _, msg := range replay {
+		header := map[string]string{}
+
+		for k, v := range msg.Header {
+			if k == broker.DeadLetterReasonHeader || k == broker.DeadLetterSourceHeader || k == broker.DeadLetterGroupHeader {
 				continue
 			}
-			newSubsForThisGroup = append(newSubsForThisGroup, subscriber)
+			header[k] = v
+		}
+
+		options := broker.PublishOptions{
+			Topic:   msg.Header[broker.DeadLetterSourceHeader],
+			Header:  header,
+			Context: context.Background(),
 		}
 
-		b.subscribers[options.Group] = newSubsForThisGroup
+		group := msg.Header[broker.DeadLetterGroupHeader]
+
+		// the other groups of the topic already handled the message
+		publish := broker.WrapPublish(b.options, func(data interface{}, options broker.PublishOptions) error {
+			return b.publishTo(data, options, group)
+		})
+
+		if err := publish(msg.Body, options); err != nil {
+			errs = append(errs, fmt.Errorf("failed to replay message %s: %w", msg.Id, err))
+			continue
+		}
 
+		b.mtx.Lock()
+		b.deadLetters[topic] = slices.DeleteFunc(b.deadLetters[topic], func(m *broker.Message) bool {
+			return m == msg
+		})
 		b.mtx.Unlock()
-	}()
+	}
 
-	return sub
+	return errors.Join(errs...)
 }
 
+// SubscribesToTopic marks the broker as one that Request can take replies on
+func (b *memory) SubscribesToTopic() {}
+
 func (b *memory) String() string {
 	return "memory"
 }
 
+// unsubscribe takes the subscriber out of its group so that no publish picks it from then on
+func (b *memory) unsubscribe(sub *subscriber) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	g, ok := b.subscribers[sub.topic][sub.group]
+	if !ok {
+		return
+	}
+
+	g.remove(sub.id)
+
+	if len(g.subscribers) == 0 {
+		delete(b.subscribers[sub.topic], sub.group)
+	}
+
+	if len(b.subscribers[sub.topic]) == 0 {
+		delete(b.subscribers, sub.topic)
+	}
+}
+
+func (b *memory) next(topic, grp string) *subscriber {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	g, ok := b.subscribers[topic][grp]
+	if !ok {
+		return nil
+	}
+
+	return g.next()
+}
+
+// deadLetter keeps the message for Replay, so a failure to publish it to the dead-letter topic is only logged
+func (b *memory) deadLetter(topic string, msg *broker.Message, header map[string]string) error {
+	deadLetter := &broker.Message{
+		Id:        msg.Id,
+		Topic:     topic,
+		Header:    header,
+		Body:      msg.Body,
+		Timestamp: time.Now(),
+		Attempts:  msg.Attempts,
+	}
+
+	b.mtx.Lock()
+	b.deadLetters[topic] = append(b.deadLetters[topic], deadLetter)
+	b.mtx.Unlock()
+
+	// subscribers of the dead-letter topic get it like they would on the other brokers
+	options := broker.PublishOptions{
+		Topic:   topic,
+		Header:  header,
+		Context: context.Background(),
+	}
+
+	if err := b.publish(msg.Body, options); err != nil {
+		log.Errorf("failed to publish message %s to dead-letter topic %s: %v", msg.Id, topic, err)
+	}
+
+	return nil
+}
+
 func NewBroker(opts ...broker.BrokerOption) broker.Broker {
 	options := broker.NewBrokerOptions(opts...)
 
 	b := &memory{
 		options:     options,
-		subscribers: map[string][]broker.Subscriber{},
+		subscribers: map[string]map[string]*group{},
+		deadLetters: map[string][]*broker.Message{},
+		wheel:       newTimerWheel(defaultWheelTick, defaultWheelSlots),
 		mtx:         sync.RWMutex{},
 	}
 
+	if async, ok := GetAsyncFromContext(options.Context); ok {
+		b.async = async
+	}
+
 	return b
 }
@@ -0,0 +1,1060 @@
+package memory
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/telemetry/log"
+	logmemory "github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/telemetry/tracev2"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLogger(logmemory.NewLog(logmemory.LogWithBuffer(memoryutils.NewBuffer())))
+
+	os.Exit(m.Run())
+}
+
+func TestPublish(t *testing.T) {
+	b := NewBroker()
+
+	received := make(chan *broker.Message, 1)
+
+	sub := b.Subscribe(func(msg *broker.Message) error {
+		received <- msg
+		return nil
+	}, broker.NewSubscribeOptions(broker.SubscribeWithGroup("test")))
+	defer sub.Unsubscribe(context.Background())
+
+	err := b.Publish("hello", broker.NewPublishOptions(
+		broker.PublishWithTopic("test"),
+		broker.PublishWithHeader("foo", "bar"),
+	))
+	require.NoError(t, err)
+
+	msg := <-received
+	require.NotEmpty(t, msg.Id)
+	require.Equal(t, "test", msg.Topic)
+	require.Equal(t, []byte("hello"), msg.Body)
+	require.Equal(t, "bar", msg.Header["foo"])
+	require.Equal(t, 1, msg.Attempts)
+	require.False(t, msg.Timestamp.IsZero())
+	require.True(t, msg.Settled())
+	require.Equal(t, broker.ErrMessageSettled, msg.Ack())
+}
+
+func TestPublishRetries(t *testing.T) {
+	b := NewBroker()
+
+	calls := 0
+
+	sub := b.Subscribe(func(msg *broker.Message) error {
+		calls++
+		return errors.New("boom")
+	}, broker.NewSubscribeOptions(broker.SubscribeWithGroup("test")))
+	defer sub.Unsubscribe(context.Background())
+
+	// the handler failed, so retrying the publish would run it again
+	err := b.Publish("hello", broker.NewPublishOptions(
+		broker.PublishWithTopic("test"),
+		broker.PublishWithRetryCount(3),
+		broker.PublishWithRetryCheck(func(ctx context.Context, retryCount int, err error) (bool, error) {
+			return true, nil
+		}),
+		broker.PublishWithBackoff(func(ctx context.Context, attempts int) (time.Duration, error) {
+			return 0, nil
+		}),
+	))
+	require.EqualError(t, err, "boom")
+	require.Equal(t, 1, calls)
+}
+
+func TestFanOut(t *testing.T) {
+	b := NewBroker()
+
+	counts := map[string]int{}
+
+	mtx := sync.Mutex{}
+
+	for _, grp := range []string{"billing", "shipping"} {
+		for i := 0; i < 2; i++ {
+			id := fmt.Sprintf("%s-%d", grp, i)
+
+			sub := b.Subscribe(func(msg *broker.Message) error {
+				mtx.Lock()
+				defer mtx.Unlock()
+				counts[id]++
+				return nil
+			}, broker.NewSubscribeOptions(
+				broker.SubscribeWithTopic("orders"),
+				broker.SubscribeWithGroup(grp),
+			))
+			defer sub.Unsubscribe(context.Background())
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		err := b.Publish("hello", broker.NewPublishOptions(broker.PublishWithTopic("orders")))
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, map[string]int{
+		"billing-0":  2,
+		"billing-1":  2,
+		"shipping-0": 2,
+		"shipping-1": 2,
+	}, counts)
+}
+
+func TestNack(t *testing.T) {
+	b := NewBroker()
+
+	received := make(chan *broker.Message, 2)
+
+	sub := b.Subscribe(func(msg *broker.Message) error {
+		received <- msg
+		if msg.Attempts == 1 {
+			return msg.Nack(10 * time.Millisecond)
+		}
+		return nil
+	}, broker.NewSubscribeOptions(broker.SubscribeWithGroup("test")))
+	defer sub.Unsubscribe(context.Background())
+
+	err := b.Publish("hello", broker.NewPublishOptions(broker.PublishWithTopic("test")))
+	require.NoError(t, err)
+
+	first := <-received
+	require.Equal(t, 1, first.Attempts)
+
+	select {
+	case second := <-received:
+		require.Equal(t, first.Id, second.Id)
+		require.Equal(t, 2, second.Attempts)
+	case <-time.After(time.Second):
+		t.Fatal("expected the nacked message to be redelivered")
+	}
+}
+
+func TestInFlight(t *testing.T) {
+	b := NewBroker()
+
+	received := make(chan *broker.Message, 2)
+
+	// the first delivery finds the message claimed by another handler, as the idempotent wrapper would
+	sub := b.Subscribe(func(msg *broker.Message) error {
+		received <- msg
+		if len(received) == 1 {
+			return broker.ErrMessageInFlight
+		}
+		return nil
+	}, broker.NewSubscribeOptions(
+		broker.SubscribeWithGroup("test"),
+		broker.SubscribeWithMaxDeliveries(1),
+		broker.SubscribeWithDeadLetterTopic("dlq"),
+	))
+	defer sub.Unsubscribe(context.Background())
+
+	err := b.Publish("hello", broker.NewPublishOptions(broker.PublishWithTopic("test")))
+	require.NoError(t, err)
+
+	first := <-received
+	require.Equal(t, 1, first.Attempts)
+
+	select {
+	case second := <-received:
+		require.Equal(t, first.Id, second.Id)
+		require.Equal(t, 1, second.Attempts)
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the message to be redelivered once the original was done with")
+	}
+
+	deadLetters, err := b.(broker.DeadLetterQueue).DeadLetters("dlq")
+	require.NoError(t, err)
+	require.Empty(t, deadLetters)
+}
+
+func TestDeadLetter(t *testing.T) {
+	b := NewBroker()
+
+	attempts := make(chan int, 3)
+
+	fail := true
+
+	handler := func(msg *broker.Message) error {
+		attempts <- msg.Attempts
+		if fail {
+			return errors.New("boom")
+		}
+		return nil
+	}
+
+	options := broker.NewSubscribeOptions(
+		broker.SubscribeWithGroup("test"),
+		broker.SubscribeWithMaxDeliveries(2),
+		broker.SubscribeWithDeadLetterTopic("test-dlq"),
+	)
+
+	sub := b.Subscribe(handler, options)
+	defer sub.Unsubscribe(context.Background())
+
+	healthy := atomic.Int64{}
+
+	healthySub := b.Subscribe(func(msg *broker.Message) error {
+		healthy.Add(1)
+		return nil
+	}, broker.NewSubscribeOptions(
+		broker.SubscribeWithGroup("healthy"),
+		broker.SubscribeWithTopic("test"),
+	))
+	defer healthySub.Unsubscribe(context.Background())
+
+	received := make(chan *broker.Message, 1)
+
+	dlqSub := b.Subscribe(func(msg *broker.Message) error {
+		received <- msg
+		return nil
+	}, broker.NewSubscribeOptions(
+		broker.SubscribeWithGroup("test"),
+		broker.SubscribeWithTopic("test-dlq"),
+	))
+	defer dlqSub.Unsubscribe(context.Background())
+
+	err := b.Publish("hello", broker.NewPublishOptions(broker.PublishWithTopic("test")))
+	require.NoError(t, err)
+
+	require.Equal(t, 1, <-attempts)
+	require.Equal(t, 2, <-attempts)
+
+	select {
+	case msg := <-received:
+		require.Equal(t, []byte("hello"), msg.Body)
+		require.Equal(t, "boom", msg.Header[broker.DeadLetterReasonHeader])
+	case <-time.After(time.Second):
+		t.Fatal("expected the dead-letter topic subscriber to receive the message")
+	}
+
+	dlq := b.(broker.DeadLetterQueue)
+
+	var deadLetters []*broker.Message
+
+	require.Eventually(t, func() bool {
+		deadLetters, _ = dlq.DeadLetters("test-dlq")
+		return len(deadLetters) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	require.Equal(t, []byte("hello"), deadLetters[0].Body)
+	require.Equal(t, "boom", deadLetters[0].Header[broker.DeadLetterReasonHeader])
+	require.Equal(t, "test", deadLetters[0].Header[broker.DeadLetterSourceHeader])
+	require.Equal(t, "test", deadLetters[0].Header[broker.DeadLetterGroupHeader])
+
+	// a group that is gone fails the replay, which keeps the dead letter
+	require.NoError(t, sub.Unsubscribe(context.Background()))
+
+	err = dlq.Replay("test-dlq", deadLetters[0].Id)
+	require.ErrorIs(t, err, ErrNoSubscribers)
+
+	deadLetters, err = dlq.DeadLetters("test-dlq")
+	require.NoError(t, err)
+	require.Len(t, deadLetters, 1)
+
+	fail = false
+
+	sub = b.Subscribe(handler, options)
+	defer sub.Unsubscribe(context.Background())
+
+	err = dlq.Replay("test-dlq", deadLetters[0].Id)
+	require.NoError(t, err)
+
+	require.Equal(t, 1, <-attempts)
+
+	// the healthy group already handled the message and does not get it again
+	require.Equal(t, int64(1), healthy.Load())
+
+	deadLetters, err = dlq.DeadLetters("test-dlq")
+	require.NoError(t, err)
+	require.Empty(t, deadLetters)
+}
+
+func TestAsync(t *testing.T) {
+	t.Run("slow subscribers do not block publishers", func(t *testing.T) {
+		b := NewBroker(MemoryWithAsync())
+
+		release := make(chan struct{})
+
+		handled := atomic.Int64{}
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			<-release
+			handled.Add(1)
+			return nil
+		}, broker.NewSubscribeOptions(
+			broker.SubscribeWithTopic("test"),
+			MemoryWithQueueSize(10),
+			MemoryWithWorkers(2),
+		))
+		defer sub.Unsubscribe(context.Background())
+
+		for i := 0; i < 5; i++ {
+			err := b.Publish("hello", broker.NewPublishOptions(broker.PublishWithTopic("test")))
+			require.NoError(t, err)
+		}
+
+		require.Equal(t, int64(0), handled.Load())
+
+		close(release)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		err := b.(broker.Drainer).Drain(ctx)
+		require.NoError(t, err)
+		require.Equal(t, int64(5), handled.Load())
+	})
+
+	t.Run("full queues fail the publish", func(t *testing.T) {
+		b := NewBroker(MemoryWithAsync())
+
+		release := make(chan struct{})
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			<-release
+			return nil
+		}, broker.NewSubscribeOptions(
+			broker.SubscribeWithTopic("test"),
+			MemoryWithQueueSize(1),
+			MemoryWithOverflowPolicy(OverflowError),
+		))
+		defer sub.Unsubscribe(context.Background())
+
+		var err error
+
+		for i := 0; i < 3 && err == nil; i++ {
+			err = b.Publish("hello", broker.NewPublishOptions(broker.PublishWithTopic("test")))
+		}
+
+		require.ErrorIs(t, err, ErrQueueFull)
+
+		close(release)
+	})
+}
+
+func TestWrappers(t *testing.T) {
+	calls := []string{}
+
+	publishWrapper := func(name string) broker.PublishWrapper {
+		return func(fn broker.PublishFunc) broker.PublishFunc {
+			return func(data interface{}, options broker.PublishOptions) error {
+				calls = append(calls, name)
+				return fn(data, options)
+			}
+		}
+	}
+
+	subscriberWrapper := func(name string) broker.SubscriberWrapper {
+		return func(fn broker.HandlerFunc) broker.HandlerFunc {
+			return func(msg *broker.Message) error {
+				calls = append(calls, name)
+				return fn(msg)
+			}
+		}
+	}
+
+	b := NewBroker(
+		broker.BrokerWithPublishWrappers(publishWrapper("publish-1"), publishWrapper("publish-2")),
+		broker.BrokerWithSubscriberWrappers(subscriberWrapper("handler-1"), subscriberWrapper("handler-2")),
+	)
+
+	sub := b.Subscribe(func(msg *broker.Message) error {
+		calls = append(calls, "handler")
+		return nil
+	}, broker.NewSubscribeOptions(broker.SubscribeWithTopic("test")))
+	defer sub.Unsubscribe(context.Background())
+
+	err := b.Publish("hello", broker.NewPublishOptions(broker.PublishWithTopic("test")))
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"publish-1", "publish-2", "handler-1", "handler-2", "handler"}, calls)
+}
+
+func TestTracePropagation(t *testing.T) {
+	b := NewBroker()
+
+	received := make(chan *broker.Message, 1)
+
+	sub := b.Subscribe(func(msg *broker.Message) error {
+		received <- msg
+		return nil
+	}, broker.NewSubscribeOptions(broker.SubscribeWithTopic("test")))
+	defer sub.Unsubscribe(context.Background())
+
+	traceparent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+	ctx, err := tracev2.ContextWithTraceParent(context.Background(), traceparent)
+	require.NoError(t, err)
+
+	err = b.Publish(map[string]string{"foo": "bar"}, broker.NewPublishOptions(
+		broker.PublishWithTopic("test"),
+		broker.PublishWithContext(ctx),
+	))
+	require.NoError(t, err)
+
+	msg := <-received
+	require.Equal(t, traceparent, msg.Header[tracev2.TraceParentKey])
+	require.JSONEq(t, `{"foo":"bar"}`, string(msg.Body))
+
+	traceId, ok := tracev2.TraceIdFromContext(msg.Context)
+	require.True(t, ok)
+	require.Equal(t, "0af7651916cd43dd8448eb211c80319c", hex.EncodeToString(traceId[:]))
+}
+
+func TestDelay(t *testing.T) {
+	b := NewBroker()
+
+	received := make(chan string, 3)
+
+	sub := b.Subscribe(func(msg *broker.Message) error {
+		received <- string(msg.Body)
+		return nil
+	}, broker.NewSubscribeOptions(broker.SubscribeWithTopic("orders")))
+	defer sub.Unsubscribe(context.Background())
+
+	start := time.Now()
+
+	err := b.Publish("expired", broker.NewPublishOptions(
+		broker.PublishWithTopic("orders"),
+		broker.PublishWithDeliverAt(start.Add(100*time.Millisecond)),
+	))
+	require.NoError(t, err)
+
+	err = b.Publish("reminded", broker.NewPublishOptions(
+		broker.PublishWithTopic("orders"),
+		broker.PublishWithDelay(50*time.Millisecond),
+	))
+	require.NoError(t, err)
+
+	err = b.Publish("created", broker.NewPublishOptions(broker.PublishWithTopic("orders")))
+	require.NoError(t, err)
+
+	require.Equal(t, "created", <-received)
+	require.Equal(t, "reminded", <-received)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	require.Equal(t, "expired", <-received)
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	// drain waits for messages that are still on the wheel
+	err = b.Publish("later", broker.NewPublishOptions(
+		broker.PublishWithTopic("orders"),
+		broker.PublishWithDelay(50*time.Millisecond),
+	))
+	require.NoError(t, err)
+
+	err = b.(broker.Drainer).Drain(context.Background())
+	require.NoError(t, err)
+
+	select {
+	case body := <-received:
+		require.Equal(t, "later", body)
+	default:
+		t.Fatal("expected drain to wait for the delayed message")
+	}
+}
+
+func TestTimerWheel(t *testing.T) {
+	// delays longer than one turn of the wheel wait out the extra rounds
+	w := newTimerWheel(time.Millisecond, 4)
+
+	fired := make(chan int, 3)
+
+	start := time.Now()
+
+	for _, d := range []int{10, 2, 5} {
+		d := d
+		w.schedule(time.Duration(d)*time.Millisecond, func() {
+			fired <- d
+		})
+	}
+
+	require.Equal(t, 2, <-fired)
+	require.Equal(t, 5, <-fired)
+	require.Equal(t, 10, <-fired)
+	require.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		w.mtx.Lock()
+		defer w.mtx.Unlock()
+		return !w.running && w.pending == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestRequestReply(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		t.Run(fmt.Sprintf("async %t", async), func(t *testing.T) {
+			opts := []broker.BrokerOption{}
+			if async {
+				opts = append(opts, MemoryWithAsync())
+			}
+
+			b := NewBroker(opts...)
+
+			sub := b.Subscribe(func(msg *broker.Message) error {
+				return broker.Reply(b, msg, "hello "+string(msg.Body), broker.PublishWithHeader("foo", "bar"))
+			}, broker.NewSubscribeOptions(
+				broker.SubscribeWithTopic("greeter"),
+				broker.SubscribeWithGroup("greeter"),
+			))
+			defer sub.Unsubscribe(context.Background())
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			for _, name := range []string{"world", "again"} {
+				rsp, err := broker.Request(ctx, b, name, broker.NewPublishOptions(broker.PublishWithTopic("greeter")))
+				require.NoError(t, err)
+				require.Equal(t, []byte("hello "+name), rsp.Body)
+				require.Equal(t, "bar", rsp.Header["foo"])
+			}
+
+			// the requests share one reply topic
+			topics, err := b.(broker.Inspector).Inspect(context.Background())
+			require.NoError(t, err)
+			require.Len(t, topics, 2)
+		})
+	}
+
+	t.Run("gives up when nobody replies", func(t *testing.T) {
+		b := NewBroker()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := broker.Request(ctx, b, "world", broker.NewPublishOptions(broker.PublishWithTopic("greeter")))
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("closing the replies fails the waiting requests and unsubscribes", func(t *testing.T) {
+		b := NewBroker()
+
+		time.AfterFunc(50*time.Millisecond, func() {
+			require.NoError(t, broker.CloseReplies(context.Background(), b))
+		})
+
+		_, err := broker.Request(context.Background(), b, "world", broker.NewPublishOptions(broker.PublishWithTopic("greeter")))
+		require.ErrorIs(t, err, broker.ErrRepliesClosed)
+
+		topics, err := b.(broker.Inspector).Inspect(context.Background())
+		require.NoError(t, err)
+		require.Empty(t, topics)
+	})
+
+	t.Run("messages without a reply-to topic cannot be replied to", func(t *testing.T) {
+		err := broker.Reply(NewBroker(), broker.NewMessage(nil), "hello")
+		require.ErrorIs(t, err, broker.ErrNoReplyTo)
+	})
+}
+
+func TestPublishBatch(t *testing.T) {
+	b := NewBroker()
+
+	received := []string{}
+
+	sub := b.Subscribe(func(msg *broker.Message) error {
+		received = append(received, string(msg.Body))
+		return nil
+	}, broker.NewSubscribeOptions(broker.SubscribeWithTopic("orders")))
+	defer sub.Unsubscribe(context.Background())
+
+	options := broker.NewPublishOptions(broker.PublishWithTopic("orders"))
+
+	// a message that cannot be encoded stops the whole batch
+	err := broker.PublishBatch(b, []broker.BatchEntry{
+		{Data: "a", Options: options},
+		{Data: make(chan int), Options: options},
+	})
+
+	batchErr := &broker.BatchError{}
+	require.ErrorAs(t, err, &batchErr)
+	require.ErrorIs(t, batchErr.Errors[0], ErrBatchAborted)
+	require.Error(t, batchErr.Errors[1])
+	require.Empty(t, received)
+
+	err = broker.PublishBatch(b, []broker.BatchEntry{
+		{Data: "a", Options: options},
+		{Data: "b", Options: options},
+		{Data: "c", Options: options},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c"}, received)
+
+	// handlers can publish while the batch is being delivered
+	forwarder := b.Subscribe(func(msg *broker.Message) error {
+		return b.Publish(msg.Body, broker.NewPublishOptions(broker.PublishWithTopic("orders")))
+	}, broker.NewSubscribeOptions(broker.SubscribeWithTopic("incoming")))
+	defer forwarder.Unsubscribe(context.Background())
+
+	incoming := broker.NewPublishOptions(broker.PublishWithTopic("incoming"))
+
+	err = broker.PublishBatch(b, []broker.BatchEntry{
+		{Data: "d", Options: incoming},
+		{Data: "e", Options: incoming},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c", "d", "e"}, received)
+}
+
+func TestPublishBatchAsync(t *testing.T) {
+	t.Run("queues every message or none", func(t *testing.T) {
+		b := NewBroker(MemoryWithAsync())
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+
+		mtx := sync.Mutex{}
+		received := []string{}
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			if string(msg.Body) == "first" {
+				close(started)
+				<-release
+			}
+			mtx.Lock()
+			received = append(received, string(msg.Body))
+			mtx.Unlock()
+			return nil
+		}, broker.NewSubscribeOptions(
+			broker.SubscribeWithTopic("orders"),
+			MemoryWithQueueSize(2),
+			MemoryWithWorkers(1),
+			MemoryWithOverflowPolicy(OverflowError),
+		))
+		defer sub.Unsubscribe(context.Background())
+
+		options := broker.NewPublishOptions(broker.PublishWithTopic("orders"))
+
+		// the worker holds the first message and the second takes one of the two places in the queue
+		require.NoError(t, b.Publish("first", options))
+		<-started
+		require.NoError(t, b.Publish("second", options))
+
+		err := broker.PublishBatch(b, []broker.BatchEntry{
+			{Data: "a", Options: options},
+			{Data: "b", Options: options},
+		})
+
+		batchErr := &broker.BatchError{}
+		require.ErrorAs(t, err, &batchErr)
+		require.ErrorIs(t, batchErr.Errors[0], ErrQueueFull)
+		require.ErrorIs(t, batchErr.Errors[1], ErrQueueFull)
+
+		close(release)
+
+		require.NoError(t, b.(broker.Drainer).Drain(context.Background()))
+
+		require.NoError(t, broker.PublishBatch(b, []broker.BatchEntry{
+			{Data: "c", Options: options},
+			{Data: "d", Options: options},
+		}))
+
+		require.NoError(t, b.(broker.Drainer).Drain(context.Background()))
+
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		require.Equal(t, []string{"first", "second", "c", "d"}, received)
+	})
+
+	t.Run("gives up waiting for room with the context of an entry", func(t *testing.T) {
+		b := NewBroker(MemoryWithAsync())
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			select {
+			case <-started:
+			default:
+				close(started)
+			}
+			<-release
+			return nil
+		}, broker.NewSubscribeOptions(
+			broker.SubscribeWithTopic("orders"),
+			MemoryWithQueueSize(2),
+			MemoryWithWorkers(1),
+		))
+		defer sub.Unsubscribe(context.Background())
+		defer close(release)
+
+		// the batch needs both places in the queue while one is taken
+		require.NoError(t, b.Publish("first", broker.NewPublishOptions(broker.PublishWithTopic("orders"))))
+		<-started
+		require.NoError(t, b.Publish("second", broker.NewPublishOptions(broker.PublishWithTopic("orders"))))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		err := broker.PublishBatch(b, []broker.BatchEntry{
+			{Data: "a", Options: broker.NewPublishOptions(broker.PublishWithTopic("orders"))},
+			{Data: "b", Options: broker.NewPublishOptions(broker.PublishWithTopic("orders"), broker.PublishWithContext(ctx))},
+		})
+
+		batchErr := &broker.BatchError{}
+		require.ErrorAs(t, err, &batchErr)
+		require.ErrorIs(t, batchErr.Errors[0], context.DeadlineExceeded)
+		require.ErrorIs(t, batchErr.Errors[1], context.DeadlineExceeded)
+	})
+}
+
+func TestPublishBatchWrappers(t *testing.T) {
+	// the wrappers of the entries run side by side
+	mtx := sync.Mutex{}
+	wrapped := []string{}
+
+	b := NewBroker(broker.BrokerWithPublishWrappers(func(fn broker.PublishFunc) broker.PublishFunc {
+		return func(data interface{}, options broker.PublishOptions) error {
+			if data == "rejected" {
+				return errors.New("rejected by wrapper")
+			}
+
+			options.Header = map[string]string{"wrapped": "true"}
+
+			err := fn(data, options)
+			if err == nil {
+				mtx.Lock()
+				wrapped = append(wrapped, data.(string))
+				mtx.Unlock()
+			}
+
+			return err
+		}
+	}))
+
+	headers := []string{}
+
+	sub := b.Subscribe(func(msg *broker.Message) error {
+		headers = append(headers, string(msg.Body)+"="+msg.Header["wrapped"])
+		return nil
+	}, broker.NewSubscribeOptions(broker.SubscribeWithTopic("orders")))
+	defer sub.Unsubscribe(context.Background())
+
+	options := broker.NewPublishOptions(broker.PublishWithTopic("orders"))
+
+	err := broker.PublishBatch(b, []broker.BatchEntry{
+		{Data: "a", Options: options},
+		{Data: "rejected", Options: options},
+		{Data: "b", Options: options},
+	})
+
+	batchErr := &broker.BatchError{}
+	require.ErrorAs(t, err, &batchErr)
+	require.NoError(t, batchErr.Errors[0])
+	require.EqualError(t, batchErr.Errors[1], "rejected by wrapper")
+	require.NoError(t, batchErr.Errors[2])
+
+	require.ElementsMatch(t, []string{"a", "b"}, wrapped)
+	require.Equal(t, []string{"a=true", "b=true"}, headers)
+}
+
+func TestTopicPatterns(t *testing.T) {
+	b := NewBroker()
+
+	received := []string{}
+
+	sub := b.Subscribe(func(msg *broker.Message) error {
+		received = append(received, msg.Topic)
+		return nil
+	}, broker.NewSubscribeOptions(
+		broker.SubscribeWithTopic("orders.*"),
+		broker.SubscribeWithGroup("audit"),
+	))
+	defer sub.Unsubscribe(context.Background())
+
+	for _, topic := range []string{"orders.created", "payments.created", "orders.created.eu", "orders.paid"} {
+		err := b.Publish("hello", broker.NewPublishOptions(broker.PublishWithTopic(topic)))
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, []string{"orders.created", "orders.paid"}, received)
+}
+
+func TestInspect(t *testing.T) {
+	b := NewBroker(MemoryWithAsync())
+
+	release := make(chan struct{})
+
+	sub := b.Subscribe(func(msg *broker.Message) error {
+		<-release
+		return nil
+	}, broker.NewSubscribeOptions(
+		broker.SubscribeWithTopic("orders"),
+		broker.SubscribeWithGroup("billing"),
+		MemoryWithQueueSize(10),
+	))
+	defer sub.Unsubscribe(context.Background())
+
+	for i := 0; i < 3; i++ {
+		err := b.Publish("hello", broker.NewPublishOptions(broker.PublishWithTopic("orders")))
+		require.NoError(t, err)
+	}
+
+	// one message is in the handler and the other two wait in the queue
+	require.Eventually(t, func() bool {
+		topics, err := b.(broker.Inspector).Inspect(context.Background())
+		return err == nil && len(topics) == 1 && topics[0].Groups[0].InFlight == 1
+	}, time.Second, 10*time.Millisecond)
+
+	topics, err := b.(broker.Inspector).Inspect(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []broker.TopicInfo{
+		{
+			Topic: "orders",
+			Groups: []broker.GroupInfo{
+				{
+					Group:       "billing",
+					Subscribers: []string{sub.Id()},
+					InFlight:    1,
+					Lag:         2,
+				},
+			},
+		},
+	}, topics)
+
+	close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	require.NoError(t, b.(broker.Drainer).Drain(ctx))
+
+	topics, err = b.(broker.Inspector).Inspect(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, int64(0), topics[0].Groups[0].InFlight)
+	require.Equal(t, int64(0), topics[0].Groups[0].Lag)
+}
+
+func TestUnsubscribe(t *testing.T) {
+	t.Run("waits for the handler in flight", func(t *testing.T) {
+		b := NewBroker(MemoryWithAsync())
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+
+		handled := atomic.Bool{}
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			close(started)
+			<-release
+			handled.Store(true)
+			return nil
+		}, broker.NewSubscribeOptions(broker.SubscribeWithTopic("test")))
+
+		err := b.Publish("hello", broker.NewPublishOptions(broker.PublishWithTopic("test")))
+		require.NoError(t, err)
+
+		<-started
+
+		time.AfterFunc(50*time.Millisecond, func() {
+			close(release)
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		require.NoError(t, sub.Unsubscribe(ctx))
+		require.True(t, handled.Load())
+	})
+
+	t.Run("gives up when the context is done", func(t *testing.T) {
+		b := NewBroker(MemoryWithAsync())
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+		defer close(release)
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			close(started)
+			<-release
+			return nil
+		}, broker.NewSubscribeOptions(broker.SubscribeWithTopic("test")))
+
+		err := b.Publish("hello", broker.NewPublishOptions(broker.PublishWithTopic("test")))
+		require.NoError(t, err)
+
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		require.ErrorIs(t, sub.Unsubscribe(ctx), context.DeadlineExceeded)
+	})
+
+	t.Run("no message reaches the handler after it returns", func(t *testing.T) {
+		for _, async := range []bool{false, true} {
+			opts := []broker.BrokerOption{}
+			if async {
+				opts = append(opts, MemoryWithAsync())
+			}
+
+			b := NewBroker(opts...)
+
+			started := make(chan struct{})
+			release := make(chan struct{})
+
+			handled := atomic.Int64{}
+
+			sub := b.Subscribe(func(msg *broker.Message) error {
+				if handled.Add(1) == 1 && async {
+					close(started)
+					<-release
+				}
+				return nil
+			}, broker.NewSubscribeOptions(broker.SubscribeWithTopic("test")))
+
+			if async {
+				// the first message holds up the worker while the rest wait in the queue
+				for i := 0; i < 3; i++ {
+					err := b.Publish("queued", broker.NewPublishOptions(broker.PublishWithTopic("test")))
+					require.NoError(t, err)
+				}
+
+				<-started
+
+				// the worker is let go only once the subscriber has left
+				time.AfterFunc(50*time.Millisecond, func() {
+					close(release)
+				})
+			}
+
+			require.NoError(t, sub.Unsubscribe(context.Background()))
+
+			before := handled.Load()
+
+			err := b.Publish("late", broker.NewPublishOptions(broker.PublishWithTopic("test")))
+			require.NoError(t, err)
+
+			// a publish that picked the subscriber just before it left does not reach the handler either
+			err = sub.(*subscriber).deliver(context.Background(), newMessage(sub.(*subscriber), &broker.Message{Id: "late"}))
+			require.NoError(t, err)
+
+			err = b.(broker.Drainer).Drain(context.Background())
+			require.NoError(t, err)
+
+			require.Equal(t, before, handled.Load())
+
+			if async {
+				require.Equal(t, int64(1), before)
+			}
+		}
+	})
+
+	t.Run("queued messages go to the rest of the group", func(t *testing.T) {
+		b := NewBroker(MemoryWithAsync())
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+
+		leaving := atomic.Int64{}
+		staying := atomic.Int64{}
+
+		opts := broker.NewSubscribeOptions(broker.SubscribeWithTopic("test"), broker.SubscribeWithGroup("test"))
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			if leaving.Add(1) == 1 {
+				close(started)
+				<-release
+			}
+			return nil
+		}, opts)
+
+		b.Subscribe(func(msg *broker.Message) error {
+			staying.Add(1)
+			return nil
+		}, opts)
+
+		for i := 0; i < 10; i++ {
+			err := b.Publish("hello", broker.NewPublishOptions(broker.PublishWithTopic("test")))
+			require.NoError(t, err)
+		}
+
+		<-started
+
+		time.AfterFunc(50*time.Millisecond, func() {
+			close(release)
+		})
+
+		require.NoError(t, sub.Unsubscribe(context.Background()))
+
+		err := b.(broker.Drainer).Drain(context.Background())
+		require.NoError(t, err)
+
+		require.Equal(t, int64(1), leaving.Load())
+		require.Equal(t, int64(10), leaving.Load()+staying.Load())
+	})
+}
+
+func TestPublishContext(t *testing.T) {
+	t.Run("a full queue gives up when the context is done", func(t *testing.T) {
+		b := NewBroker(MemoryWithAsync())
+
+		release := make(chan struct{})
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			<-release
+			return nil
+		}, broker.NewSubscribeOptions(
+			broker.SubscribeWithTopic("test"),
+			MemoryWithQueueSize(1),
+		))
+		defer sub.Unsubscribe(context.Background())
+		defer close(release)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		var err error
+
+		for i := 0; i < 3 && err == nil; i++ {
+			err = b.Publish("hello", broker.NewPublishOptions(
+				broker.PublishWithTopic("test"),
+				broker.PublishWithContext(ctx),
+			))
+		}
+
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("a canceled context is not published", func(t *testing.T) {
+		b := NewBroker()
+
+		handled := atomic.Int64{}
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			handled.Add(1)
+			return nil
+		}, broker.NewSubscribeOptions(broker.SubscribeWithTopic("test")))
+		defer sub.Unsubscribe(context.Background())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		for _, delay := range []time.Duration{0, time.Millisecond} {
+			err := b.Publish("hello", broker.NewPublishOptions(
+				broker.PublishWithTopic("test"),
+				broker.PublishWithContext(ctx),
+				broker.PublishWithDelay(delay),
+			))
+			require.ErrorIs(t, err, context.Canceled)
+		}
+
+		require.Equal(t, int64(0), handled.Load())
+	})
+}
@@ -0,0 +1,68 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/w-h-a/pkg/broker"
+)
+
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes the publisher wait for room in the queue
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest evicts the oldest queued message to make room
+	OverflowDropOldest
+	// OverflowError fails the publish when the queue is full
+	OverflowError
+)
+
+type asyncKey struct{}
+
+func MemoryWithAsync() broker.BrokerOption {
+	return func(o *broker.BrokerOptions) {
+		o.Context = context.WithValue(o.Context, asyncKey{}, true)
+	}
+}
+
+func GetAsyncFromContext(ctx context.Context) (bool, bool) {
+	a, ok := ctx.Value(asyncKey{}).(bool)
+	return a, ok
+}
+
+type queueSizeKey struct{}
+type workersKey struct{}
+type overflowPolicyKey struct{}
+
+func MemoryWithQueueSize(n int) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		o.Context = context.WithValue(o.Context, queueSizeKey{}, n)
+	}
+}
+
+func GetQueueSizeFromContext(ctx context.Context) (int, bool) {
+	n, ok := ctx.Value(queueSizeKey{}).(int)
+	return n, ok
+}
+
+func MemoryWithWorkers(n int) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		o.Context = context.WithValue(o.Context, workersKey{}, n)
+	}
+}
+
+func GetWorkersFromContext(ctx context.Context) (int, bool) {
+	n, ok := ctx.Value(workersKey{}).(int)
+	return n, ok
+}
+
+func MemoryWithOverflowPolicy(p OverflowPolicy) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		o.Context = context.WithValue(o.Context, overflowPolicyKey{}, p)
+	}
+}
+
+func GetOverflowPolicyFromContext(ctx context.Context) (OverflowPolicy, bool) {
+	p, ok := ctx.Value(overflowPolicyKey{}).(OverflowPolicy)
+	return p, ok
+}
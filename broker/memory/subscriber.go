@@ -1,12 +1,36 @@
 package memory
 
-import "github.com/w-h-a/pkg/broker"
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/utils/retryutils"
+)
 
 type subscriber struct {
-	options broker.SubscribeOptions
-	id      string
-	handler func([]byte) error
-	exit    chan struct{}
+	options  broker.SubscribeOptions
+	id       string
+	topic    string
+	group    string
+	handler  broker.HandlerFunc
+	broker   *memory
+	queue    chan *broker.Message
+	policy   OverflowPolicy
+	handling atomic.Int64
+	exit     chan struct{}
+	// pushes holds publishers off the queue while a batch makes room for all of its messages
+	pushes sync.Mutex
+}
+
+// delivery is a message on its way to one subscriber
+type delivery struct {
+	sub *subscriber
+	msg *broker.Message
 }
 
 func (s *subscriber) Options() broker.SubscribeOptions {
@@ -17,20 +41,386 @@ func (s *subscriber) Id() string {
 	return s.id
 }
 
-func (s *subscriber) Handler(b []byte) error {
-	return s.handler(b)
+func (s *subscriber) Handler(msg *broker.Message) error {
+	s.handling.Add(1)
+	defer s.handling.Add(-1)
+
+	return s.handle(msg)
+}
+
+func (s *subscriber) handle(msg *broker.Message) error {
+	err := broker.HandleMessage(s.options, msg, s.handler, s.retry, s.deadLetter)
+
+	// a failure that the broker redelivers or dead-letters is no longer the publisher's to deal with
+	if s.options.MaxDeliveries > 0 && msg.Settled() {
+		return nil
+	}
+
+	return err
+}
+
+// retry only redelivers messages with a delivery limit, since without one the failure goes back to the publisher
+func (s *subscriber) retry(msg *broker.Message) error {
+	if s.options.MaxDeliveries <= 0 {
+		return nil
+	}
+
+	return msg.Nack(retryutils.ExponentialBackoff(msg.Attempts))
+}
+
+// deadLetter records the group the message is replayed to, which for subscribers without a group is their own
+func (s *subscriber) deadLetter(topic string, msg *broker.Message, header map[string]string) error {
+	header[broker.DeadLetterGroupHeader] = s.group
+
+	return s.broker.deadLetter(topic, msg, header)
 }
 
-func (s *subscriber) Unsubscribe() error {
+func (s *subscriber) Unsubscribe(ctx context.Context) error {
+	s.broker.unsubscribe(s)
+
 	select {
 	case <-s.exit:
-		return nil
 	default:
 		close(s.exit)
-		return nil
 	}
+
+	return broker.WaitFor(ctx, func() bool {
+		return s.handling.Load() == 0
+	})
 }
 
 func (s *subscriber) String() string {
 	return "memory"
 }
+
+func (s *subscriber) deliver(ctx context.Context, msg *broker.Message) error {
+	if s.queue == nil {
+		// a publish may have picked the subscriber just before it left
+		if !s.active() {
+			return nil
+		}
+		defer s.handling.Add(-1)
+
+		return s.handle(msg)
+	}
+
+	return s.enqueue(ctx, msg)
+}
+
+func (s *subscriber) enqueue(ctx context.Context, msg *broker.Message) error {
+	err := s.push(ctx, msg)
+
+	// the workers may have gone before the message was queued, which would strand it
+	select {
+	case <-s.exit:
+		s.requeue()
+	default:
+	}
+
+	return err
+}
+
+// push gives up when ctx is done so that a publisher is not stuck behind a full queue past its deadline
+func (s *subscriber) push(ctx context.Context, msg *broker.Message) error {
+	s.pushes.Lock()
+	defer s.pushes.Unlock()
+
+	s.broker.inflight.Add(1)
+
+	switch s.policy {
+	case OverflowError:
+		select {
+		case s.queue <- msg:
+			return nil
+		case <-s.exit:
+			s.broker.inflight.Add(-1)
+			return nil
+		default:
+			s.broker.inflight.Add(-1)
+			return ErrQueueFull
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case s.queue <- msg:
+				return nil
+			case <-s.exit:
+				s.broker.inflight.Add(-1)
+				return nil
+			case <-ctx.Done():
+				s.broker.inflight.Add(-1)
+				return ctx.Err()
+			default:
+			}
+
+			select {
+			case dropped := <-s.queue:
+				s.broker.inflight.Add(-1)
+				log.Warnf("dropping message %s from the full queue of group %s", dropped.Id, s.options.Group)
+			default:
+			}
+		}
+	default:
+		select {
+		case s.queue <- msg:
+			return nil
+		case <-s.exit:
+			s.broker.inflight.Add(-1)
+			return nil
+		case <-ctx.Done():
+			s.broker.inflight.Add(-1)
+			return ctx.Err()
+		}
+	}
+}
+
+// enqueueBatch queues every message or none of them. Each subscriber is held while room is made for its share of the batch,
+// so that only its workers, which can only add room, touch its queue until the messages are in.
+func enqueueBatch(ctx context.Context, ds []delivery) error {
+	shares := map[*subscriber]int{}
+	subs := []*subscriber{}
+
+	for _, d := range ds {
+		if shares[d.sub] == 0 {
+			subs = append(subs, d.sub)
+		}
+		shares[d.sub]++
+	}
+
+	// subscribers are held in the same order by every batch so that two batches cannot wait on each other
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].id < subs[j].id
+	})
+
+	for _, sub := range subs {
+		sub.pushes.Lock()
+	}
+
+	err := reserve(ctx, subs, shares)
+
+	// only a subscriber that left while the batch waited can still be out of room
+	left := []delivery{}
+
+	if err == nil {
+		for _, d := range ds {
+			d.sub.broker.inflight.Add(1)
+
+			select {
+			case d.sub.queue <- d.msg:
+			default:
+				left = append(left, d)
+			}
+		}
+	}
+
+	for _, sub := range subs {
+		sub.pushes.Unlock()
+	}
+
+	for _, d := range left {
+		d.sub.handBack(d.msg)
+	}
+
+	// the workers of a subscriber that left meanwhile are not there to take its share
+	for _, sub := range subs {
+		select {
+		case <-sub.exit:
+			sub.requeue()
+		default:
+		}
+	}
+
+	return err
+}
+
+// reserve makes room for the share of the batch of each subscriber, which must be held. Failures come first, then waits,
+// and only then is anything dropped, so that a batch that cannot be queued leaves the queues as they were.
+func reserve(ctx context.Context, subs []*subscriber, shares map[*subscriber]int) error {
+	room := func(sub *subscriber) bool {
+		return cap(sub.queue)-len(sub.queue) >= shares[sub]
+	}
+
+	for _, sub := range subs {
+		if shares[sub] > cap(sub.queue) || (sub.policy == OverflowError && !room(sub)) {
+			return ErrQueueFull
+		}
+	}
+
+	for _, sub := range subs {
+		if sub.policy != OverflowBlock {
+			continue
+		}
+
+		err := broker.WaitFor(ctx, func() bool {
+			select {
+			case <-sub.exit:
+				return true
+			default:
+				return room(sub)
+			}
+		})
+		if err != nil {
+			return context.Cause(ctx)
+		}
+	}
+
+	for _, sub := range subs {
+		if sub.policy != OverflowDropOldest {
+			continue
+		}
+
+		for !room(sub) {
+			select {
+			case dropped := <-sub.queue:
+				sub.broker.inflight.Add(-1)
+				log.Warnf("dropping message %s from the full queue of group %s", dropped.Id, sub.options.Group)
+			default:
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *subscriber) work() {
+	for {
+		select {
+		case msg := <-s.queue:
+			s.process(msg)
+		case <-s.exit:
+			s.requeue()
+			return
+		}
+	}
+}
+
+// requeue hands whatever is still queued to the rest of the group once the subscriber has left
+func (s *subscriber) requeue() {
+	for {
+		select {
+		case msg := <-s.queue:
+			s.handBack(msg)
+		default:
+			return
+		}
+	}
+}
+
+// handBack delivers a queued message to the next member of the group and drops it only when the group is empty
+func (s *subscriber) handBack(msg *broker.Message) {
+	defer s.broker.inflight.Add(-1)
+
+	sub := s.broker.next(s.topic, s.group)
+	if sub == nil {
+		log.Warnf("dropping message %s: group %s has no subscribers", msg.Id, s.group)
+		return
+	}
+
+	if err := sub.deliver(context.Background(), newMessage(sub, msg)); err != nil {
+		log.Errorf("failed to hand message %s to group %s: %s", msg.Id, s.group, err)
+	}
+}
+
+// active counts the caller as handling a message unless the subscriber has left, so that Unsubscribe waits for it
+func (s *subscriber) active() bool {
+	s.handling.Add(1)
+
+	select {
+	case <-s.exit:
+		s.handling.Add(-1)
+		return false
+	default:
+		return true
+	}
+}
+
+func (s *subscriber) process(msg *broker.Message) {
+	// the subscriber may have left while the message was queued
+	if !s.active() {
+		s.handBack(msg)
+		return
+	}
+	defer s.handling.Add(-1)
+
+	defer s.broker.inflight.Add(-1)
+
+	if err := s.handle(msg); err != nil {
+		log.Errorf("failed to handle message %s from group %s: %s", msg.Id, s.options.Group, err)
+	}
+}
+
+type acknowledger struct {
+	sub *subscriber
+	msg *broker.Message
+}
+
+func (a *acknowledger) Ack() error {
+	return nil
+}
+
+func (a *acknowledger) Nack(delay time.Duration) error {
+	if limit := a.sub.options.MaxDeliveries; limit > 0 && a.msg.Attempts >= limit {
+		if len(a.sub.options.DeadLetterTopic) == 0 {
+			log.Errorf("dropping message %s from group %s after %d deliveries: message was nacked on its final delivery", a.msg.Id, a.sub.options.Group, a.msg.Attempts)
+			return nil
+		}
+
+		return a.sub.deadLetter(a.sub.options.DeadLetterTopic, a.msg, broker.DeadLetterHeader(a.msg, "message was nacked on its final delivery"))
+	}
+
+	a.redeliver(delay, a.msg.Attempts+1)
+
+	return nil
+}
+
+// Defer redelivers the message as the same attempt so that it does not count against the delivery limit
+func (a *acknowledger) Defer(delay time.Duration) error {
+	a.redeliver(delay, a.msg.Attempts)
+
+	return nil
+}
+
+func (a *acknowledger) redeliver(delay time.Duration, attempts int) {
+	a.sub.broker.inflight.Add(1)
+
+	time.AfterFunc(delay, func() {
+		defer a.sub.broker.inflight.Add(-1)
+
+		// redeliver to whichever member of the group is next in line
+		sub := a.sub.broker.next(a.sub.topic, a.sub.group)
+		if sub == nil {
+			log.Errorf("dropping redelivered message %s: group %s has no subscribers", a.msg.Id, a.sub.group)
+			return
+		}
+
+		redelivery := newMessage(sub, a.msg)
+		redelivery.Attempts = attempts
+
+		if err := sub.deliver(context.Background(), redelivery); err != nil {
+			log.Errorf("failed to handle redelivered message %s from group %s: %s", a.msg.Id, a.sub.options.Group, err)
+		}
+	})
+}
+
+func newMessage(sub *subscriber, msg *broker.Message) *broker.Message {
+	header := map[string]string{}
+
+	for k, v := range msg.Header {
+		header[k] = v
+	}
+
+	a := &acknowledger{sub: sub}
+
+	m := broker.NewMessage(a)
+	m.Id = msg.Id
+	m.Topic = msg.Topic
+	m.Header = header
+	m.Context = broker.ExtractTraceHeaders(context.Background(), header)
+	m.Body = msg.Body
+	m.Timestamp = msg.Timestamp
+	m.Attempts = msg.Attempts
+
+	a.msg = m
+
+	return m
+}
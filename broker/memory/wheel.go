@@ -0,0 +1,150 @@
+package memory
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultWheelTick  = 10 * time.Millisecond
+	defaultWheelSlots = 512
+)
+
+type timer struct {
+	// rounds counts the remaining turns of the wheel before the timer fires
+	rounds int
+	fn     func()
+}
+
+// timerWheel is a hashed timing wheel that fires delayed deliveries with a resolution of one tick.
+// It only runs while timers are pending.
+type timerWheel struct {
+	tick    time.Duration
+	slots   [][]*timer
+	cursor  int
+	pending int
+	running bool
+	due     []func()
+	firing  bool
+	mtx     sync.Mutex
+}
+
+func (w *timerWheel) schedule(delay time.Duration, fn func()) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	ticks := int((delay + w.tick - 1) / w.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	n := len(w.slots)
+
+	slot := (w.cursor + ticks) % n
+
+	w.slots[slot] = append(w.slots[slot], &timer{rounds: (ticks - 1) / n, fn: fn})
+
+	w.pending++
+
+	if !w.running {
+		w.running = true
+		go w.run()
+	}
+}
+
+func (w *timerWheel) run() {
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+
+	start := time.Now()
+	advanced := 0
+
+	for range ticker.C {
+		// catch up on ticks that were missed while timers were firing
+		elapsed := int(time.Since(start) / w.tick)
+
+		for ; advanced < elapsed; advanced++ {
+			due, stopped := w.advance()
+
+			if len(due) > 0 {
+				w.fire(due)
+			}
+
+			if stopped {
+				return
+			}
+		}
+	}
+}
+
+// fire hands the due timers to a goroutine that runs them in order, so that a slow subscriber does not hold up the wheel
+func (w *timerWheel) fire(due []func()) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.due = append(w.due, due...)
+
+	if !w.firing {
+		w.firing = true
+		go w.drain()
+	}
+}
+
+func (w *timerWheel) drain() {
+	for {
+		w.mtx.Lock()
+
+		due := w.due
+		w.due = nil
+
+		if len(due) == 0 {
+			w.firing = false
+			w.mtx.Unlock()
+			return
+		}
+
+		w.mtx.Unlock()
+
+		for _, fn := range due {
+			fn()
+		}
+	}
+}
+
+// advance moves the wheel on by one slot and reports whether it stopped because nothing is pending
+func (w *timerWheel) advance() ([]func(), bool) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.cursor = (w.cursor + 1) % len(w.slots)
+
+	due := []func(){}
+	remaining := []*timer{}
+
+	for _, t := range w.slots[w.cursor] {
+		if t.rounds > 0 {
+			t.rounds--
+			remaining = append(remaining, t)
+			continue
+		}
+		due = append(due, t.fn)
+	}
+
+	w.slots[w.cursor] = remaining
+	w.pending -= len(due)
+
+	if w.pending == 0 {
+		w.running = false
+		return due, true
+	}
+
+	return due, false
+}
+
+func newTimerWheel(tick time.Duration, slots int) *timerWheel {
+	return &timerWheel{
+		tick:  tick,
+		slots: make([][]*timer, slots),
+		mtx:   sync.Mutex{},
+	}
+}
@@ -0,0 +1,123 @@
+package nats
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/telemetry/log"
+)
+
+const (
+	defaultAckWait = 30 * time.Second
+)
+
+type consumer struct {
+	sub     *subscriber
+	subject string
+	group   string
+	config  jetstream.ConsumerConfig
+}
+
+func (c *consumer) run() error {
+	ctx := context.Background()
+
+	stream, err := c.sub.broker.stream(ctx, c.subject)
+	if err != nil {
+		return err
+	}
+
+	cons, err := stream.CreateOrUpdateConsumer(ctx, c.config)
+	if err != nil {
+		return err
+	}
+
+	consume, err := cons.Consume(c.handle)
+	if err != nil {
+		return err
+	}
+
+	c.sub.mtx.Lock()
+	defer c.sub.mtx.Unlock()
+
+	c.sub.consume = consume
+
+	return nil
+}
+
+func (c *consumer) handle(jmsg jetstream.Msg) {
+	msg := broker.NewMessage(&acknowledger{msg: jmsg})
+	msg.Topic = jmsg.Subject()
+	msg.Body = jmsg.Data()
+	msg.Attempts = 1
+
+	if meta, err := jmsg.Metadata(); err == nil {
+		msg.Id = strconv.FormatUint(meta.Sequence.Stream, 10)
+		msg.Timestamp = meta.Timestamp
+		msg.Attempts = int(meta.NumDelivered)
+	}
+
+	for k := range jmsg.Headers() {
+		msg.Header[k] = jmsg.Headers().Get(k)
+	}
+
+	msg.Context = broker.ExtractTraceHeaders(context.Background(), msg.Header)
+
+	if err := c.sub.Handler(msg); err != nil {
+		log.Errorf("failed to handle message %s from group %s: %v", msg.Id, c.group, err)
+	}
+}
+
+func newConsumer(sub *subscriber) *consumer {
+	subject := broker.SubscriptionTopic(sub.options)
+
+	config := jetstream.ConsumerConfig{
+		FilterSubject: subject,
+		DeliverPolicy: jetstream.DeliverNewPolicy,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       defaultAckWait,
+	}
+
+	// subscribers without a group get an ephemeral consumer with their own copy of every message
+	if len(sub.options.Group) > 0 {
+		config.Durable = nameReplacer.Replace(sub.options.Group)
+	}
+
+	// one extra delivery so that a message whose last attempt died with the consumer still gets dead-lettered
+	if sub.options.MaxDeliveries > 0 {
+		config.MaxDeliver = sub.options.MaxDeliveries + 1
+	}
+
+	if d, ok := GetAckWaitFromContext(sub.options.Context); ok && d > 0 {
+		config.AckWait = d
+	}
+
+	if n, ok := GetMaxAckPendingFromContext(sub.options.Context); ok && n > 0 {
+		config.MaxAckPending = n
+	}
+
+	return &consumer{
+		sub:     sub,
+		subject: subject,
+		group:   sub.options.Group,
+		config:  config,
+	}
+}
+
+type acknowledger struct {
+	msg jetstream.Msg
+}
+
+func (a *acknowledger) Ack() error {
+	return a.msg.Ack()
+}
+
+func (a *acknowledger) Nack(delay time.Duration) error {
+	if delay <= 0 {
+		return a.msg.Nak()
+	}
+
+	return a.msg.NakWithDelay(delay)
+}
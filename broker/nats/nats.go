@@ -0,0 +1,201 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/utils/datautils"
+)
+
+var (
+	// stream and durable names may not contain these
+	nameReplacer = strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_", "/", "_", "\\", "_")
+)
+
+type natsBroker struct {
+	options   broker.BrokerOptions
+	scheduler *broker.Scheduler
+	conn      *nats.Conn
+	js        jetstream.JetStream
+	streams   map[string]jetstream.Stream
+	mtx       sync.RWMutex
+}
+
+func (b *natsBroker) Options() broker.BrokerOptions {
+	return b.options
+}
+
+func (b *natsBroker) Publish(data interface{}, options broker.PublishOptions) error {
+	return broker.WrapPublish(b.options, b.publish)(data, options)
+}
+
+func (b *natsBroker) publish(data interface{}, options broker.PublishOptions) error {
+	if broker.DeliveryDelay(options) > 0 {
+		if b.scheduler == nil {
+			return broker.ErrSchedulerRequired
+		}
+		return b.scheduler.Schedule(data, options)
+	}
+
+	bs, err := datautils.Stringify(data)
+	if err != nil {
+		return err
+	}
+
+	msg := nats.NewMsg(options.Topic)
+	msg.Data = bs
+
+	for k, v := range broker.InjectTraceHeaders(options.Context, options.Header) {
+		msg.Header.Set(k, v)
+	}
+
+	return broker.RetryPublish(options, retryCheck, func(ctx context.Context) error {
+		return b.publishMsg(ctx, msg)
+	})
+}
+
+func (b *natsBroker) publishMsg(ctx context.Context, msg *nats.Msg) error {
+	if _, err := b.stream(ctx, msg.Subject); err != nil {
+		return err
+	}
+
+	_, err := b.js.PublishMsg(ctx, msg)
+
+	return err
+}
+
+func (b *natsBroker) Subscribe(callback func(*broker.Message) error, options broker.SubscribeOptions) broker.Subscriber {
+	handler := broker.WrapHandler(b.options, callback)
+
+	sub := &subscriber{
+		options: options,
+		id:      uuid.New().String(),
+		handler: handler,
+		broker:  b,
+	}
+
+	c := newConsumer(sub)
+
+	// the consumer has to exist before we return so that nothing published afterwards is missed
+	if err := c.run(); err != nil {
+		log.Errorf("failed to consume subject %s for group %s: %v", c.subject, c.group, err)
+	}
+
+	return sub
+}
+
+// Close stops polling the scheduler store
+func (b *natsBroker) Close() error {
+	if b.scheduler != nil {
+		b.scheduler.Stop()
+	}
+
+	return nil
+}
+
+// SubscribesToTopic marks the broker as one that Request can take replies on
+func (b *natsBroker) SubscribesToTopic() {}
+
+func (b *natsBroker) String() string {
+	return "nats"
+}
+
+// stream finds the stream that captures the subject and creates one when there is none
+func (b *natsBroker) stream(ctx context.Context, subject string) (jetstream.Stream, error) {
+	b.mtx.RLock()
+	s, ok := b.streams[subject]
+	b.mtx.RUnlock()
+
+	if ok {
+		return s, nil
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if s, ok := b.streams[subject]; ok {
+		return s, nil
+	}
+
+	name, err := b.js.StreamNameBySubject(ctx, subject)
+	if err != nil && !errors.Is(err, jetstream.ErrStreamNotFound) {
+		return nil, err
+	}
+
+	if err == nil {
+		s, err = b.js.Stream(ctx, name)
+	} else {
+		s, err = b.js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+			Name:     nameReplacer.Replace(subject),
+			Subjects: []string{subject},
+		})
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	b.streams[subject] = s
+
+	return s, nil
+}
+
+func (b *natsBroker) configure() error {
+	if len(b.options.Nodes) == 0 {
+		return fmt.Errorf("broker addresses are required")
+	}
+
+	conn, err := nats.Connect(strings.Join(b.options.Nodes, ","))
+	if err != nil {
+		return err
+	}
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		return err
+	}
+
+	b.conn = conn
+	b.js = js
+
+	return nil
+}
+
+// retryCheck also retries publishes that timed out waiting for jetstream or found no stream to answer them
+func retryCheck(ctx context.Context, retryCount int, err error) (bool, error) {
+	for _, target := range []error{nats.ErrTimeout, nats.ErrNoResponders, nats.ErrConnectionReconnecting, jetstream.ErrNoStreamResponse} {
+		if errors.Is(err, target) {
+			return true, nil
+		}
+	}
+
+	return broker.IsTransient(err), nil
+}
+
+func NewBroker(opts ...broker.BrokerOption) broker.Broker {
+	options := broker.NewBrokerOptions(opts...)
+
+	b := &natsBroker{
+		options: options,
+		streams: map[string]jetstream.Stream{},
+		mtx:     sync.RWMutex{},
+	}
+
+	if err := b.configure(); err != nil {
+		log.Fatal(err)
+	}
+
+	if options.SchedulerStore != nil {
+		b.scheduler = broker.NewScheduler(options.SchedulerStore, b.publish)
+	}
+
+	return b
+}
@@ -0,0 +1,183 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+)
+
+func runServer(t *testing.T) *server.Server {
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	go s.Start()
+
+	require.True(t, s.ReadyForConnections(5*time.Second))
+
+	t.Cleanup(s.Shutdown)
+
+	return s
+}
+
+func TestPubSub(t *testing.T) {
+	log.SetLogger(memory.NewLog(memory.LogWithBuffer(memoryutils.NewBuffer())))
+
+	s := runServer(t)
+
+	b := NewBroker(broker.BrokerWithNodes(s.ClientURL()))
+
+	t.Run("subscribers receive the body, header and attempts", func(t *testing.T) {
+		received := make(chan *broker.Message, 1)
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			received <- msg
+			return nil
+		}, broker.NewSubscribeOptions(
+			broker.SubscribeWithTopic("orders.created"),
+			broker.SubscribeWithGroup("billing"),
+		))
+		defer sub.Unsubscribe(context.Background())
+
+		err := b.Publish("hello", broker.NewPublishOptions(
+			broker.PublishWithTopic("orders.created"),
+			broker.PublishWithHeader("foo", "bar"),
+		))
+		require.NoError(t, err)
+
+		select {
+		case msg := <-received:
+			require.Equal(t, "orders.created", msg.Topic)
+			require.Equal(t, []byte("hello"), msg.Body)
+			require.Equal(t, "bar", msg.Header["foo"])
+			require.Equal(t, 1, msg.Attempts)
+			require.Equal(t, "1", msg.Id)
+			require.False(t, msg.Timestamp.IsZero())
+		case <-time.After(time.Second):
+			t.Fatal("expected the message to be delivered")
+		}
+	})
+
+	t.Run("members of a group share messages and other groups get a copy", func(t *testing.T) {
+		group := make(chan string, 10)
+		other := make(chan string, 10)
+
+		for i := 0; i < 2; i++ {
+			sub := b.Subscribe(func(msg *broker.Message) error {
+				group <- string(msg.Body)
+				return nil
+			}, broker.NewSubscribeOptions(
+				broker.SubscribeWithTopic("fanout"),
+				broker.SubscribeWithGroup("group"),
+			))
+			defer sub.Unsubscribe(context.Background())
+		}
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			other <- string(msg.Body)
+			return nil
+		}, broker.NewSubscribeOptions(broker.SubscribeWithTopic("fanout")))
+		defer sub.Unsubscribe(context.Background())
+
+		for _, body := range []string{"a", "b", "c"} {
+			err := b.Publish(body, broker.NewPublishOptions(broker.PublishWithTopic("fanout")))
+			require.NoError(t, err)
+		}
+
+		for _, ch := range []chan string{group, other} {
+			for i := 0; i < 3; i++ {
+				select {
+				case <-ch:
+				case <-time.After(time.Second):
+					t.Fatal("expected the message to be delivered")
+				}
+			}
+		}
+
+		select {
+		case body := <-group:
+			t.Fatalf("expected the group to receive each message once but got %s again", body)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
+
+func TestRedelivery(t *testing.T) {
+	log.SetLogger(memory.NewLog(memory.LogWithBuffer(memoryutils.NewBuffer())))
+
+	s := runServer(t)
+
+	b := NewBroker(broker.BrokerWithNodes(s.ClientURL()))
+
+	t.Run("nacked messages are redelivered after the delay", func(t *testing.T) {
+		attempts := make(chan int, 2)
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			attempts <- msg.Attempts
+			if msg.Attempts == 1 {
+				return msg.Nack(10 * time.Millisecond)
+			}
+			return nil
+		}, broker.NewSubscribeOptions(
+			broker.SubscribeWithTopic("nack"),
+			broker.SubscribeWithGroup("test"),
+		))
+		defer sub.Unsubscribe(context.Background())
+
+		err := b.Publish("hello", broker.NewPublishOptions(broker.PublishWithTopic("nack")))
+		require.NoError(t, err)
+
+		require.Equal(t, 1, <-attempts)
+		require.Equal(t, 2, <-attempts)
+	})
+
+	t.Run("failed messages are nacked and then dead-lettered", func(t *testing.T) {
+		attempts := make(chan int, 2)
+		dead := make(chan *broker.Message, 1)
+
+		dlq := b.Subscribe(func(msg *broker.Message) error {
+			dead <- msg
+			return nil
+		}, broker.NewSubscribeOptions(broker.SubscribeWithTopic("fail-dlq")))
+		defer dlq.Unsubscribe(context.Background())
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			attempts <- msg.Attempts
+			return errors.New("boom")
+		}, broker.NewSubscribeOptions(
+			broker.SubscribeWithTopic("fail"),
+			broker.SubscribeWithGroup("test"),
+			broker.SubscribeWithMaxDeliveries(2),
+			broker.SubscribeWithDeadLetterTopic("fail-dlq"),
+			NatsWithNakDelay(10*time.Millisecond),
+		))
+		defer sub.Unsubscribe(context.Background())
+
+		err := b.Publish("hello", broker.NewPublishOptions(broker.PublishWithTopic("fail")))
+		require.NoError(t, err)
+
+		require.Equal(t, 1, <-attempts)
+		require.Equal(t, 2, <-attempts)
+
+		select {
+		case msg := <-dead:
+			require.Equal(t, []byte("hello"), msg.Body)
+			require.Equal(t, "boom", msg.Header[broker.DeadLetterReasonHeader])
+			require.Equal(t, "fail", msg.Header[broker.DeadLetterSourceHeader])
+		case <-time.After(time.Second):
+			t.Fatal("expected the message to be dead-lettered")
+		}
+	})
+}
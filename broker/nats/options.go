@@ -0,0 +1,47 @@
+package nats
+
+import (
+	"context"
+	"time"
+
+	"github.com/w-h-a/pkg/broker"
+)
+
+type ackWaitKey struct{}
+type nakDelayKey struct{}
+type maxAckPendingKey struct{}
+
+// NatsWithAckWait sets how long the server waits for an ack before redelivering a message
+func NatsWithAckWait(d time.Duration) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		o.Context = context.WithValue(o.Context, ackWaitKey{}, d)
+	}
+}
+
+func GetAckWaitFromContext(ctx context.Context) (time.Duration, bool) {
+	d, ok := ctx.Value(ackWaitKey{}).(time.Duration)
+	return d, ok
+}
+
+// NatsWithNakDelay sets how long the server waits before redelivering a message whose handler failed
+func NatsWithNakDelay(d time.Duration) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		o.Context = context.WithValue(o.Context, nakDelayKey{}, d)
+	}
+}
+
+func GetNakDelayFromContext(ctx context.Context) (time.Duration, bool) {
+	d, ok := ctx.Value(nakDelayKey{}).(time.Duration)
+	return d, ok
+}
+
+func NatsWithMaxAckPending(n int) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		o.Context = context.WithValue(o.Context, maxAckPendingKey{}, n)
+	}
+}
+
+func GetMaxAckPendingFromContext(ctx context.Context) (int, bool) {
+	n, ok := ctx.Value(maxAckPendingKey{}).(int)
+	return n, ok
+}
@@ -0,0 +1,75 @@
+package nats
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/w-h-a/pkg/broker"
+)
+
+type subscriber struct {
+	options  broker.SubscribeOptions
+	id       string
+	handler  broker.HandlerFunc
+	broker   *natsBroker
+	consume  jetstream.ConsumeContext
+	handling atomic.Int64
+	mtx      sync.Mutex
+}
+
+func (s *subscriber) Options() broker.SubscribeOptions {
+	return s.options
+}
+
+func (s *subscriber) Id() string {
+	return s.id
+}
+
+func (s *subscriber) Handler(msg *broker.Message) error {
+	s.handling.Add(1)
+	defer s.handling.Add(-1)
+
+	return broker.HandleMessage(s.options, msg, s.handler, s.retry, s.deadLetter)
+}
+
+func (s *subscriber) Unsubscribe(ctx context.Context) error {
+	s.mtx.Lock()
+
+	if s.consume != nil {
+		s.consume.Stop()
+		s.consume = nil
+	}
+
+	s.mtx.Unlock()
+
+	return broker.WaitFor(ctx, func() bool {
+		return s.handling.Load() == 0
+	})
+}
+
+func (s *subscriber) String() string {
+	return "nats"
+}
+
+// retry naks the message when a nak delay is set; otherwise the server redelivers it once the ack wait has passed
+func (s *subscriber) retry(msg *broker.Message) error {
+	if delay, ok := GetNakDelayFromContext(s.options.Context); ok && delay > 0 {
+		return msg.Nack(delay)
+	}
+
+	return nil
+}
+
+func (s *subscriber) deadLetter(topic string, msg *broker.Message, header map[string]string) error {
+	dlq := nats.NewMsg(topic)
+	dlq.Data = msg.Body
+
+	for k, v := range header {
+		dlq.Header.Set(k, v)
+	}
+
+	return s.broker.publishMsg(context.Background(), dlq)
+}
@@ -1,14 +1,22 @@
 package broker
 
-import "context"
+import (
+	"context"
+	"time"
+
+	"github.com/w-h-a/pkg/store"
+)
 
 type BrokerOption func(o *BrokerOptions)
 
 type BrokerOptions struct {
-	Nodes            []string
-	PublishOptions   *PublishOptions
-	SubscribeOptions *SubscribeOptions
-	Context          context.Context
+	Nodes              []string
+	PublishOptions     *PublishOptions
+	SubscribeOptions   *SubscribeOptions
+	PublishWrappers    []PublishWrapper
+	SubscriberWrappers []SubscriberWrapper
+	SchedulerStore     store.Store
+	Context            context.Context
 }
 
 func BrokerWithNodes(addrs ...string) BrokerOption {
@@ -29,6 +37,25 @@ func BrokerWithSubscribeOptions(options *SubscribeOptions) BrokerOption {
 	}
 }
 
+func BrokerWithPublishWrappers(ws ...PublishWrapper) BrokerOption {
+	return func(o *BrokerOptions) {
+		o.PublishWrappers = append(o.PublishWrappers, ws...)
+	}
+}
+
+func BrokerWithSubscriberWrappers(ws ...SubscriberWrapper) BrokerOption {
+	return func(o *BrokerOptions) {
+		o.SubscriberWrappers = append(o.SubscriberWrappers, ws...)
+	}
+}
+
+// BrokerWithSchedulerStore keeps delayed messages in the store until they are due for brokers without native delays
+func BrokerWithSchedulerStore(s store.Store) BrokerOption {
+	return func(o *BrokerOptions) {
+		o.SchedulerStore = s
+	}
+}
+
 func NewBrokerOptions(opts ...BrokerOption) BrokerOptions {
 	options := BrokerOptions{
 		Context: context.Background(),
@@ -44,8 +71,16 @@ func NewBrokerOptions(opts ...BrokerOption) BrokerOptions {
 type PublishOption func(o *PublishOptions)
 
 type PublishOptions struct {
-	Topic   string
-	Context context.Context
+	Topic           string
+	Key             string
+	DeduplicationId string
+	Header          map[string]string
+	Delay           time.Duration
+	DeliverAt       time.Time
+	Backoff         func(ctx context.Context, attempts int) (time.Duration, error)
+	RetryCheck      func(ctx context.Context, retryCount int, err error) (bool, error)
+	RetryCount      int
+	Context         context.Context
 }
 
 func PublishWithTopic(topic string) PublishOption {
@@ -54,9 +89,74 @@ func PublishWithTopic(topic string) PublishOption {
 	}
 }
 
+// PublishWithKey sets the key that brokers use to keep related messages in order (e.g., the kafka partition key)
+func PublishWithKey(key string) PublishOption {
+	return func(o *PublishOptions) {
+		o.Key = key
+	}
+}
+
+// PublishWithDeduplicationId sets the id that brokers use to drop repeated publishes of the same message (e.g., sns fifo topics)
+func PublishWithDeduplicationId(id string) PublishOption {
+	return func(o *PublishOptions) {
+		o.DeduplicationId = id
+	}
+}
+
+func PublishWithHeader(k, v string) PublishOption {
+	return func(o *PublishOptions) {
+		if o.Header == nil {
+			o.Header = map[string]string{}
+		}
+		o.Header[k] = v
+	}
+}
+
+// PublishWithDelay holds the message back for the duration from the moment it is published
+func PublishWithDelay(d time.Duration) PublishOption {
+	return func(o *PublishOptions) {
+		o.Delay = d
+	}
+}
+
+// PublishWithDeliverAt holds the message back until the given time
+func PublishWithDeliverAt(t time.Time) PublishOption {
+	return func(o *PublishOptions) {
+		o.DeliverAt = t
+	}
+}
+
+func PublishWithBackoff(fn func(ctx context.Context, attempts int) (time.Duration, error)) PublishOption {
+	return func(o *PublishOptions) {
+		o.Backoff = fn
+	}
+}
+
+// PublishWithRetryCheck decides which failed publishes are retried in place of the broker's own check
+func PublishWithRetryCheck(fn func(ctx context.Context, retryCount int, err error) (bool, error)) PublishOption {
+	return func(o *PublishOptions) {
+		o.RetryCheck = fn
+	}
+}
+
+func PublishWithRetryCount(count int) PublishOption {
+	return func(o *PublishOptions) {
+		o.RetryCount = count
+	}
+}
+
+func PublishWithContext(ctx context.Context) PublishOption {
+	return func(o *PublishOptions) {
+		o.Context = ctx
+	}
+}
+
 func NewPublishOptions(opts ...PublishOption) PublishOptions {
 	options := PublishOptions{
-		Context: context.Background(),
+		Header:     map[string]string{},
+		Backoff:    defaultBackoff,
+		RetryCount: defaultRetryCount,
+		Context:    context.Background(),
 	}
 
 	for _, fn := range opts {
@@ -69,8 +169,21 @@ func NewPublishOptions(opts ...PublishOption) PublishOptions {
 type SubscribeOption func(o *SubscribeOptions)
 
 type SubscribeOptions struct {
-	Group   string
-	Context context.Context
+	Topic           string
+	Group           string
+	MaxDeliveries   int
+	DeadLetterTopic string
+	Context         context.Context
+}
+
+// SubscribeWithTopic also takes patterns like orders.* or orders.> on the memory and file brokers.
+// The redis, kafka, and sns+sqs brokers can't subscribe to patterns since their consumers are bound to one stream, topic, or queue.
+// NATS subjects take the same wildcards, but the nats broker keeps one stream per literal subject and
+// JetStream does not let a stream for a pattern overlap them, so it doesn't take patterns either.
+func SubscribeWithTopic(topic string) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Topic = topic
+	}
 }
 
 func SubscribeWithGroup(group string) SubscribeOption {
@@ -79,6 +192,18 @@ func SubscribeWithGroup(group string) SubscribeOption {
 	}
 }
 
+func SubscribeWithMaxDeliveries(n int) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.MaxDeliveries = n
+	}
+}
+
+func SubscribeWithDeadLetterTopic(topic string) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.DeadLetterTopic = topic
+	}
+}
+
 func NewSubscribeOptions(opts ...SubscribeOption) SubscribeOptions {
 	options := SubscribeOptions{
 		Context: context.Background(),
@@ -0,0 +1,246 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/telemetry/log"
+)
+
+const (
+	defaultCount        = int64(10)
+	defaultBlock        = time.Second
+	defaultClaimTimeout = 30 * time.Second
+	readBackoff         = time.Second
+)
+
+type consumer struct {
+	sub          *subscriber
+	client       goredis.UniversalClient
+	stream       string
+	group        string
+	name         string
+	count        int64
+	block        time.Duration
+	claimTimeout time.Duration
+	lastClaim    time.Time
+}
+
+func (c *consumer) run() {
+	defer c.sub.wg.Done()
+
+	for {
+		select {
+		case <-c.sub.exit:
+			return
+		default:
+		}
+
+		if time.Since(c.lastClaim) >= c.claimTimeout/2 {
+			c.claim()
+			c.lastClaim = time.Now()
+		}
+
+		c.read()
+	}
+}
+
+func (c *consumer) read() {
+	streams, err := c.client.XReadGroup(context.Background(), &goredis.XReadGroupArgs{
+		Group:    c.group,
+		Consumer: c.name,
+		Streams:  []string{c.stream, ">"},
+		Count:    c.count,
+		Block:    c.block,
+	}).Result()
+	if err == goredis.Nil {
+		return
+	}
+
+	if err != nil {
+		log.Errorf("failed to read from stream %s for group %s: %v", c.stream, c.group, err)
+
+		select {
+		case <-c.sub.exit:
+		case <-time.After(readBackoff):
+		}
+
+		return
+	}
+
+	for _, stream := range streams {
+		for _, xmsg := range stream.Messages {
+			c.handle(xmsg, 1)
+		}
+	}
+}
+
+// claim takes over entries that other consumers (or this one) left pending for longer than the claim timeout
+func (c *consumer) claim() {
+	start := "0-0"
+
+	for {
+		xmsgs, next, err := c.client.XAutoClaim(context.Background(), &goredis.XAutoClaimArgs{
+			Stream:   c.stream,
+			Group:    c.group,
+			MinIdle:  c.claimTimeout,
+			Start:    start,
+			Count:    c.count,
+			Consumer: c.name,
+		}).Result()
+		if err != nil {
+			log.Errorf("failed to claim pending messages from stream %s for group %s: %v", c.stream, c.group, err)
+			return
+		}
+
+		for _, xmsg := range xmsgs {
+			c.handle(xmsg, c.attempts(xmsg.ID))
+		}
+
+		if next == "0-0" || len(next) == 0 {
+			return
+		}
+
+		start = next
+	}
+}
+
+func (c *consumer) redeliver(id string) {
+	xmsgs, err := c.client.XClaim(context.Background(), &goredis.XClaimArgs{
+		Stream:   c.stream,
+		Group:    c.group,
+		Consumer: c.name,
+		Messages: []string{id},
+	}).Result()
+	if err != nil {
+		log.Errorf("failed to claim nacked message %s from stream %s for group %s: %v", id, c.stream, c.group, err)
+		return
+	}
+
+	for _, xmsg := range xmsgs {
+		c.handle(xmsg, c.attempts(xmsg.ID))
+	}
+}
+
+func (c *consumer) attempts(id string) int {
+	pending, err := c.client.XPendingExt(context.Background(), &goredis.XPendingExtArgs{
+		Stream: c.stream,
+		Group:  c.group,
+		Start:  id,
+		End:    id,
+		Count:  1,
+	}).Result()
+	if err != nil || len(pending) == 0 {
+		return 1
+	}
+
+	return int(pending[0].RetryCount)
+}
+
+func (c *consumer) handle(xmsg goredis.XMessage, attempts int) {
+	// entries that were read as the subscriber left stay pending for another consumer to claim
+	select {
+	case <-c.sub.exit:
+		return
+	default:
+	}
+
+	// entries that were deleted from the stream come back without values
+	if len(xmsg.Values) == 0 {
+		c.client.XAck(context.Background(), c.stream, c.group, xmsg.ID)
+		return
+	}
+
+	msg := broker.NewMessage(&acknowledger{consumer: c, id: xmsg.ID})
+	msg.Id = xmsg.ID
+	msg.Topic = c.stream
+	msg.Attempts = attempts
+
+	if body, ok := xmsg.Values[bodyField].(string); ok {
+		msg.Body = []byte(body)
+	}
+
+	if header, ok := xmsg.Values[headerField].(string); ok {
+		if err := json.Unmarshal([]byte(header), &msg.Header); err != nil {
+			log.Warnf("failed to unmarshal header of message %s from stream %s: %v", xmsg.ID, c.stream, err)
+		}
+	}
+
+	if ts, ok := xmsg.Values[timestampField].(string); ok {
+		if ms, err := strconv.ParseInt(ts, 10, 64); err == nil {
+			msg.Timestamp = time.UnixMilli(ms)
+		}
+	}
+
+	msg.Context = broker.ExtractTraceHeaders(context.Background(), msg.Header)
+
+	if err := c.sub.Handler(msg); err != nil {
+		log.Errorf("failed to handle message %s from group %s: %v", msg.Id, c.group, err)
+	}
+}
+
+func newConsumer(sub *subscriber, client goredis.UniversalClient) *consumer {
+	stream := broker.SubscriptionTopic(sub.options)
+	group := broker.SubscriptionGroup(sub.options, sub.id)
+
+	count := defaultCount
+	if n, ok := GetCountFromContext(sub.options.Context); ok && n > 0 {
+		count = n
+	}
+
+	block := defaultBlock
+	if d, ok := GetBlockFromContext(sub.options.Context); ok && d > 0 {
+		block = d
+	}
+
+	claimTimeout := defaultClaimTimeout
+	if d, ok := GetClaimTimeoutFromContext(sub.options.Context); ok && d > 0 {
+		claimTimeout = d
+	}
+
+	return &consumer{
+		sub:          sub,
+		client:       client,
+		stream:       stream,
+		group:        group,
+		name:         sub.id,
+		count:        count,
+		block:        block,
+		claimTimeout: claimTimeout,
+	}
+}
+
+type acknowledger struct {
+	consumer *consumer
+	id       string
+}
+
+func (a *acknowledger) Ack() error {
+	return a.consumer.client.XAck(context.Background(), a.consumer.stream, a.consumer.group, a.id).Err()
+}
+
+// Nack keeps the entry pending and claims it back for this consumer once the delay has passed
+func (a *acknowledger) Nack(delay time.Duration) error {
+	sub := a.consumer.sub
+
+	sub.wg.Add(1)
+
+	go func() {
+		defer sub.wg.Done()
+
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-sub.exit:
+		case <-timer.C:
+			a.consumer.redeliver(a.id)
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	"github.com/w-h-a/pkg/broker"
+)
+
+type maxLenKey struct{}
+
+func RedisWithMaxLen(n int64) broker.PublishOption {
+	return func(o *broker.PublishOptions) {
+		o.Context = context.WithValue(o.Context, maxLenKey{}, n)
+	}
+}
+
+func GetMaxLenFromContext(ctx context.Context) (int64, bool) {
+	n, ok := ctx.Value(maxLenKey{}).(int64)
+	return n, ok
+}
+
+type countKey struct{}
+type blockKey struct{}
+type claimTimeoutKey struct{}
+
+func RedisWithCount(n int64) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		o.Context = context.WithValue(o.Context, countKey{}, n)
+	}
+}
+
+func GetCountFromContext(ctx context.Context) (int64, bool) {
+	n, ok := ctx.Value(countKey{}).(int64)
+	return n, ok
+}
+
+func RedisWithBlock(d time.Duration) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		o.Context = context.WithValue(o.Context, blockKey{}, d)
+	}
+}
+
+func GetBlockFromContext(ctx context.Context) (time.Duration, bool) {
+	d, ok := ctx.Value(blockKey{}).(time.Duration)
+	return d, ok
+}
+
+// RedisWithClaimTimeout sets how long a message may stay unacked before another consumer claims it
+func RedisWithClaimTimeout(d time.Duration) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		o.Context = context.WithValue(o.Context, claimTimeoutKey{}, d)
+	}
+}
+
+func GetClaimTimeoutFromContext(ctx context.Context) (time.Duration, bool) {
+	d, ok := ctx.Value(claimTimeoutKey{}).(time.Duration)
+	return d, ok
+}
@@ -0,0 +1,156 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/utils/datautils"
+)
+
+const (
+	bodyField      = "body"
+	headerField    = "header"
+	timestampField = "timestamp"
+)
+
+type redisBroker struct {
+	options   broker.BrokerOptions
+	scheduler *broker.Scheduler
+	client    goredis.UniversalClient
+}
+
+func (b *redisBroker) Options() broker.BrokerOptions {
+	return b.options
+}
+
+func (b *redisBroker) Publish(data interface{}, options broker.PublishOptions) error {
+	return broker.WrapPublish(b.options, b.publish)(data, options)
+}
+
+func (b *redisBroker) publish(data interface{}, options broker.PublishOptions) error {
+	if broker.DeliveryDelay(options) > 0 {
+		if b.scheduler == nil {
+			return broker.ErrSchedulerRequired
+		}
+		return b.scheduler.Schedule(data, options)
+	}
+
+	bs, err := datautils.Stringify(data)
+	if err != nil {
+		return err
+	}
+
+	header, err := json.Marshal(broker.InjectTraceHeaders(options.Context, options.Header))
+	if err != nil {
+		return err
+	}
+
+	args := &goredis.XAddArgs{
+		Stream: options.Topic,
+		Values: map[string]interface{}{
+			bodyField:      bs,
+			headerField:    header,
+			timestampField: time.Now().UnixMilli(),
+		},
+	}
+
+	if options.Context != nil {
+		if n, ok := GetMaxLenFromContext(options.Context); ok {
+			args.MaxLen = n
+			args.Approx = true
+		}
+	}
+
+	return broker.RetryPublish(options, retryCheck, func(ctx context.Context) error {
+		return b.client.XAdd(ctx, args).Err()
+	})
+}
+
+func (b *redisBroker) Subscribe(callback func(*broker.Message) error, options broker.SubscribeOptions) broker.Subscriber {
+	handler := broker.WrapHandler(b.options, callback)
+
+	sub := &subscriber{
+		options: options,
+		id:      uuid.New().String(),
+		handler: handler,
+		client:  b.client,
+		exit:    make(chan struct{}),
+	}
+
+	c := newConsumer(sub, b.client)
+
+	// the group has to exist before we return so that nothing published afterwards is missed
+	if err := b.client.XGroupCreateMkStream(context.Background(), c.stream, c.group, "$").Err(); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		log.Errorf("failed to create consumer group %s on stream %s: %v", c.group, c.stream, err)
+	}
+
+	sub.wg.Add(1)
+
+	go c.run()
+
+	return sub
+}
+
+// Close stops polling the scheduler store
+func (b *redisBroker) Close() error {
+	if b.scheduler != nil {
+		b.scheduler.Stop()
+	}
+
+	return nil
+}
+
+// SubscribesToTopic marks the broker as one that Request can take replies on
+func (b *redisBroker) SubscribesToTopic() {}
+
+func (b *redisBroker) String() string {
+	return "redis"
+}
+
+func (b *redisBroker) configure() error {
+	if len(b.options.Nodes) == 0 {
+		return fmt.Errorf("broker addresses are required")
+	}
+
+	b.client = goredis.NewUniversalClient(&goredis.UniversalOptions{
+		Addrs: b.options.Nodes,
+	})
+
+	return b.client.Ping(context.Background()).Err()
+}
+
+// retryCheck also retries the errors a redis server returns while it loads data or fails over
+func retryCheck(ctx context.Context, retryCount int, err error) (bool, error) {
+	for _, prefix := range []string{"LOADING ", "TRYAGAIN ", "CLUSTERDOWN ", "MASTERDOWN ", "READONLY "} {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return true, nil
+		}
+	}
+
+	return broker.IsTransient(err), nil
+}
+
+func NewBroker(opts ...broker.BrokerOption) broker.Broker {
+	options := broker.NewBrokerOptions(opts...)
+
+	b := &redisBroker{
+		options: options,
+	}
+
+	if err := b.configure(); err != nil {
+		log.Fatal(err)
+	}
+
+	if options.SchedulerStore != nil {
+		b.scheduler = broker.NewScheduler(options.SchedulerStore, b.publish)
+	}
+
+	return b
+}
@@ -0,0 +1,155 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+)
+
+func TestPubSub(t *testing.T) {
+	log.SetLogger(memory.NewLog(memory.LogWithBuffer(memoryutils.NewBuffer())))
+
+	s := miniredis.RunT(t)
+
+	b := NewBroker(broker.BrokerWithNodes(s.Addr()))
+
+	client := goredis.NewClient(&goredis.Options{Addr: s.Addr()})
+	defer client.Close()
+
+	received := make(chan *broker.Message, 1)
+
+	sub := b.Subscribe(func(msg *broker.Message) error {
+		received <- msg
+		return nil
+	}, broker.NewSubscribeOptions(
+		broker.SubscribeWithTopic("orders"),
+		broker.SubscribeWithGroup("billing"),
+		RedisWithBlock(10*time.Millisecond),
+	))
+	defer sub.Unsubscribe(context.Background())
+
+	err := b.Publish("hello", broker.NewPublishOptions(
+		broker.PublishWithTopic("orders"),
+		broker.PublishWithHeader("foo", "bar"),
+	))
+	require.NoError(t, err)
+
+	select {
+	case msg := <-received:
+		require.Equal(t, "orders", msg.Topic)
+		require.Equal(t, []byte("hello"), msg.Body)
+		require.Equal(t, "bar", msg.Header["foo"])
+		require.Equal(t, 1, msg.Attempts)
+		require.False(t, msg.Timestamp.IsZero())
+	case <-time.After(time.Second):
+		t.Fatal("expected the message to be delivered")
+	}
+
+	require.Eventually(t, func() bool {
+		pending, err := client.XPending(context.Background(), "orders", "billing").Result()
+		return err == nil && pending.Count == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRedelivery(t *testing.T) {
+	log.SetLogger(memory.NewLog(memory.LogWithBuffer(memoryutils.NewBuffer())))
+
+	s := miniredis.RunT(t)
+
+	b := NewBroker(broker.BrokerWithNodes(s.Addr()))
+
+	t.Run("nacked messages are claimed back after the delay", func(t *testing.T) {
+		attempts := make(chan int, 2)
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			attempts <- msg.Attempts
+			if msg.Attempts == 1 {
+				return msg.Nack(10 * time.Millisecond)
+			}
+			return nil
+		}, broker.NewSubscribeOptions(
+			broker.SubscribeWithTopic("nack"),
+			broker.SubscribeWithGroup("test"),
+			RedisWithBlock(10*time.Millisecond),
+		))
+		defer sub.Unsubscribe(context.Background())
+
+		err := b.Publish("hello", broker.NewPublishOptions(broker.PublishWithTopic("nack")))
+		require.NoError(t, err)
+
+		require.Equal(t, 1, <-attempts)
+		require.Equal(t, 2, <-attempts)
+	})
+
+	t.Run("nacked messages stay pending once the subscriber leaves", func(t *testing.T) {
+		attempts := make(chan int, 2)
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			attempts <- msg.Attempts
+			return msg.Nack(100 * time.Millisecond)
+		}, broker.NewSubscribeOptions(
+			broker.SubscribeWithTopic("leave"),
+			broker.SubscribeWithGroup("test"),
+			RedisWithBlock(10*time.Millisecond),
+		))
+
+		err := b.Publish("hello", broker.NewPublishOptions(broker.PublishWithTopic("leave")))
+		require.NoError(t, err)
+
+		require.Equal(t, 1, <-attempts)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		require.NoError(t, sub.Unsubscribe(ctx))
+
+		time.Sleep(200 * time.Millisecond)
+
+		require.Empty(t, attempts)
+
+		pending, err := b.(*redisBroker).client.XPending(context.Background(), "leave", "test").Result()
+		require.NoError(t, err)
+		require.Equal(t, int64(1), pending.Count)
+	})
+
+	t.Run("failed messages are claimed and then dead-lettered", func(t *testing.T) {
+		attempts := make(chan int, 2)
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			attempts <- msg.Attempts
+			return errors.New("boom")
+		}, broker.NewSubscribeOptions(
+			broker.SubscribeWithTopic("fail"),
+			broker.SubscribeWithGroup("test"),
+			broker.SubscribeWithMaxDeliveries(2),
+			broker.SubscribeWithDeadLetterTopic("fail-dlq"),
+			RedisWithBlock(10*time.Millisecond),
+			RedisWithClaimTimeout(50*time.Millisecond),
+		))
+		defer sub.Unsubscribe(context.Background())
+
+		err := b.Publish("hello", broker.NewPublishOptions(broker.PublishWithTopic("fail")))
+		require.NoError(t, err)
+
+		require.Equal(t, 1, <-attempts)
+		require.Equal(t, 2, <-attempts)
+
+		require.Eventually(t, func() bool {
+			entries, err := s.Stream("fail-dlq")
+			return err == nil && len(entries) == 1
+		}, time.Second, 10*time.Millisecond)
+
+		entries, err := s.Stream("fail-dlq")
+		require.NoError(t, err)
+		require.Contains(t, entries[0].Values, `{"dead-letter-group":"test","dead-letter-reason":"boom","dead-letter-source":"fail"}`)
+	})
+}
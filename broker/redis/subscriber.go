@@ -0,0 +1,63 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/w-h-a/pkg/broker"
+)
+
+type subscriber struct {
+	options broker.SubscribeOptions
+	id      string
+	handler broker.HandlerFunc
+	client  goredis.UniversalClient
+	wg      sync.WaitGroup
+	exit    chan struct{}
+}
+
+func (s *subscriber) Options() broker.SubscribeOptions {
+	return s.options
+}
+
+func (s *subscriber) Id() string {
+	return s.id
+}
+
+func (s *subscriber) Handler(msg *broker.Message) error {
+	// the entry stays pending until a consumer claims it again
+	return broker.HandleMessage(s.options, msg, s.handler, nil, s.deadLetter)
+}
+
+func (s *subscriber) Unsubscribe(ctx context.Context) error {
+	select {
+	case <-s.exit:
+	default:
+		close(s.exit)
+	}
+
+	return broker.WaitForGroup(ctx, &s.wg)
+}
+
+func (s *subscriber) String() string {
+	return "redis"
+}
+
+func (s *subscriber) deadLetter(topic string, msg *broker.Message, header map[string]string) error {
+	bs, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	return s.client.XAdd(context.Background(), &goredis.XAddArgs{
+		Stream: topic,
+		Values: map[string]interface{}{
+			bodyField:      msg.Body,
+			headerField:    bs,
+			timestampField: time.Now().UnixMilli(),
+		},
+	}).Err()
+}
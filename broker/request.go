@@ -0,0 +1,162 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// every broker gets one reply topic per process until CloseReplies, so requests do not leave topics behind
+	repliers    = map[Broker]*replier{}
+	repliersMtx = sync.Mutex{}
+)
+
+// Request publishes the message with a correlation id and a reply-to topic and waits until the reply arrives or ctx is done.
+// The reply-to topic is shared by the requests of the process and its subscriber routes replies by correlation id until
+// CloseReplies. Brokers that are not a TopicSubscriber cannot take requests and fail with ErrRequestUnsupported.
+func Request(ctx context.Context, b Broker, data interface{}, options PublishOptions) (*Message, error) {
+	r, err := replierFor(b)
+	if err != nil {
+		return nil, err
+	}
+
+	correlationId := uuid.New().String()
+
+	replies := r.await(correlationId)
+	defer r.forget(correlationId)
+
+	header := map[string]string{}
+
+	for k, v := range options.Header {
+		header[k] = v
+	}
+
+	header[CorrelationIdHeader] = correlationId
+	header[ReplyToHeader] = r.topic
+
+	options.Header = header
+	options.Context = ctx
+
+	if err := b.Publish(data, options); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.done:
+		return nil, ErrRepliesClosed
+	case msg := <-replies:
+		return msg, nil
+	}
+}
+
+// CloseReplies unsubscribes the reply topic that Request made for b and fails the requests still waiting on it.
+// A later Request on b subscribes to a new reply topic.
+func CloseReplies(ctx context.Context, b Broker) error {
+	repliersMtx.Lock()
+	r, ok := repliers[b]
+	delete(repliers, b)
+	repliersMtx.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	close(r.done)
+
+	return r.sub.Unsubscribe(ctx)
+}
+
+// Reply publishes the reply to the topic the request asked for under the request's correlation id
+func Reply(b Broker, req *Message, data interface{}, opts ...PublishOption) error {
+	replyTo := req.Header[ReplyToHeader]
+	if len(replyTo) == 0 {
+		return ErrNoReplyTo
+	}
+
+	// the reply carries on the request's trace unless the responder passes its own context
+	if req.Context != nil {
+		opts = append([]PublishOption{PublishWithContext(req.Context)}, opts...)
+	}
+
+	options := NewPublishOptions(opts...)
+
+	options.Topic = replyTo
+	options.Header[CorrelationIdHeader] = req.Header[CorrelationIdHeader]
+
+	return b.Publish(data, options)
+}
+
+type replier struct {
+	topic   string
+	sub     Subscriber
+	pending map[string]chan *Message
+	done    chan struct{}
+	mtx     sync.Mutex
+}
+
+// route hands the reply to the request that is waiting on it and drops replies that come after the request gave up
+func (r *replier) route(msg *Message) error {
+	r.mtx.Lock()
+	replies, ok := r.pending[msg.Header[CorrelationIdHeader]]
+	r.mtx.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	select {
+	case replies <- msg:
+	default:
+	}
+
+	return nil
+}
+
+func (r *replier) await(correlationId string) chan *Message {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	replies := make(chan *Message, 1)
+
+	r.pending[correlationId] = replies
+
+	return replies
+}
+
+func (r *replier) forget(correlationId string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	delete(r.pending, correlationId)
+}
+
+// replierFor refuses brokers that would hand the reply subscriber messages of other topics, which it would take and drop
+func replierFor(b Broker) (*replier, error) {
+	if _, ok := b.(TopicSubscriber); !ok {
+		return nil, ErrRequestUnsupported
+	}
+
+	repliersMtx.Lock()
+	defer repliersMtx.Unlock()
+
+	if r, ok := repliers[b]; ok {
+		return r, nil
+	}
+
+	r := &replier{
+		topic:   fmt.Sprintf("replies.%s", uuid.New().String()),
+		pending: map[string]chan *Message{},
+		done:    make(chan struct{}),
+	}
+
+	r.sub = b.Subscribe(r.route, NewSubscribeOptions(SubscribeWithTopic(r.topic)))
+
+	repliers[b] = r
+
+	return r, nil
+}
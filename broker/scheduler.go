@@ -0,0 +1,212 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/utils/datautils"
+)
+
+const (
+	schedulerPrefix          = "broker/scheduled/"
+	schedulerClaimPrefix     = "broker/scheduled-claim/"
+	defaultSchedulerTick     = time.Second
+	defaultSchedulerClaimTTL = time.Minute
+)
+
+type scheduledMessage struct {
+	Topic           string            `json:"topic"`
+	Key             string            `json:"key,omitempty"`
+	DeduplicationId string            `json:"deduplicationId,omitempty"`
+	Header          map[string]string `json:"header,omitempty"`
+	Body            []byte            `json:"body"`
+}
+
+// Scheduler keeps delayed messages in a store and publishes them once they are due.
+// Instances that share the store claim each message before publishing it so that it goes out once.
+type Scheduler struct {
+	store   store.Store
+	publish PublishFunc
+	tick    time.Duration
+	exit    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Schedule stores the message until its delivery delay has passed
+func (s *Scheduler) Schedule(data interface{}, options PublishOptions) error {
+	if options.Context != nil {
+		if err := options.Context.Err(); err != nil {
+			return err
+		}
+	}
+
+	bs, err := datautils.Stringify(data)
+	if err != nil {
+		return err
+	}
+
+	msg := scheduledMessage{
+		Topic:           options.Topic,
+		Key:             options.Key,
+		DeduplicationId: options.DeduplicationId,
+		Header:          InjectTraceHeaders(options.Context, options.Header),
+		Body:            bs,
+	}
+
+	value, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	deliverAt := time.Now().Add(DeliveryDelay(options))
+
+	// keys sort by delivery time so that the due messages come first
+	return s.store.Write(&store.Record{
+		Key:   fmt.Sprintf("%s%020d/%s", schedulerPrefix, deliverAt.UnixNano(), uuid.New().String()),
+		Value: value,
+	})
+}
+
+func (s *Scheduler) Stop() {
+	s.once.Do(func() {
+		close(s.exit)
+	})
+
+	<-s.done
+}
+
+func (s *Scheduler) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.exit:
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.publishDue(); err != nil {
+			log.Errorf("failed to publish scheduled messages: %v", err)
+		}
+	}
+}
+
+func (s *Scheduler) publishDue() error {
+	keys, err := s.store.List(store.ListWithPrefix(schedulerPrefix))
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(keys)
+
+	now := time.Now().UnixNano()
+
+	for _, key := range keys {
+		select {
+		case <-s.exit:
+			return nil
+		default:
+		}
+
+		deliverAt, err := strconv.ParseInt(strings.SplitN(strings.TrimPrefix(key, schedulerPrefix), "/", 2)[0], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if deliverAt > now {
+			break
+		}
+
+		if err := s.publishOne(key); err != nil {
+			log.Errorf("failed to publish scheduled message %s: %v", key, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Scheduler) publishOne(key string) error {
+	claim := schedulerClaimPrefix + strings.TrimPrefix(key, schedulerPrefix)
+
+	err := s.store.Write(&store.Record{
+		Key:    claim,
+		Value:  []byte("claimed"),
+		Expiry: defaultSchedulerClaimTTL,
+	}, store.WriteWithIfNotExists())
+	if errors.Is(err, store.ErrRecordExists) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	recs, err := s.store.Read(key)
+	if errors.Is(err, store.ErrRecordNotFound) || (err == nil && len(recs) == 0) {
+		// another instance published it between the listing and the claim
+		return s.store.Delete(claim)
+	}
+
+	if err != nil {
+		s.store.Delete(claim)
+		return err
+	}
+
+	msg := scheduledMessage{}
+
+	if err := json.Unmarshal(recs[0].Value, &msg); err != nil {
+		s.store.Delete(claim)
+		return err
+	}
+
+	options := NewPublishOptions(
+		PublishWithTopic(msg.Topic),
+		PublishWithKey(msg.Key),
+		PublishWithDeduplicationId(msg.DeduplicationId),
+		PublishWithContext(context.Background()),
+	)
+
+	for k, v := range msg.Header {
+		options.Header[k] = v
+	}
+
+	if err := s.publish(msg.Body, options); err != nil {
+		s.store.Delete(claim)
+		return err
+	}
+
+	if err := s.store.Delete(key); err != nil {
+		return err
+	}
+
+	return s.store.Delete(claim)
+}
+
+// NewScheduler starts polling the store and hands due messages to publish, which should not apply delays again
+func NewScheduler(s store.Store, publish PublishFunc) *Scheduler {
+	sch := &Scheduler{
+		store:   s,
+		publish: publish,
+		tick:    defaultSchedulerTick,
+		exit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go sch.run()
+
+	return sch
+}
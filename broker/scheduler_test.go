@@ -0,0 +1,84 @@
+package broker
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/store/memory"
+	"github.com/w-h-a/pkg/telemetry/log"
+	logmemory "github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+)
+
+func TestScheduler(t *testing.T) {
+	log.SetLogger(logmemory.NewLog(logmemory.LogWithBuffer(memoryutils.NewBuffer())))
+
+	s := memory.NewStore()
+
+	published := []PublishOptions{}
+	bodies := []interface{}{}
+	fail := true
+	mtx := sync.Mutex{}
+
+	publish := func(data interface{}, options PublishOptions) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		if fail {
+			fail = false
+			return errors.New("boom")
+		}
+
+		published = append(published, options)
+		bodies = append(bodies, data)
+
+		return nil
+	}
+
+	// two instances share the store and the message still goes out once
+	first := NewScheduler(s, publish)
+	defer first.Stop()
+
+	second := NewScheduler(s, publish)
+	defer second.Stop()
+
+	err := first.Schedule("expired", NewPublishOptions(
+		PublishWithTopic("orders"),
+		PublishWithKey("order-1"),
+		PublishWithHeader("foo", "bar"),
+		PublishWithDelay(100*time.Millisecond),
+	))
+	require.NoError(t, err)
+
+	err = first.Schedule("later", NewPublishOptions(
+		PublishWithTopic("orders"),
+		PublishWithDelay(time.Hour),
+	))
+	require.NoError(t, err)
+
+	// the failed publish is retried on the next tick
+	require.Eventually(t, func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return len(published) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	time.Sleep(1500 * time.Millisecond)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	require.Len(t, published, 1)
+	require.Equal(t, []byte("expired"), bodies[0])
+	require.Equal(t, "orders", published[0].Topic)
+	require.Equal(t, "order-1", published[0].Key)
+	require.Equal(t, "bar", published[0].Header["foo"])
+
+	keys, err := s.List(store.ListWithPrefix(schedulerPrefix))
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+}
@@ -3,37 +3,122 @@ package snssqs
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/google/uuid"
 	"github.com/w-h-a/pkg/broker"
 	"github.com/w-h-a/pkg/telemetry/log"
 )
 
 type SnsClient interface {
-	ProduceToTopic(bs []byte, topic string) error
+	ProduceToTopic(ctx context.Context, bs []byte, options broker.PublishOptions) error
+	// ProduceBatchToTopic sends up to 10 messages to the topic of the first one and returns their errors in order
+	ProduceBatchToTopic(ctx context.Context, bss [][]byte, options []broker.PublishOptions) []error
 }
 
 type snsClient struct {
 	*sns.Client
 }
 
-func (c *snsClient) ProduceToTopic(bs []byte, topic string) error {
+func (c *snsClient) ProduceToTopic(ctx context.Context, bs []byte, options broker.PublishOptions) error {
 	input := &sns.PublishInput{
-		Message:  aws.String(string(bs)),
-		TopicArn: aws.String(topic),
+		Message:           aws.String(string(bs)),
+		TopicArn:          aws.String(options.Topic),
+		MessageAttributes: messageAttributes(options.Header),
 	}
 
-	if _, err := c.Publish(context.Background(), input); err != nil {
+	// fifo topics require a group and either a deduplication id or content-based deduplication
+	if len(options.Key) > 0 {
+		input.MessageGroupId = aws.String(options.Key)
+	}
+
+	if len(options.DeduplicationId) > 0 {
+		input.MessageDeduplicationId = aws.String(options.DeduplicationId)
+	}
+
+	if _, err := c.Publish(ctx, input); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+func (c *snsClient) ProduceBatchToTopic(ctx context.Context, bss [][]byte, options []broker.PublishOptions) []error {
+	errs := make([]error, len(bss))
+
+	input := &sns.PublishBatchInput{
+		TopicArn: aws.String(options[0].Topic),
+	}
+
+	for i, bs := range bss {
+		entry := snstypes.PublishBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			Message:           aws.String(string(bs)),
+			MessageAttributes: messageAttributes(options[i].Header),
+		}
+
+		if len(options[i].Key) > 0 {
+			entry.MessageGroupId = aws.String(options[i].Key)
+		}
+
+		if len(options[i].DeduplicationId) > 0 {
+			entry.MessageDeduplicationId = aws.String(options[i].DeduplicationId)
+		}
+
+		input.PublishBatchRequestEntries = append(input.PublishBatchRequestEntries, entry)
+	}
+
+	result, err := c.PublishBatch(ctx, input)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	for _, failed := range result.Failed {
+		i, err := strconv.Atoi(aws.ToString(failed.Id))
+		if err != nil || i >= len(errs) {
+			continue
+		}
+		errs[i] = fmt.Errorf("failed to publish sns message: %s: %s", aws.ToString(failed.Code), aws.ToString(failed.Message))
+	}
+
+	return errs
+}
+
+func messageAttributes(header map[string]string) map[string]snstypes.MessageAttributeValue {
+	attributes := map[string]snstypes.MessageAttributeValue{}
+
+	for k, v := range header {
+		// sns rejects attributes with empty values
+		if len(v) == 0 {
+			continue
+		}
+
+		attributes[k] = snstypes.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(v),
+		}
+	}
+
+	return attributes
+}
+
 type SqsClient interface {
-	ConsumeFromGroup(sub broker.Subscriber)
+	SendToGroup(ctx context.Context, bs []byte, options broker.PublishOptions, delaySeconds int32) error
+	ReceiveFromGroup(ctx context.Context, maxMessages int32) ([]*ReceivedMessage, error)
+	DeleteFromGroup(ctx context.Context, receiptHandles []string) []error
+	ChangeVisibility(ctx context.Context, receiptHandle string, timeout int32) error
+	// CountInGroup returns the approximate number of messages waiting in the queue and of messages received but not deleted yet
+	CountInGroup(ctx context.Context) (int64, int64, error)
 }
 
 type sqsClient struct {
@@ -44,45 +129,194 @@ type sqsClient struct {
 }
 
 type sqsMsg struct {
-	Message string `json:"message"`
+	Message           string                  `json:"message"`
+	MessageId         string                  `json:"messageId"`
+	TopicArn          string                  `json:"topicArn"`
+	Timestamp         time.Time               `json:"timestamp"`
+	MessageAttributes map[string]sqsAttribute `json:"messageAttributes"`
+	// sent along by the delay queue so that forwarding keeps fifo ordering and deduplication
+	MessageGroupId         string `json:"messageGroupId,omitempty"`
+	MessageDeduplicationId string `json:"messageDeduplicationId,omitempty"`
+}
+
+type sqsAttribute struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
 }
 
-func (c *sqsClient) ConsumeFromGroup(sub broker.Subscriber) {
-	result, err := c.ReceiveMessage(context.Background(), &sqs.ReceiveMessageInput{
+// SendToGroup wraps the message like sns does so that it reads the same as messages that came through a topic
+func (c *sqsClient) SendToGroup(ctx context.Context, bs []byte, options broker.PublishOptions, delaySeconds int32) error {
+	msg := sqsMsg{
+		Message:                string(bs),
+		MessageId:              uuid.New().String(),
+		TopicArn:               options.Topic,
+		Timestamp:              time.Now(),
+		MessageAttributes:      map[string]sqsAttribute{},
+		MessageGroupId:         options.Key,
+		MessageDeduplicationId: options.DeduplicationId,
+	}
+
+	for k, v := range options.Header {
+		msg.MessageAttributes[k] = sqsAttribute{Type: "String", Value: v}
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:     c.queueUrl,
+		MessageBody:  aws.String(string(body)),
+		DelaySeconds: delaySeconds,
+	})
+
+	return err
+}
+
+func (c *sqsClient) ReceiveFromGroup(ctx context.Context, maxMessages int32) ([]*ReceivedMessage, error) {
+	result, err := c.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
 		QueueUrl:              c.queueUrl,
-		MaxNumberOfMessages:   1,
+		MaxNumberOfMessages:   maxMessages,
 		VisibilityTimeout:     c.visibilityTimeout,
 		WaitTimeSeconds:       c.waitTimeSeconds,
 		MessageAttributeNames: []string{"All"},
+		MessageSystemAttributeNames: []sqstypes.MessageSystemAttributeName{
+			sqstypes.MessageSystemAttributeNameApproximateReceiveCount,
+			sqstypes.MessageSystemAttributeNameSentTimestamp,
+			sqstypes.MessageSystemAttributeNameMessageGroupId,
+		},
 	})
 	if err != nil {
-		log.Errorf("failed to receive sqs message from group %s: %s", sub.Options().Group, err.Error())
-		return
+		return nil, err
 	}
 
-	if len(result.Messages) == 0 {
-		return
-	}
+	msgs := []*ReceivedMessage{}
 
 	for _, msg := range result.Messages {
-		body := msg.Body
+		m, err := c.toMessage(msg)
+		if err != nil {
+			log.Errorf("failed to unmarshal sqs message %s: %s", aws.ToString(msg.MessageId), err)
+			continue
+		}
 
-		var sqsMsg sqsMsg
+		msgs = append(msgs, m)
+	}
 
-		if err := json.Unmarshal([]byte(*body), &sqsMsg); err != nil {
-			log.Errorf("failed to unmarshal message from group %s: %s", sub.Options().Group, err)
-			continue
+	return msgs, nil
+}
+
+func (c *sqsClient) DeleteFromGroup(ctx context.Context, receiptHandles []string) []error {
+	errs := make([]error, len(receiptHandles))
+
+	entries := []sqstypes.DeleteMessageBatchRequestEntry{}
+
+	for i, handle := range receiptHandles {
+		entries = append(entries, sqstypes.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(i)),
+			ReceiptHandle: aws.String(handle),
+		})
+	}
+
+	result, err := c.DeleteMessageBatch(ctx, &sqs.DeleteMessageBatchInput{
+		QueueUrl: c.queueUrl,
+		Entries:  entries,
+	})
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
 		}
+		return errs
+	}
 
-		if err := sub.Handler([]byte(sqsMsg.Message)); err != nil {
-			log.Errorf("failed to handle message from group %s: %s", sub.Options().Group, err)
+	for _, failed := range result.Failed {
+		i, err := strconv.Atoi(aws.ToString(failed.Id))
+		if err != nil || i >= len(errs) {
 			continue
 		}
+		errs[i] = fmt.Errorf("failed to delete sqs message: %s: %s", aws.ToString(failed.Code), aws.ToString(failed.Message))
+	}
 
-		msgHandle := msg.ReceiptHandle
-		c.DeleteMessage(context.Background(), &sqs.DeleteMessageInput{
-			QueueUrl:      aws.String(sub.Options().Group),
-			ReceiptHandle: msgHandle,
-		})
+	return errs
+}
+
+func (c *sqsClient) ChangeVisibility(ctx context.Context, receiptHandle string, timeout int32) error {
+	_, err := c.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          c.queueUrl,
+		ReceiptHandle:     aws.String(receiptHandle),
+		VisibilityTimeout: timeout,
+	})
+
+	return err
+}
+
+func (c *sqsClient) toMessage(msg sqstypes.Message) (*ReceivedMessage, error) {
+	var sqsMsg sqsMsg
+
+	if err := json.Unmarshal([]byte(aws.ToString(msg.Body)), &sqsMsg); err != nil {
+		return nil, err
 	}
+
+	m := &ReceivedMessage{
+		ReceiptHandle:   aws.ToString(msg.ReceiptHandle),
+		Id:              sqsMsg.MessageId,
+		Topic:           sqsMsg.TopicArn,
+		Header:          map[string]string{},
+		Body:            []byte(sqsMsg.Message),
+		Timestamp:       sqsMsg.Timestamp,
+		GroupId:         msg.Attributes[string(sqstypes.MessageSystemAttributeNameMessageGroupId)],
+		DeduplicationId: sqsMsg.MessageDeduplicationId,
+	}
+
+	if len(m.GroupId) == 0 {
+		m.GroupId = sqsMsg.MessageGroupId
+	}
+
+	if len(m.Id) == 0 {
+		m.Id = aws.ToString(msg.MessageId)
+	}
+
+	if sent, err := strconv.ParseInt(msg.Attributes[string(sqstypes.MessageSystemAttributeNameSentTimestamp)], 10, 64); err == nil && m.Timestamp.IsZero() {
+		m.Timestamp = time.UnixMilli(sent)
+	}
+
+	if count, err := strconv.Atoi(msg.Attributes[string(sqstypes.MessageSystemAttributeNameApproximateReceiveCount)]); err == nil {
+		m.Attempts = count
+	}
+
+	// attributes arrive in the sns envelope unless raw message delivery is enabled
+	for k, v := range sqsMsg.MessageAttributes {
+		m.Header[k] = v.Value
+	}
+
+	for k, v := range msg.MessageAttributes {
+		m.Header[k] = aws.ToString(v.StringValue)
+	}
+
+	return m, nil
+}
+
+func (c *sqsClient) CountInGroup(ctx context.Context) (int64, int64, error) {
+	result, err := c.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl: c.queueUrl,
+		AttributeNames: []sqstypes.QueueAttributeName{
+			sqstypes.QueueAttributeNameApproximateNumberOfMessages,
+			sqstypes.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+		},
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	waiting, err := strconv.ParseInt(result.Attributes[string(sqstypes.QueueAttributeNameApproximateNumberOfMessages)], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	received, err := strconv.ParseInt(result.Attributes[string(sqstypes.QueueAttributeNameApproximateNumberOfMessagesNotVisible)], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return waiting, received, nil
 }
@@ -0,0 +1,374 @@
+package snssqs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/telemetry/log"
+)
+
+var (
+	errUnsubscribed = errors.New("subscriber has unsubscribed")
+)
+
+const (
+	defaultReceivers   = 1
+	defaultWorkers     = 1
+	defaultMaxMessages = int32(1)
+	maxBatchSize       = 10
+	ackInterval        = 100 * time.Millisecond
+	receiveBackoff     = time.Second
+	maxVisibility      = 12 * time.Hour
+)
+
+type consumer struct {
+	sub               *subscriber
+	client            SqsClient
+	receivers         int
+	maxMessages       int32
+	visibilityTimeout int32
+	slots             chan struct{}
+	acks              chan string
+	done              chan struct{}
+	groups            map[string][]*sqsAcknowledger
+	mtx               sync.Mutex
+}
+
+func (c *consumer) run() {
+	c.sub.wg.Add(1 + c.receivers)
+
+	go c.batch()
+
+	for i := 0; i < c.receivers; i++ {
+		go c.receive()
+	}
+}
+
+func (c *consumer) receive() {
+	defer c.sub.wg.Done()
+
+	for {
+		n := c.acquire()
+		if n == 0 {
+			return
+		}
+
+		msgs, err := c.client.ReceiveFromGroup(context.Background(), int32(n))
+		if err != nil {
+			log.Errorf("failed to receive sqs messages from group %s: %s", c.sub.options.Group, err)
+		}
+
+		if unused := n - len(msgs); unused > 0 {
+			c.release(unused)
+		}
+
+		// a receive that was in flight as the subscriber left hands its messages back
+		if c.stopped() {
+			as := make([]*sqsAcknowledger, len(msgs))
+			for i, msg := range msgs {
+				as[i] = c.acknowledger(msg)
+			}
+			c.abandon(as)
+			return
+		}
+
+		for _, msg := range msgs {
+			c.dispatch(msg)
+		}
+
+		// back off when the queue is empty or failing so that we don't spin
+		if len(msgs) == 0 {
+			select {
+			case <-c.sub.exit:
+				return
+			case <-time.After(receiveBackoff):
+			}
+		}
+	}
+}
+
+// acquire blocks until at least one worker is free and then claims up to maxMessages of them
+func (c *consumer) acquire() int {
+	select {
+	case c.slots <- struct{}{}:
+	case <-c.sub.exit:
+		return 0
+	}
+
+	n := 1
+
+	for n < int(c.maxMessages) {
+		select {
+		case c.slots <- struct{}{}:
+			n++
+		default:
+			return n
+		}
+	}
+
+	return n
+}
+
+func (c *consumer) release(n int) {
+	for i := 0; i < n; i++ {
+		<-c.slots
+	}
+}
+
+// dispatch hands messages of the same fifo group to the handler one at a time and in the order they arrived
+func (c *consumer) dispatch(rm *ReceivedMessage) {
+	c.sub.wg.Add(1)
+
+	// the message is kept invisible from the moment it is received, including while it waits behind its group
+	a := c.acknowledger(rm)
+
+	go c.heartbeat(rm.ReceiptHandle, a.stop)
+
+	if len(rm.GroupId) == 0 {
+		go c.handle(a)
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	pending, running := c.groups[rm.GroupId]
+
+	c.groups[rm.GroupId] = append(pending, a)
+
+	if !running {
+		go c.drain(rm.GroupId)
+	}
+}
+
+func (c *consumer) drain(groupId string) {
+	for {
+		c.mtx.Lock()
+
+		pending := c.groups[groupId]
+		if len(pending) == 0 {
+			delete(c.groups, groupId)
+			c.mtx.Unlock()
+			return
+		}
+
+		c.groups[groupId] = pending[1:]
+
+		c.mtx.Unlock()
+
+		if err := c.handle(pending[0]); err != nil {
+			// sqs holds back the rest of the group until the failed message is redelivered
+			c.mtx.Lock()
+			rest := c.groups[groupId]
+			delete(c.groups, groupId)
+			c.mtx.Unlock()
+
+			c.abandon(rest)
+
+			c.sub.wg.Add(-len(rest))
+
+			return
+		}
+	}
+}
+
+func (c *consumer) stopped() bool {
+	select {
+	case <-c.sub.exit:
+		return true
+	default:
+		return false
+	}
+}
+
+// abandon makes the messages visible again right away so that sqs redelivers them in order
+func (c *consumer) abandon(as []*sqsAcknowledger) {
+	for _, a := range as {
+		a.stopHeartbeat()
+
+		if err := c.client.ChangeVisibility(context.Background(), a.receiptHandle, 0); err != nil {
+			log.Warnf("failed to release message %s of group %s: %s", a.received.Id, c.sub.options.Group, err)
+		}
+
+		c.release(1)
+	}
+}
+
+func (c *consumer) acknowledger(rm *ReceivedMessage) *sqsAcknowledger {
+	return &sqsAcknowledger{
+		consumer:      c,
+		received:      rm,
+		receiptHandle: rm.ReceiptHandle,
+		stop:          make(chan struct{}),
+	}
+}
+
+func (c *consumer) handle(a *sqsAcknowledger) error {
+	defer c.sub.wg.Done()
+
+	if c.stopped() {
+		c.abandon([]*sqsAcknowledger{a})
+		return errUnsubscribed
+	}
+
+	defer c.release(1)
+
+	defer a.stopHeartbeat()
+
+	rm := a.received
+
+	msg := broker.NewMessage(a)
+	msg.Id = rm.Id
+	msg.Topic = rm.Topic
+	msg.Body = rm.Body
+	msg.Timestamp = rm.Timestamp
+	msg.Attempts = rm.Attempts
+
+	for k, v := range rm.Header {
+		msg.Header[k] = v
+	}
+
+	msg.Context = broker.ExtractTraceHeaders(context.Background(), msg.Header)
+
+	err := c.sub.Handler(msg)
+	if err != nil {
+		log.Errorf("failed to handle message %s from group %s: %s", msg.Id, c.sub.options.Group, err)
+	}
+
+	return err
+}
+
+// heartbeat keeps the message invisible to other consumers until it is handled or abandoned
+func (c *consumer) heartbeat(receiptHandle string, stop chan struct{}) {
+	if c.visibilityTimeout <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(c.visibilityTimeout) * time.Second / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := c.client.ChangeVisibility(context.Background(), receiptHandle, c.visibilityTimeout); err != nil {
+				log.Warnf("failed to extend visibility of message in group %s: %s", c.sub.options.Group, err)
+			}
+		}
+	}
+}
+
+func (c *consumer) ack(receiptHandle string) {
+	select {
+	case c.acks <- receiptHandle:
+	case <-c.done:
+		c.delete([]string{receiptHandle})
+	}
+}
+
+// batch collects acks and deletes them together once a batch fills up or the interval passes
+func (c *consumer) batch() {
+	defer c.sub.wg.Done()
+
+	defer close(c.done)
+
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+
+	pending := []string{}
+
+	for {
+		select {
+		case receiptHandle := <-c.acks:
+			pending = append(pending, receiptHandle)
+			if len(pending) == maxBatchSize {
+				c.delete(pending)
+				pending = []string{}
+			}
+		case <-ticker.C:
+			c.delete(pending)
+			pending = []string{}
+		case <-c.sub.exit:
+			c.delete(pending)
+			return
+		}
+	}
+}
+
+func (c *consumer) delete(receiptHandles []string) {
+	if len(receiptHandles) == 0 {
+		return
+	}
+
+	errs := c.client.DeleteFromGroup(context.Background(), receiptHandles)
+
+	for _, err := range errs {
+		if err != nil {
+			log.Errorf("failed to ack message from group %s: %s", c.sub.options.Group, err)
+		}
+	}
+}
+
+func newConsumer(sub *subscriber, client SqsClient, visibilityTimeout int32) *consumer {
+	receivers := defaultReceivers
+	if n, ok := GetReceiversFromContext(sub.options.Context); ok && n > 0 {
+		receivers = n
+	}
+
+	workers := defaultWorkers
+	if n, ok := GetWorkersFromContext(sub.options.Context); ok && n > 0 {
+		workers = n
+	}
+
+	maxMessages := defaultMaxMessages
+	if n, ok := GetMaxMessagesFromContext(sub.options.Context); ok && n > 0 {
+		maxMessages = min(n, maxBatchSize)
+	}
+
+	return &consumer{
+		sub:               sub,
+		client:            client,
+		receivers:         receivers,
+		maxMessages:       maxMessages,
+		visibilityTimeout: visibilityTimeout,
+		slots:             make(chan struct{}, workers),
+		acks:              make(chan string),
+		done:              make(chan struct{}),
+		groups:            map[string][]*sqsAcknowledger{},
+		mtx:               sync.Mutex{},
+	}
+}
+
+type sqsAcknowledger struct {
+	consumer      *consumer
+	received      *ReceivedMessage
+	receiptHandle string
+	stop          chan struct{}
+	once          sync.Once
+}
+
+// Ack is batched, so failed deletes are logged and the message is redelivered by sqs
+func (a *sqsAcknowledger) Ack() error {
+	a.stopHeartbeat()
+
+	a.consumer.ack(a.receiptHandle)
+
+	return nil
+}
+
+func (a *sqsAcknowledger) Nack(delay time.Duration) error {
+	a.stopHeartbeat()
+
+	// sqs rejects visibility timeouts past its maximum
+	return a.consumer.client.ChangeVisibility(context.Background(), a.receiptHandle, int32(min(delay, maxVisibility).Seconds()))
+}
+
+func (a *sqsAcknowledger) stopHeartbeat() {
+	a.once.Do(func() {
+		close(a.stop)
+	})
+}
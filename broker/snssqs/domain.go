@@ -0,0 +1,15 @@
+package snssqs
+
+import "time"
+
+type ReceivedMessage struct {
+	ReceiptHandle   string
+	Id              string
+	Topic           string
+	Header          map[string]string
+	Body            []byte
+	Timestamp       time.Time
+	Attempts        int
+	GroupId         string
+	DeduplicationId string
+}
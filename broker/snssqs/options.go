@@ -31,6 +31,32 @@ func GetSqsClientFromContext(ctx context.Context) (SqsClient, bool) {
 	return c, ok
 }
 
+type delayQueueKey struct{}
+type delayClientKey struct{}
+
+// SnsSqsWithDelayQueue names the sqs queue that holds delayed messages of up to 15 minutes before they go to sns
+func SnsSqsWithDelayQueue(name string) broker.BrokerOption {
+	return func(o *broker.BrokerOptions) {
+		o.Context = context.WithValue(o.Context, delayQueueKey{}, name)
+	}
+}
+
+func GetDelayQueueFromContext(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(delayQueueKey{}).(string)
+	return name, ok
+}
+
+func SnsSqsWithDelayClient(c SqsClient) broker.BrokerOption {
+	return func(o *broker.BrokerOptions) {
+		o.Context = context.WithValue(o.Context, delayClientKey{}, c)
+	}
+}
+
+func GetDelayClientFromContext(ctx context.Context) (SqsClient, bool) {
+	c, ok := ctx.Value(delayClientKey{}).(SqsClient)
+	return c, ok
+}
+
 type visibilityTimeoutKey struct{}
 type waitTimeSecondsKey struct{}
 
@@ -55,3 +81,40 @@ func GetWaitTimeSecondsFromContext(ctx context.Context) (int32, bool) {
 	t, ok := ctx.Value(waitTimeSecondsKey{}).(int32)
 	return t, ok
 }
+
+type receiversKey struct{}
+type workersKey struct{}
+type maxMessagesKey struct{}
+
+func SqsWithReceivers(n int) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		o.Context = context.WithValue(o.Context, receiversKey{}, n)
+	}
+}
+
+func GetReceiversFromContext(ctx context.Context) (int, bool) {
+	n, ok := ctx.Value(receiversKey{}).(int)
+	return n, ok
+}
+
+func SqsWithWorkers(n int) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		o.Context = context.WithValue(o.Context, workersKey{}, n)
+	}
+}
+
+func GetWorkersFromContext(ctx context.Context) (int, bool) {
+	n, ok := ctx.Value(workersKey{}).(int)
+	return n, ok
+}
+
+func SqsWithMaxMessages(n int32) broker.SubscribeOption {
+	return func(o *broker.SubscribeOptions) {
+		o.Context = context.WithValue(o.Context, maxMessagesKey{}, n)
+	}
+}
+
+func GetMaxMessagesFromContext(ctx context.Context) (int32, bool) {
+	n, ok := ctx.Value(maxMessagesKey{}).(int32)
+	return n, ok
+}
@@ -3,9 +3,14 @@ package snssqs
 import (
 	"context"
 	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/sns"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
@@ -18,64 +23,361 @@ import (
 const (
 	defaultVisibilityTimeout int32 = 8
 	defaultWaitSeconds       int32 = 8
+	// sqs holds messages back for at most 15 minutes
+	maxSqsDelay                 = 15 * time.Minute
+	delayQueueMaxMessages int32 = 10
 )
 
 type snssqs struct {
-	options   broker.BrokerOptions
-	snsClient SnsClient
-	sqsClient SqsClient
+	options     broker.BrokerOptions
+	scheduler   *broker.Scheduler
+	snsClient   SnsClient
+	sqsClient   SqsClient
+	delayClient SqsClient
+	subscribers map[string]*subscriber
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+	mtx         sync.RWMutex
 }
 
 func (b *snssqs) Options() broker.BrokerOptions {
 	return b.options
 }
 
-// TODO: retry
-/* for loop with max retries
-**	go call a function that (a) calls exponential function (b) sleeps for the duration and (c) calls actual write that sends error to chan
-**  if err from chan is nil, stop
-**  else, keep looping
- */
 func (b *snssqs) Publish(data interface{}, options broker.PublishOptions) error {
+	return broker.WrapPublish(b.options, b.publish)(data, options)
+}
+
+func (b *snssqs) publish(data interface{}, options broker.PublishOptions) error {
+	if delay := broker.DeliveryDelay(options); delay > 0 {
+		// sns has no delays so short ones wait in the sqs delay queue and the rest in the scheduler
+		if b.delayClient != nil && delay <= maxSqsDelay {
+			return b.delay(data, options, delay)
+		}
+		if b.scheduler == nil {
+			return broker.ErrSchedulerRequired
+		}
+		return b.scheduler.Schedule(data, options)
+	}
+
 	bs, err := datautils.Stringify(data)
 	if err != nil {
 		return err
 	}
 
-	if err := b.snsClient.ProduceToTopic(bs, options.Topic); err != nil {
-		return err
+	options.Header = broker.InjectTraceHeaders(options.Context, options.Header)
+
+	return broker.RetryPublish(options, retryCheck, func(ctx context.Context) error {
+		return b.snsClient.ProduceToTopic(ctx, bs, options)
+	})
+}
+
+// PublishBatch sends the messages of each topic in batches of 10 and retries only the messages that failed
+func (b *snssqs) PublishBatch(entries []broker.BatchEntry) error {
+	return broker.WrapPublishBatch(b.options, entries, b.publishBatch)
+}
+
+func (b *snssqs) publishBatch(entries []broker.BatchEntry) error {
+	errs := make([]error, len(entries))
+	bss := make([][]byte, len(entries))
+	options := make([]broker.PublishOptions, len(entries))
+
+	topics := []string{}
+	batches := map[string][]int{}
+
+	for i, entry := range entries {
+		// delayed messages cannot go in an sns batch
+		if broker.DeliveryDelay(entry.Options) > 0 {
+			errs[i] = b.publish(entry.Data, entry.Options)
+			continue
+		}
+
+		bs, err := datautils.Stringify(entry.Data)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		bss[i] = bs
+		options[i] = entry.Options
+		options[i].Header = broker.InjectTraceHeaders(entry.Options.Context, entry.Options.Header)
+
+		topic := entry.Options.Topic
+		if _, ok := batches[topic]; !ok {
+			topics = append(topics, topic)
+		}
+
+		batches[topic] = append(batches[topic], i)
+	}
+
+	for _, topic := range topics {
+		indices := batches[topic]
+
+		for start := 0; start < len(indices); start += maxBatchSize {
+			b.produceBatch(indices[start:min(start+maxBatchSize, len(indices))], bss, options, errs)
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return &broker.BatchError{Errors: errs}
+		}
 	}
 
 	return nil
 }
 
-func (b *snssqs) Subscribe(callback func([]byte) error, options broker.SubscribeOptions) broker.Subscriber {
-	sub := &subscriber{
-		options: options,
-		id:      uuid.New().String(),
-		handler: callback,
-		exit:    make(chan struct{}),
+func (b *snssqs) produceBatch(indices []int, bss [][]byte, options []broker.PublishOptions, errs []error) {
+	pending := indices
+
+	err := broker.RetryPublish(options[indices[0]], retryCheck, func(ctx context.Context) error {
+		batch := make([][]byte, len(pending))
+		batchOptions := make([]broker.PublishOptions, len(pending))
+
+		for j, i := range pending {
+			batch[j] = bss[i]
+			batchOptions[j] = options[i]
+		}
+
+		failed := []int{}
+
+		var first error
+
+		for j, err := range b.snsClient.ProduceBatchToTopic(ctx, batch, batchOptions) {
+			errs[pending[j]] = err
+			if err != nil {
+				failed = append(failed, pending[j])
+				if first == nil {
+					first = err
+				}
+			}
+		}
+
+		pending = failed
+
+		return first
+	})
+
+	// the retry policy may give up before the messages were sent again
+	if err != nil {
+		for _, i := range pending {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
 	}
+}
 
-	go func() {
-		for {
+func (b *snssqs) delay(data interface{}, options broker.PublishOptions, delay time.Duration) error {
+	bs, err := datautils.Stringify(data)
+	if err != nil {
+		return err
+	}
+
+	options.Header = broker.InjectTraceHeaders(options.Context, options.Header)
+
+	seconds := int32(math.Ceil(delay.Seconds()))
+
+	return broker.RetryPublish(options, retryCheck, func(ctx context.Context) error {
+		return b.delayClient.SendToGroup(ctx, bs, options, seconds)
+	})
+}
+
+// forward moves messages from the delay queue to their sns topics once sqs makes them visible
+func (b *snssqs) forward(ctx context.Context) {
+	defer b.wg.Done()
+
+	for {
+		msgs, err := b.delayClient.ReceiveFromGroup(ctx, delayQueueMaxMessages)
+
+		// messages received as the broker closes become visible again once their visibility times out
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			log.Errorf("failed to receive from the delay queue: %v", err)
+		}
+
+		// back off when the queue is empty or failing so that we don't spin
+		if len(msgs) == 0 {
 			select {
-			case <-sub.exit:
+			case <-ctx.Done():
 				return
-			default:
-				b.sqsClient.ConsumeFromGroup(sub)
-				time.Sleep(time.Second)
+			case <-time.After(receiveBackoff):
+			}
+			continue
+		}
+
+		handles := []string{}
+
+		for _, rm := range msgs {
+			options := broker.NewPublishOptions(
+				broker.PublishWithTopic(rm.Topic),
+				broker.PublishWithKey(rm.GroupId),
+				broker.PublishWithDeduplicationId(rm.DeduplicationId),
+			)
+
+			for k, v := range rm.Header {
+				options.Header[k] = v
+			}
+
+			// a message that fails to forward becomes visible again and is retried
+			if err := b.snsClient.ProduceToTopic(ctx, rm.Body, options); err != nil {
+				log.Errorf("failed to forward delayed message %s to %s: %v", rm.Id, rm.Topic, err)
+				continue
+			}
+
+			handles = append(handles, rm.ReceiptHandle)
+		}
+
+		if len(handles) == 0 {
+			continue
+		}
+
+		for i, err := range b.delayClient.DeleteFromGroup(ctx, handles) {
+			if err != nil {
+				log.Errorf("failed to delete forwarded message %s from the delay queue: %v", handles[i], err)
 			}
 		}
+	}
+}
+
+func (b *snssqs) Subscribe(callback func(*broker.Message) error, options broker.SubscribeOptions) broker.Subscriber {
+	handler := broker.WrapHandler(b.options, callback)
+
+	sub := &subscriber{
+		options:   options,
+		id:        uuid.New().String(),
+		handler:   handler,
+		snsClient: b.snsClient,
+		exit:      make(chan struct{}),
+	}
+
+	newConsumer(sub, b.sqsClient, b.visibilityTimeout(options)).run()
+
+	b.mtx.Lock()
+	b.subscribers[sub.id] = sub
+	b.mtx.Unlock()
+
+	go func() {
+		<-sub.exit
+
+		b.mtx.Lock()
+		defer b.mtx.Unlock()
+
+		delete(b.subscribers, sub.id)
 	}()
 
 	return sub
 }
 
+// Inspect reports sqs's approximate counts for the queue, which all of the subscribers share
+func (b *snssqs) Inspect(ctx context.Context) ([]broker.TopicInfo, error) {
+	b.mtx.RLock()
+
+	subs := []*subscriber{}
+
+	for _, sub := range b.subscribers {
+		subs = append(subs, sub)
+	}
+
+	b.mtx.RUnlock()
+
+	topics := []broker.TopicInfo{}
+
+	if len(subs) == 0 || b.sqsClient == nil {
+		return topics, nil
+	}
+
+	lag, inFlight, err := b.sqsClient.CountInGroup(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := map[string]map[string]*broker.GroupInfo{}
+
+	for _, sub := range subs {
+		group := sub.options.Group
+		if len(group) == 0 && b.options.SubscribeOptions != nil {
+			group = b.options.SubscribeOptions.Group
+		}
+
+		if _, ok := groups[sub.options.Topic]; !ok {
+			groups[sub.options.Topic] = map[string]*broker.GroupInfo{}
+		}
+
+		info, ok := groups[sub.options.Topic][group]
+		if !ok {
+			info = &broker.GroupInfo{
+				Group:       group,
+				Subscribers: []string{},
+				InFlight:    inFlight,
+				Lag:         lag,
+				Approximate: true,
+			}
+			groups[sub.options.Topic][group] = info
+		}
+
+		info.Subscribers = append(info.Subscribers, sub.id)
+	}
+
+	for topic, infos := range groups {
+		info := broker.TopicInfo{
+			Topic:  topic,
+			Groups: []broker.GroupInfo{},
+		}
+
+		for _, group := range infos {
+			slices.Sort(group.Subscribers)
+			info.Groups = append(info.Groups, *group)
+		}
+
+		slices.SortFunc(info.Groups, func(a, b broker.GroupInfo) int {
+			return strings.Compare(a.Group, b.Group)
+		})
+
+		topics = append(topics, info)
+	}
+
+	slices.SortFunc(topics, func(a, b broker.TopicInfo) int {
+		return strings.Compare(a.Topic, b.Topic)
+	})
+
+	return topics, nil
+}
+
+// Close stops forwarding from the delay queue and polling the scheduler store
+func (b *snssqs) Close() error {
+	b.cancel()
+
+	b.wg.Wait()
+
+	if b.scheduler != nil {
+		b.scheduler.Stop()
+	}
+
+	return nil
+}
+
 func (b *snssqs) String() string {
 	return "snssqs"
 }
 
+func (b *snssqs) visibilityTimeout(options broker.SubscribeOptions) int32 {
+	if timeout, ok := GetVisibilityTimeoutFromContext(options.Context); ok {
+		return timeout
+	}
+
+	if b.options.SubscribeOptions != nil {
+		if timeout, ok := GetVisibilityTimeoutFromContext(b.options.SubscribeOptions.Context); ok {
+			return timeout
+		}
+	}
+
+	return defaultVisibilityTimeout
+}
+
 func (b *snssqs) configure() error {
 	if len(b.options.Nodes) == 0 {
 		return fmt.Errorf("broker addresses are required")
@@ -89,7 +391,11 @@ func (b *snssqs) configure() error {
 		b.sqsClient = sqs
 	}
 
-	if b.snsClient != nil || b.sqsClient != nil {
+	if delay, ok := GetDelayClientFromContext(b.options.Context); ok {
+		b.delayClient = delay
+	}
+
+	if b.snsClient != nil || b.sqsClient != nil || b.delayClient != nil {
 		return nil
 	}
 
@@ -101,7 +407,10 @@ func (b *snssqs) configure() error {
 		return err
 	}
 
-	if b.options.PublishOptions != nil {
+	delayQueue, _ := GetDelayQueueFromContext(b.options.Context)
+
+	// dead-lettering publishes to sns from the subscriber and so does forwarding from the delay queue
+	if b.options.PublishOptions != nil || len(delayQueue) > 0 || (b.options.SubscribeOptions != nil && len(b.options.SubscribeOptions.DeadLetterTopic) > 0) {
 		b.snsClient = &snsClient{sns.NewFromConfig(
 			cfg,
 			func(o *sns.Options) {
@@ -140,19 +449,61 @@ func (b *snssqs) configure() error {
 		b.sqsClient = &sqsClient{client, url.QueueUrl, visibilityTimeout, waitTimeSeconds}
 	}
 
+	if len(delayQueue) > 0 {
+		client := sqs.NewFromConfig(
+			cfg,
+			func(o *sqs.Options) {
+				o.EndpointResolverV2 = &sqsResolver{b.options.Nodes}
+			},
+		)
+
+		url, err := client.GetQueueUrl(context.Background(), &sqs.GetQueueUrlInput{
+			QueueName: aws.String(delayQueue),
+		})
+		if err != nil {
+			return err
+		}
+
+		b.delayClient = &sqsClient{client, url.QueueUrl, defaultVisibilityTimeout, defaultWaitSeconds}
+	}
+
 	return nil
 }
 
+// retryCheck retries the throttling, server and connection errors that the aws sdk retries itself
+func retryCheck(ctx context.Context, retryCount int, err error) (bool, error) {
+	if retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary {
+		return true, nil
+	}
+
+	return broker.IsTransient(err), nil
+}
+
 func NewBroker(opts ...broker.BrokerOption) broker.Broker {
 	options := broker.NewBrokerOptions(opts...)
 
 	b := &snssqs{
-		options: options,
+		options:     options,
+		subscribers: map[string]*subscriber{},
+		mtx:         sync.RWMutex{},
 	}
 
 	if err := b.configure(); err != nil {
 		log.Fatal(err)
 	}
 
+	if options.SchedulerStore != nil {
+		b.scheduler = broker.NewScheduler(options.SchedulerStore, b.publish)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	b.cancel = cancel
+
+	if b.delayClient != nil && b.snsClient != nil {
+		b.wg.Add(1)
+		go b.forward(ctx)
+	}
+
 	return b
 }
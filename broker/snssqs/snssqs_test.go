@@ -0,0 +1,717 @@
+package snssqs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/broker"
+	memorystore "github.com/w-h-a/pkg/store/memory"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+)
+
+type visibilityChange struct {
+	receiptHandle string
+	timeout       int32
+}
+
+type mockSnsClient struct {
+	produced []broker.PublishOptions
+	batches  [][]string
+	flaky    bool
+	mtx      sync.Mutex
+}
+
+func (c *mockSnsClient) ProduceToTopic(ctx context.Context, bs []byte, options broker.PublishOptions) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.produced = append(c.produced, options)
+
+	return nil
+}
+
+// ProduceBatchToTopic fails messages with a "fail" body and messages with a "flaky" body the first time
+func (c *mockSnsClient) ProduceBatchToTopic(ctx context.Context, bss [][]byte, options []broker.PublishOptions) []error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	errs := make([]error, len(bss))
+
+	batch := []string{}
+
+	for i, bs := range bss {
+		batch = append(batch, options[i].Topic+":"+string(bs))
+
+		switch string(bs) {
+		case "fail":
+			errs[i] = errors.New("boom")
+		case "flaky":
+			if !c.flaky {
+				c.flaky = true
+				errs[i] = errors.New("throttled")
+			}
+		}
+	}
+
+	c.batches = append(c.batches, batch)
+
+	return errs
+}
+
+type mockSqsClient struct {
+	queue       []*ReceivedMessage
+	delays      []int32
+	deletes     [][]string
+	visibility  []visibilityChange
+	maxReceived int32
+	waiting     int64
+	notVisible  int64
+	gate        chan struct{}
+	receives    int
+	mtx         sync.Mutex
+}
+
+func (c *mockSqsClient) SendToGroup(ctx context.Context, bs []byte, options broker.PublishOptions, delaySeconds int32) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.delays = append(c.delays, delaySeconds)
+
+	c.queue = append(c.queue, &ReceivedMessage{
+		ReceiptHandle:   fmt.Sprintf("handle-%d", len(c.delays)),
+		Id:              fmt.Sprintf("id-%d", len(c.delays)),
+		Topic:           options.Topic,
+		Header:          options.Header,
+		Body:            bs,
+		Timestamp:       time.Now(),
+		GroupId:         options.Key,
+		DeduplicationId: options.DeduplicationId,
+	})
+
+	return nil
+}
+
+// ReceiveFromGroup waits for the gate when there is one, like a long poll does
+func (c *mockSqsClient) ReceiveFromGroup(ctx context.Context, maxMessages int32) ([]*ReceivedMessage, error) {
+	c.mtx.Lock()
+	c.receives++
+	c.mtx.Unlock()
+
+	if c.gate != nil {
+		select {
+		case <-c.gate:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.maxReceived = max(c.maxReceived, maxMessages)
+
+	n := min(int(maxMessages), len(c.queue))
+
+	msgs := c.queue[:n]
+
+	c.queue = c.queue[n:]
+
+	return msgs, nil
+}
+
+func (c *mockSqsClient) DeleteFromGroup(ctx context.Context, receiptHandles []string) []error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.deletes = append(c.deletes, receiptHandles)
+
+	return make([]error, len(receiptHandles))
+}
+
+func (c *mockSqsClient) ChangeVisibility(ctx context.Context, receiptHandle string, timeout int32) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.visibility = append(c.visibility, visibilityChange{receiptHandle, timeout})
+
+	return nil
+}
+
+func (c *mockSqsClient) CountInGroup(ctx context.Context) (int64, int64, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.waiting, c.notVisible, nil
+}
+
+func (c *mockSqsClient) deleted() []string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	handles := []string{}
+
+	for _, batch := range c.deletes {
+		handles = append(handles, batch...)
+	}
+
+	return handles
+}
+
+func newMockSqsClient(n int) *mockSqsClient {
+	c := &mockSqsClient{}
+
+	for i := 0; i < n; i++ {
+		c.queue = append(c.queue, &ReceivedMessage{
+			ReceiptHandle: fmt.Sprintf("handle-%d", i),
+			Id:            fmt.Sprintf("id-%d", i),
+			Header:        map[string]string{"foo": "bar"},
+			Body:          []byte("hello"),
+			Timestamp:     time.Now(),
+			Attempts:      1,
+		})
+	}
+
+	return c
+}
+
+func TestConsumer(t *testing.T) {
+	log.SetLogger(memory.NewLog(memory.LogWithBuffer(memoryutils.NewBuffer())))
+
+	t.Run("workers handle messages concurrently and acks are batched", func(t *testing.T) {
+		client := newMockSqsClient(4)
+
+		b := NewBroker(
+			broker.BrokerWithNodes("http://localhost:4566"),
+			SnsSqsWithSqsClient(client),
+		)
+
+		wg := sync.WaitGroup{}
+		wg.Add(4)
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			// every handler blocks until all four are running at once
+			wg.Done()
+			wg.Wait()
+			return nil
+		}, broker.NewSubscribeOptions(
+			broker.SubscribeWithGroup("test"),
+			SqsWithWorkers(4),
+			SqsWithMaxMessages(4),
+		))
+		defer sub.Unsubscribe(context.Background())
+
+		require.Eventually(t, func() bool {
+			return len(client.deleted()) == 4
+		}, 2*time.Second, 10*time.Millisecond)
+
+		client.mtx.Lock()
+		defer client.mtx.Unlock()
+
+		require.Equal(t, int32(4), client.maxReceived)
+		require.Less(t, len(client.deletes), 4)
+	})
+
+	t.Run("messages of a fifo group are handled one at a time and in order", func(t *testing.T) {
+		client := newMockSqsClient(6)
+
+		for i, msg := range client.queue {
+			msg.GroupId = fmt.Sprintf("group-%d", i%2)
+			msg.Header = map[string]string{"group": msg.GroupId}
+		}
+
+		b := NewBroker(
+			broker.BrokerWithNodes("http://localhost:4566"),
+			SnsSqsWithSqsClient(client),
+		)
+
+		order := map[string][]string{}
+		running := map[string]int{}
+		overlapped := false
+		mtx := sync.Mutex{}
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			group := msg.Header["group"]
+
+			mtx.Lock()
+			running[group]++
+			overlapped = overlapped || running[group] > 1
+			order[group] = append(order[group], msg.Id)
+			mtx.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mtx.Lock()
+			running[group]--
+			mtx.Unlock()
+
+			return nil
+		}, broker.NewSubscribeOptions(
+			broker.SubscribeWithGroup("test.fifo"),
+			SqsWithWorkers(6),
+			SqsWithMaxMessages(6),
+		))
+		defer sub.Unsubscribe(context.Background())
+
+		require.Eventually(t, func() bool {
+			return len(client.deleted()) == 6
+		}, 2*time.Second, 10*time.Millisecond)
+
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		require.False(t, overlapped)
+		require.Equal(t, []string{"id-0", "id-2", "id-4"}, order["group-0"])
+		require.Equal(t, []string{"id-1", "id-3", "id-5"}, order["group-1"])
+	})
+
+	t.Run("a failure releases the rest of its fifo group so that it is redelivered in order", func(t *testing.T) {
+		client := newMockSqsClient(6)
+
+		for i, msg := range client.queue {
+			msg.GroupId = fmt.Sprintf("group-%d", i%2)
+			msg.Header = map[string]string{"group": msg.GroupId}
+		}
+
+		b := NewBroker(
+			broker.BrokerWithNodes("http://localhost:4566"),
+			SnsSqsWithSqsClient(client),
+		)
+
+		handled := []string{}
+		mtx := sync.Mutex{}
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			time.Sleep(20 * time.Millisecond)
+
+			mtx.Lock()
+			handled = append(handled, msg.Id)
+			mtx.Unlock()
+
+			if msg.Id == "id-2" {
+				return errors.New("boom")
+			}
+
+			return nil
+		}, broker.NewSubscribeOptions(
+			broker.SubscribeWithGroup("test.fifo"),
+			SqsWithWorkers(6),
+			SqsWithMaxMessages(6),
+		))
+		defer sub.Unsubscribe(context.Background())
+
+		require.Eventually(t, func() bool {
+			client.mtx.Lock()
+			defer client.mtx.Unlock()
+			return len(client.visibility) > 0
+		}, 2*time.Second, 10*time.Millisecond)
+
+		require.Eventually(t, func() bool {
+			return len(client.deleted()) == 4
+		}, 2*time.Second, 10*time.Millisecond)
+
+		require.ElementsMatch(t, []string{"handle-0", "handle-1", "handle-3", "handle-5"}, client.deleted())
+
+		client.mtx.Lock()
+		require.Equal(t, []visibilityChange{{"handle-4", 0}}, client.visibility)
+		client.mtx.Unlock()
+
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		require.NotContains(t, handled, "id-4")
+	})
+
+	t.Run("visibility is extended while the handler runs", func(t *testing.T) {
+		client := newMockSqsClient(1)
+
+		b := NewBroker(
+			broker.BrokerWithNodes("http://localhost:4566"),
+			SnsSqsWithSqsClient(client),
+		)
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			time.Sleep(1200 * time.Millisecond)
+			return msg.Nack(30 * time.Second)
+		}, broker.NewSubscribeOptions(
+			broker.SubscribeWithGroup("test"),
+			SqsWithVisibilityTimeout(1),
+		))
+		defer sub.Unsubscribe(context.Background())
+
+		require.Eventually(t, func() bool {
+			client.mtx.Lock()
+			defer client.mtx.Unlock()
+			return len(client.visibility) > 0 && client.visibility[len(client.visibility)-1].timeout == 30
+		}, 3*time.Second, 10*time.Millisecond)
+
+		client.mtx.Lock()
+		defer client.mtx.Unlock()
+
+		require.Equal(t, visibilityChange{"handle-0", 1}, client.visibility[0])
+		require.Empty(t, client.deletes)
+	})
+
+	t.Run("visibility is extended while a message waits behind its fifo group", func(t *testing.T) {
+		client := newMockSqsClient(2)
+
+		for _, msg := range client.queue {
+			msg.GroupId = "group"
+		}
+
+		b := NewBroker(
+			broker.BrokerWithNodes("http://localhost:4566"),
+			SnsSqsWithSqsClient(client),
+		)
+
+		extended := make(chan bool, 1)
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			if msg.Id != "id-0" {
+				return nil
+			}
+
+			// the second message is queued behind this one the whole time
+			deadline := time.Now().Add(2 * time.Second)
+
+			for time.Now().Before(deadline) {
+				client.mtx.Lock()
+				for _, change := range client.visibility {
+					if change == (visibilityChange{"handle-1", 1}) {
+						client.mtx.Unlock()
+						extended <- true
+						return nil
+					}
+				}
+				client.mtx.Unlock()
+
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			extended <- false
+
+			return nil
+		}, broker.NewSubscribeOptions(
+			broker.SubscribeWithGroup("test.fifo"),
+			SqsWithWorkers(2),
+			SqsWithMaxMessages(2),
+			SqsWithVisibilityTimeout(1),
+		))
+		defer sub.Unsubscribe(context.Background())
+
+		require.True(t, <-extended)
+
+		require.Eventually(t, func() bool {
+			return len(client.deleted()) == 2
+		}, 2*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("messages received as the subscriber leaves are released instead of handled", func(t *testing.T) {
+		client := newMockSqsClient(2)
+		client.gate = make(chan struct{})
+
+		b := NewBroker(
+			broker.BrokerWithNodes("http://localhost:4566"),
+			SnsSqsWithSqsClient(client),
+		)
+
+		handled := atomic.Int64{}
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			handled.Add(1)
+			return nil
+		}, broker.NewSubscribeOptions(
+			broker.SubscribeWithGroup("test"),
+			SqsWithWorkers(2),
+			SqsWithMaxMessages(2),
+		))
+
+		require.Eventually(t, func() bool {
+			client.mtx.Lock()
+			defer client.mtx.Unlock()
+			return client.receives > 0
+		}, time.Second, 10*time.Millisecond)
+
+		// the receive is still in flight when unsubscribe starts
+		time.AfterFunc(50*time.Millisecond, func() {
+			close(client.gate)
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		require.NoError(t, sub.Unsubscribe(ctx))
+
+		require.Zero(t, handled.Load())
+		require.Empty(t, client.deleted())
+
+		client.mtx.Lock()
+		defer client.mtx.Unlock()
+
+		require.ElementsMatch(t, []visibilityChange{{"handle-0", 0}, {"handle-1", 0}}, client.visibility)
+	})
+
+	t.Run("nack delays are capped at the visibility maximum", func(t *testing.T) {
+		client := newMockSqsClient(1)
+
+		b := NewBroker(
+			broker.BrokerWithNodes("http://localhost:4566"),
+			SnsSqsWithSqsClient(client),
+		)
+
+		sub := b.Subscribe(func(msg *broker.Message) error {
+			return msg.Nack(48 * time.Hour)
+		}, broker.NewSubscribeOptions(
+			broker.SubscribeWithGroup("test"),
+		))
+		defer sub.Unsubscribe(context.Background())
+
+		require.Eventually(t, func() bool {
+			client.mtx.Lock()
+			defer client.mtx.Unlock()
+			return len(client.visibility) == 1
+		}, 2*time.Second, 10*time.Millisecond)
+
+		client.mtx.Lock()
+		defer client.mtx.Unlock()
+
+		require.Equal(t, visibilityChange{"handle-0", 43200}, client.visibility[0])
+	})
+}
+
+func TestDelay(t *testing.T) {
+	t.Run("short delays wait in the delay queue before going to sns", func(t *testing.T) {
+		sns := &mockSnsClient{}
+		delay := &mockSqsClient{}
+
+		b := NewBroker(
+			broker.BrokerWithNodes("http://localhost:4566"),
+			SnsSqsWithSnsClient(sns),
+			SnsSqsWithDelayClient(delay),
+		)
+
+		err := b.Publish("hello", broker.NewPublishOptions(
+			broker.PublishWithTopic("orders.fifo"),
+			broker.PublishWithKey("order-1"),
+			broker.PublishWithHeader("foo", "bar"),
+			broker.PublishWithDelay(1500*time.Millisecond),
+		))
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			return len(delay.deleted()) == 1
+		}, 2*time.Second, 10*time.Millisecond)
+
+		delay.mtx.Lock()
+		require.Equal(t, []int32{2}, delay.delays)
+		delay.mtx.Unlock()
+
+		sns.mtx.Lock()
+		defer sns.mtx.Unlock()
+
+		require.Len(t, sns.produced, 1)
+		require.Equal(t, "orders.fifo", sns.produced[0].Topic)
+		require.Equal(t, "order-1", sns.produced[0].Key)
+		require.Equal(t, "bar", sns.produced[0].Header["foo"])
+	})
+
+	t.Run("longer delays need a scheduler store", func(t *testing.T) {
+		b := NewBroker(
+			broker.BrokerWithNodes("http://localhost:4566"),
+			SnsSqsWithSnsClient(&mockSnsClient{}),
+			SnsSqsWithDelayClient(&mockSqsClient{}),
+		)
+
+		err := b.Publish("hello", broker.NewPublishOptions(
+			broker.PublishWithTopic("orders"),
+			broker.PublishWithDeliverAt(time.Now().Add(time.Hour)),
+		))
+		require.ErrorIs(t, err, broker.ErrSchedulerRequired)
+	})
+
+	t.Run("close stops forwarding from the delay queue", func(t *testing.T) {
+		delay := &mockSqsClient{gate: make(chan struct{})}
+
+		b := NewBroker(
+			broker.BrokerWithNodes("http://localhost:4566"),
+			SnsSqsWithSnsClient(&mockSnsClient{}),
+			SnsSqsWithDelayClient(delay),
+			broker.BrokerWithSchedulerStore(memorystore.NewStore()),
+		)
+
+		require.Eventually(t, func() bool {
+			delay.mtx.Lock()
+			defer delay.mtx.Unlock()
+			return delay.receives == 1
+		}, time.Second, 10*time.Millisecond)
+
+		// the long poll in flight is cancelled rather than waited out
+		require.NoError(t, b.(broker.Closer).Close())
+
+		close(delay.gate)
+
+		time.Sleep(50 * time.Millisecond)
+
+		delay.mtx.Lock()
+		defer delay.mtx.Unlock()
+
+		require.Equal(t, 1, delay.receives)
+	})
+}
+
+func TestPublishBatch(t *testing.T) {
+	sns := &mockSnsClient{}
+
+	b := NewBroker(
+		broker.BrokerWithNodes("http://localhost:4566"),
+		SnsSqsWithSnsClient(sns),
+	)
+
+	entries := []broker.BatchEntry{}
+
+	for i := 0; i < 12; i++ {
+		body := fmt.Sprintf("%d", i)
+
+		switch i {
+		case 3:
+			body = "fail"
+		case 5:
+			body = "flaky"
+		}
+
+		entries = append(entries, broker.BatchEntry{
+			Data: body,
+			Options: broker.NewPublishOptions(
+				broker.PublishWithTopic("orders"),
+				broker.PublishWithRetryCount(1),
+				broker.PublishWithRetryCheck(func(ctx context.Context, retryCount int, err error) (bool, error) {
+					return true, nil
+				}),
+				broker.PublishWithBackoff(func(ctx context.Context, attempts int) (time.Duration, error) {
+					return 0, nil
+				}),
+			),
+		})
+	}
+
+	entries = append(entries, broker.BatchEntry{
+		Data:    "hello",
+		Options: broker.NewPublishOptions(broker.PublishWithTopic("payments")),
+	})
+
+	err := broker.PublishBatch(b, entries)
+
+	batchErr := &broker.BatchError{}
+	require.ErrorAs(t, err, &batchErr)
+	require.Len(t, batchErr.Errors, len(entries))
+
+	for i, err := range batchErr.Errors {
+		if i == 3 {
+			require.EqualError(t, err, "boom")
+			continue
+		}
+		require.NoError(t, err)
+	}
+
+	sns.mtx.Lock()
+	defer sns.mtx.Unlock()
+
+	// only the failed messages of a batch are sent again and topics are batched separately
+	require.Len(t, sns.batches, 4)
+	require.Len(t, sns.batches[0], 10)
+	require.Equal(t, []string{"orders:fail", "orders:flaky"}, sns.batches[1])
+	require.Equal(t, []string{"orders:10", "orders:11"}, sns.batches[2])
+	require.Equal(t, []string{"payments:hello"}, sns.batches[3])
+}
+
+func TestRetryCheck(t *testing.T) {
+	tests := []struct {
+		err   error
+		retry bool
+	}{
+		{&smithy.GenericAPIError{Code: "ThrottlingException"}, true},
+		{&smithy.GenericAPIError{Code: "RequestTimeout"}, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNRESET}, true},
+		{&smithy.GenericAPIError{Code: "NotFound"}, false},
+		{errors.New("boom"), false},
+	}
+
+	for _, test := range tests {
+		retry, err := retryCheck(context.Background(), 0, test.err)
+		require.NoError(t, err)
+		require.Equal(t, test.retry, retry, test.err.Error())
+	}
+}
+
+func TestRequest(t *testing.T) {
+	client := newMockSqsClient(1)
+
+	b := NewBroker(
+		broker.BrokerWithNodes("http://localhost:4566"),
+		SnsSqsWithSqsClient(client),
+	)
+
+	// the reply subscriber would take the messages of the shared queue and drop them
+	_, err := broker.Request(context.Background(), b, "hello", broker.NewPublishOptions(broker.PublishWithTopic("greeter")))
+	require.ErrorIs(t, err, broker.ErrRequestUnsupported)
+
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+
+	require.Zero(t, client.receives)
+	require.Len(t, client.queue, 1)
+}
+
+func TestInspect(t *testing.T) {
+	client := &mockSqsClient{waiting: 42, notVisible: 3}
+
+	b := NewBroker(
+		broker.BrokerWithNodes("http://localhost:4566"),
+		SnsSqsWithSqsClient(client),
+	)
+
+	first := b.Subscribe(func(msg *broker.Message) error {
+		return nil
+	}, broker.NewSubscribeOptions(
+		broker.SubscribeWithTopic("orders"),
+		broker.SubscribeWithGroup("billing"),
+	))
+	defer first.Unsubscribe(context.Background())
+
+	second := b.Subscribe(func(msg *broker.Message) error {
+		return nil
+	}, broker.NewSubscribeOptions(
+		broker.SubscribeWithTopic("orders"),
+		broker.SubscribeWithGroup("billing"),
+	))
+
+	topics, err := b.(broker.Inspector).Inspect(context.Background())
+	require.NoError(t, err)
+	require.Len(t, topics, 1)
+	require.Equal(t, "orders", topics[0].Topic)
+	require.Len(t, topics[0].Groups, 1)
+
+	group := topics[0].Groups[0]
+	require.Equal(t, "billing", group.Group)
+	require.ElementsMatch(t, []string{first.Id(), second.Id()}, group.Subscribers)
+	require.Equal(t, int64(42), group.Lag)
+	require.Equal(t, int64(3), group.InFlight)
+	require.True(t, group.Approximate)
+
+	second.Unsubscribe(context.Background())
+
+	require.Eventually(t, func() bool {
+		topics, err := b.(broker.Inspector).Inspect(context.Background())
+		return err == nil && len(topics) == 1 && len(topics[0].Groups[0].Subscribers) == 1
+	}, time.Second, 10*time.Millisecond)
+}
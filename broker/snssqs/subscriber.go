@@ -1,12 +1,20 @@
 package snssqs
 
-import "github.com/w-h-a/pkg/broker"
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/w-h-a/pkg/broker"
+)
 
 type subscriber struct {
-	options broker.SubscribeOptions
-	id      string
-	handler func([]byte) error
-	exit    chan struct{}
+	options   broker.SubscribeOptions
+	id        string
+	handler   broker.HandlerFunc
+	snsClient SnsClient
+	wg        sync.WaitGroup
+	exit      chan struct{}
 }
 
 func (s *subscriber) Options() broker.SubscribeOptions {
@@ -17,20 +25,35 @@ func (s *subscriber) Id() string {
 	return s.id
 }
 
-func (s *subscriber) Handler(b []byte) error {
-	return s.handler(b)
+func (s *subscriber) Handler(msg *broker.Message) error {
+	// sqs redelivers the message once the visibility timeout expires
+	return broker.HandleMessage(s.options, msg, s.handler, nil, s.deadLetter)
 }
 
-func (s *subscriber) Unsubscribe() error {
+func (s *subscriber) Unsubscribe(ctx context.Context) error {
 	select {
 	case <-s.exit:
-		return nil
 	default:
 		close(s.exit)
-		return nil
 	}
+
+	return broker.WaitForGroup(ctx, &s.wg)
 }
 
 func (s *subscriber) String() string {
 	return "snssqs"
 }
+
+func (s *subscriber) deadLetter(topic string, msg *broker.Message, header map[string]string) error {
+	if s.snsClient == nil {
+		return errors.New("an sns client is required to dead-letter messages")
+	}
+
+	options := broker.PublishOptions{
+		Topic:   topic,
+		Header:  header,
+		Context: context.Background(),
+	}
+
+	return s.snsClient.ProduceToTopic(options.Context, msg.Body, options)
+}
@@ -1,9 +1,12 @@
 package broker
 
+import "context"
+
 type Subscriber interface {
 	Options() SubscribeOptions
 	Id() string
-	Handler(b []byte) error
-	Unsubscribe() error
+	Handler(msg *Message) error
+	// Unsubscribe stops new deliveries and waits until the handlers in flight have finished or ctx is done
+	Unsubscribe(ctx context.Context) error
 	String() string
 }
@@ -0,0 +1,595 @@
+package broker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/tracev2"
+	"github.com/w-h-a/pkg/utils/metadatautils"
+	"github.com/w-h-a/pkg/utils/retryutils"
+)
+
+// RetryFunc asks the broker to redeliver a message whose handler failed
+type RetryFunc func(msg *Message) error
+
+// RetryCheckFunc decides whether a failed publish is tried again
+type RetryCheckFunc func(ctx context.Context, retryCount int, err error) (bool, error)
+
+// DeadLetterFunc sends the message with the dead-letter header to the dead-letter topic
+type DeadLetterFunc func(topic string, msg *Message, header map[string]string) error
+
+// HandleMessage runs handler and settles msg: success acks it, failures go to retry until MaxDeliveries is reached
+// and the message is then dead-lettered. Brokers that redeliver unacked messages by themselves pass a nil retry.
+// A message that fails with ErrMessageInFlight is put off and never dead-lettered.
+func HandleMessage(options SubscribeOptions, msg *Message, handler HandlerFunc, retry RetryFunc, deadLetter DeadLetterFunc) error {
+	msg.Group = options.Group
+
+	limit := options.MaxDeliveries
+
+	// the message outlived its deliveries without being dead-lettered (e.g., the consumer died)
+	if limit > 0 && msg.Attempts > limit {
+		return sendToDeadLetter(options, msg, fmt.Sprintf("message exceeded %d deliveries", limit), deadLetter)
+	}
+
+	err := handler(msg)
+	if err == nil {
+		if !msg.Settled() {
+			return msg.Ack()
+		}
+		return nil
+	}
+
+	if msg.Settled() {
+		return err
+	}
+
+	// the original delivery may still fail, so a duplicate waits for it instead of using up a delivery
+	if errors.Is(err, ErrMessageInFlight) {
+		if postponeErr := msg.postpone(inFlightDelay); postponeErr != nil {
+			log.Errorf("failed to put off message %s from group %s: %v", msg.Id, options.Group, postponeErr)
+		}
+		return err
+	}
+
+	if limit <= 0 || msg.Attempts < limit {
+		if retry != nil {
+			if retryErr := retry(msg); retryErr != nil {
+				log.Errorf("failed to nack message %s from group %s: %v", msg.Id, options.Group, retryErr)
+			}
+		}
+		return err
+	}
+
+	return sendToDeadLetter(options, msg, err.Error(), deadLetter)
+}
+
+// SubscriptionTopic is the topic a subscriber reads, which is its group for subscribers that predate topics
+func SubscriptionTopic(options SubscribeOptions) string {
+	if len(options.Topic) == 0 {
+		return options.Group
+	}
+
+	return options.Topic
+}
+
+// SubscriptionGroup is the consumer group of a subscriber. Subscribers without a group get one of their own
+// named after their id so that each gets its own copy of every message.
+func SubscriptionGroup(options SubscribeOptions, id string) string {
+	if len(options.Group) == 0 {
+		return id
+	}
+
+	return options.Group
+}
+
+// DeadLetterHeader copies the header of msg and adds why, where from, and by which group it was dead-lettered
+func DeadLetterHeader(msg *Message, reason string) map[string]string {
+	header := map[string]string{}
+
+	for k, v := range msg.Header {
+		header[k] = v
+	}
+
+	header[DeadLetterReasonHeader] = reason
+	header[DeadLetterSourceHeader] = msg.Topic
+
+	if len(msg.Group) > 0 {
+		header[DeadLetterGroupHeader] = msg.Group
+	}
+
+	return header
+}
+
+func sendToDeadLetter(options SubscribeOptions, msg *Message, reason string, deadLetter DeadLetterFunc) error {
+	if len(options.DeadLetterTopic) == 0 {
+		log.Errorf("dropping message %s from group %s after %d deliveries: %s", msg.Id, options.Group, msg.Attempts, reason)
+		return msg.Ack()
+	}
+
+	if err := deadLetter(options.DeadLetterTopic, msg, DeadLetterHeader(msg, reason)); err != nil {
+		return err
+	}
+
+	return msg.Ack()
+}
+
+// RetryPublish calls publish until it succeeds, the retry policy gives up, or the caller's context is done.
+// The caller's retry check comes first, then the broker's, which may be nil to retry transient network errors.
+func RetryPublish(options PublishOptions, retryCheck RetryCheckFunc, publish func(ctx context.Context) error) error {
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	backoff := options.Backoff
+	if backoff == nil {
+		backoff = defaultBackoff
+	}
+
+	if options.RetryCheck != nil {
+		retryCheck = options.RetryCheck
+	}
+
+	if retryCheck == nil {
+		retryCheck = defaultRetryCheck
+	}
+
+	var e error
+
+	// retry loop
+	for i := 0; i <= options.RetryCount; i++ {
+		duration, err := backoff(ctx, i)
+		if err != nil {
+			return err
+		}
+
+		if duration > 0 {
+			timer := time.NewTimer(duration)
+
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err = publish(ctx)
+		if err == nil {
+			return nil
+		}
+
+		shouldRetry, retryErr := retryCheck(ctx, i, err)
+		if retryErr != nil {
+			return retryErr
+		}
+
+		if !shouldRetry {
+			return err
+		}
+
+		e = err
+	}
+
+	return e
+}
+
+// IsTransient reports whether err is a timeout or a dropped connection that a later attempt may get past
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var temporary interface{ Temporary() bool }
+	if errors.As(err, &temporary) && temporary.Temporary() {
+		return true
+	}
+
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) && timeout.Timeout() {
+		return true
+	}
+
+	for _, target := range []error{syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.ECONNABORTED, syscall.EPIPE, io.EOF, io.ErrUnexpectedEOF} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	// errors from this repo's clients carry a status code
+	retry, _ := retryutils.RetryOnError(err)
+
+	return retry
+}
+
+// PublishBatch uses the broker's batch publish when it has one and publishes the entries one by one otherwise.
+// It returns a *BatchError when any of the entries failed.
+func PublishBatch(b Broker, entries []BatchEntry) error {
+	if bp, ok := b.(BatchPublisher); ok {
+		return bp.PublishBatch(entries)
+	}
+
+	errs := make([]error, len(entries))
+
+	failed := false
+
+	for i, entry := range entries {
+		if err := b.Publish(entry.Data, entry.Options); err != nil {
+			errs[i] = err
+			failed = true
+		}
+	}
+
+	if failed {
+		return &BatchError{Errors: errs}
+	}
+
+	return nil
+}
+
+// IsTopicPattern reports whether the topic has a * or > token
+func IsTopicPattern(topic string) bool {
+	for _, token := range strings.Split(topic, ".") {
+		if token == "*" || token == ">" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MatchTopic reports whether the topic matches the pattern, where * stands for one dot-separated token and a trailing > for one or more
+func MatchTopic(pattern, topic string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	topicTokens := strings.Split(topic, ".")
+
+	for i, token := range patternTokens {
+		if token == ">" && i == len(patternTokens)-1 {
+			return len(topicTokens) > i
+		}
+
+		if i >= len(topicTokens) {
+			return false
+		}
+
+		if token != "*" && token != topicTokens[i] {
+			return false
+		}
+	}
+
+	return len(patternTokens) == len(topicTokens)
+}
+
+// DeliveryDelay is how long the message should be held back, taking the later of the delay and the delivery time
+func DeliveryDelay(options PublishOptions) time.Duration {
+	delay := options.Delay
+
+	if !options.DeliverAt.IsZero() {
+		delay = max(delay, time.Until(options.DeliverAt))
+	}
+
+	return max(delay, 0)
+}
+
+// WaitFor checks done every few milliseconds until it reports true or ctx is done
+func WaitFor(ctx context.Context, done func() bool) error {
+	ticker := time.NewTicker(waitInterval)
+	defer ticker.Stop()
+
+	for {
+		if done() {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// WaitForGroup waits until everything tracked by wg is done or ctx is done
+func WaitForGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
+
+// InjectTraceHeaders copies the header and adds the w3c trace context found on ctx
+func InjectTraceHeaders(ctx context.Context, header map[string]string) map[string]string {
+	cp := map[string]string{}
+
+	for k, v := range header {
+		cp[k] = v
+	}
+
+	if ctx == nil {
+		return cp
+	}
+
+	for _, k := range []string{tracev2.TraceParentKey, tracev2.TraceStateKey} {
+		if _, ok := cp[k]; ok {
+			continue
+		}
+		if v, ok := metadatautils.GetContext(ctx, k); ok && len(v) > 0 {
+			cp[k] = v
+		}
+	}
+
+	return cp
+}
+
+// ExtractTraceHeaders attaches the w3c trace context found in the header to ctx
+func ExtractTraceHeaders(ctx context.Context, header map[string]string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	md := metadatautils.Metadata{}
+
+	for _, k := range []string{tracev2.TraceParentKey, tracev2.TraceStateKey} {
+		if v, ok := header[k]; ok && len(v) > 0 {
+			md[k] = v
+		}
+	}
+
+	if len(md) == 0 {
+		return ctx
+	}
+
+	return metadatautils.MergeContext(ctx, md, true)
+}
+
+// EncodeCloudEvent lays the event out as a message header and body in the given content mode
+func EncodeCloudEvent(event *CloudEvent, mode ContentMode) (map[string]string, []byte, error) {
+	if len(event.Id) == 0 || len(event.Source) == 0 || len(event.Type) == 0 {
+		return nil, nil, ErrInvalidCloudEvent
+	}
+
+	if mode == ContentModeBinary {
+		header := map[string]string{}
+
+		for k, v := range event.Extensions {
+			header[CloudEventsHeaderPrefix+strings.ToLower(k)] = v
+		}
+
+		header[CloudEventsHeaderPrefix+"specversion"] = CloudEventsSpecVersion
+		header[CloudEventsHeaderPrefix+"id"] = event.Id
+		header[CloudEventsHeaderPrefix+"source"] = event.Source
+		header[CloudEventsHeaderPrefix+"type"] = event.Type
+
+		if len(event.Subject) > 0 {
+			header[CloudEventsHeaderPrefix+"subject"] = event.Subject
+		}
+
+		if !event.Time.IsZero() {
+			header[CloudEventsHeaderPrefix+"time"] = event.Time.UTC().Format(time.RFC3339Nano)
+		}
+
+		if len(event.DataContentType) > 0 {
+			header[ContentTypeHeader] = event.DataContentType
+		}
+
+		return header, event.Data, nil
+	}
+
+	structured := map[string]interface{}{}
+
+	for k, v := range event.Extensions {
+		structured[strings.ToLower(k)] = v
+	}
+
+	structured["specversion"] = CloudEventsSpecVersion
+	structured["id"] = event.Id
+	structured["source"] = event.Source
+	structured["type"] = event.Type
+
+	if len(event.Subject) > 0 {
+		structured["subject"] = event.Subject
+	}
+
+	if !event.Time.IsZero() {
+		structured["time"] = event.Time.UTC().Format(time.RFC3339Nano)
+	}
+
+	if len(event.DataContentType) > 0 {
+		structured["datacontenttype"] = event.DataContentType
+	}
+
+	// json data is embedded as is and anything else is carried as base64
+	if len(event.Data) > 0 {
+		if isJSONContentType(event.DataContentType) && json.Valid(event.Data) {
+			structured["data"] = json.RawMessage(event.Data)
+		} else {
+			structured["data_base64"] = base64.StdEncoding.EncodeToString(event.Data)
+		}
+	}
+
+	body, err := json.Marshal(structured)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return map[string]string{ContentTypeHeader: CloudEventsContentType}, body, nil
+}
+
+// DecodeCloudEvent reads a cloud event in either content mode and returns ErrNotCloudEvent for any other message
+func DecodeCloudEvent(header map[string]string, body []byte) (*CloudEvent, error) {
+	lower := map[string]string{}
+
+	for k, v := range header {
+		lower[strings.ToLower(k)] = v
+	}
+
+	var event *CloudEvent
+	var specVersion string
+
+	if _, ok := lower[CloudEventsHeaderPrefix+"specversion"]; ok {
+		var err error
+
+		event, specVersion, err = decodeBinaryCloudEvent(lower, body)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		structured := map[string]json.RawMessage{}
+
+		if err := json.Unmarshal(body, &structured); err != nil {
+			if strings.HasPrefix(lower[ContentTypeHeader], CloudEventsContentType) {
+				return nil, err
+			}
+			return nil, ErrNotCloudEvent
+		}
+
+		if _, ok := structured["specversion"]; !ok {
+			return nil, ErrNotCloudEvent
+		}
+
+		var err error
+
+		event, specVersion, err = decodeStructuredCloudEvent(structured)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if specVersion != CloudEventsSpecVersion || len(event.Id) == 0 || len(event.Source) == 0 || len(event.Type) == 0 {
+		return nil, ErrInvalidCloudEvent
+	}
+
+	return event, nil
+}
+
+func decodeBinaryCloudEvent(header map[string]string, body []byte) (*CloudEvent, string, error) {
+	event := &CloudEvent{
+		DataContentType: header[ContentTypeHeader],
+		Data:            body,
+		Extensions:      map[string]string{},
+	}
+
+	specVersion := ""
+
+	for k, v := range header {
+		if !strings.HasPrefix(k, CloudEventsHeaderPrefix) {
+			continue
+		}
+
+		switch name := strings.TrimPrefix(k, CloudEventsHeaderPrefix); name {
+		case "specversion":
+			specVersion = v
+		case "id":
+			event.Id = v
+		case "source":
+			event.Source = v
+		case "type":
+			event.Type = v
+		case "subject":
+			event.Subject = v
+		case "time":
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return nil, "", fmt.Errorf("%w: time must be an RFC 3339 timestamp", ErrInvalidCloudEvent)
+			}
+			event.Time = t
+		default:
+			event.Extensions[name] = v
+		}
+	}
+
+	return event, specVersion, nil
+}
+
+func decodeStructuredCloudEvent(structured map[string]json.RawMessage) (*CloudEvent, string, error) {
+	event := &CloudEvent{
+		Extensions: map[string]string{},
+	}
+
+	specVersion := ""
+
+	attributes := map[string]*string{
+		"specversion":     &specVersion,
+		"id":              &event.Id,
+		"source":          &event.Source,
+		"type":            &event.Type,
+		"subject":         &event.Subject,
+		"datacontenttype": &event.DataContentType,
+	}
+
+	for k, raw := range structured {
+		if attr, ok := attributes[k]; ok {
+			if err := json.Unmarshal(raw, attr); err != nil {
+				return nil, "", fmt.Errorf("%w: %s must be a string", ErrInvalidCloudEvent, k)
+			}
+			continue
+		}
+
+		switch k {
+		case "time":
+			if err := json.Unmarshal(raw, &event.Time); err != nil {
+				return nil, "", fmt.Errorf("%w: time must be an RFC 3339 timestamp", ErrInvalidCloudEvent)
+			}
+		case "data", "data_base64":
+		default:
+			var v string
+			if err := json.Unmarshal(raw, &v); err != nil {
+				v = string(raw)
+			}
+			event.Extensions[k] = v
+		}
+	}
+
+	if raw, ok := structured["data_base64"]; ok {
+		var encoded string
+		if err := json.Unmarshal(raw, &encoded); err != nil {
+			return nil, "", fmt.Errorf("%w: data_base64 must be a string", ErrInvalidCloudEvent)
+		}
+
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: data_base64 is not base64", ErrInvalidCloudEvent)
+		}
+
+		event.Data = data
+	} else if raw, ok := structured["data"]; ok {
+		// non-json data that was embedded as a json string is handed back without the quotes
+		var s string
+		if !isJSONContentType(event.DataContentType) && json.Unmarshal(raw, &s) == nil {
+			event.Data = []byte(s)
+		} else {
+			event.Data = []byte(raw)
+		}
+	}
+
+	return event, specVersion, nil
+}
+
+// isJSONContentType treats a missing content type as json like the structured json format does
+func isJSONContentType(contentType string) bool {
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+
+	return len(mediaType) == 0 || mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")
+}
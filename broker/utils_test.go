@@ -0,0 +1,463 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/telemetry/log"
+	logmemory "github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+)
+
+func TestRetryPublish(t *testing.T) {
+	errTransient := errors.New("transient")
+
+	retryOnTransient := func(ctx context.Context, retryCount int, err error) (bool, error) {
+		return errors.Is(err, errTransient), nil
+	}
+
+	noBackoff := func(ctx context.Context, attempts int) (time.Duration, error) {
+		return 0, nil
+	}
+
+	t.Run("retries until the publish succeeds", func(t *testing.T) {
+		calls := 0
+
+		err := RetryPublish(NewPublishOptions(
+			PublishWithRetryCount(3),
+			PublishWithRetryCheck(retryOnTransient),
+			PublishWithBackoff(noBackoff),
+		), nil, func(ctx context.Context) error {
+			calls++
+			if calls < 3 {
+				return errTransient
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 3, calls)
+	})
+
+	t.Run("gives up on errors the retry check rejects", func(t *testing.T) {
+		calls := 0
+
+		errPermanent := errors.New("permanent")
+
+		err := RetryPublish(NewPublishOptions(
+			PublishWithRetryCount(3),
+			PublishWithRetryCheck(retryOnTransient),
+			PublishWithBackoff(noBackoff),
+		), nil, func(ctx context.Context) error {
+			calls++
+			return errPermanent
+		})
+		require.Equal(t, errPermanent, err)
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("stops when the caller's deadline passes", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		calls := 0
+
+		err := RetryPublish(NewPublishOptions(
+			PublishWithRetryCount(10),
+			PublishWithRetryCheck(retryOnTransient),
+			PublishWithBackoff(func(ctx context.Context, attempts int) (time.Duration, error) {
+				return time.Duration(attempts) * time.Second, nil
+			}),
+			PublishWithContext(ctx),
+		), nil, func(ctx context.Context) error {
+			calls++
+			return errTransient
+		})
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("the broker's check applies when the caller has none", func(t *testing.T) {
+		calls := 0
+
+		err := RetryPublish(NewPublishOptions(
+			PublishWithRetryCount(3),
+			PublishWithBackoff(noBackoff),
+		), retryOnTransient, func(ctx context.Context) error {
+			calls++
+			if calls < 3 {
+				return errTransient
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 3, calls)
+
+		calls = 0
+
+		err = RetryPublish(NewPublishOptions(
+			PublishWithRetryCount(3),
+			PublishWithRetryCheck(func(ctx context.Context, retryCount int, err error) (bool, error) {
+				return false, nil
+			}),
+			PublishWithBackoff(noBackoff),
+		), retryOnTransient, func(ctx context.Context) error {
+			calls++
+			return errTransient
+		})
+		require.ErrorIs(t, err, errTransient)
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("network failures are retried by default", func(t *testing.T) {
+		calls := 0
+
+		err := RetryPublish(NewPublishOptions(
+			PublishWithRetryCount(3),
+			PublishWithBackoff(noBackoff),
+		), nil, func(ctx context.Context) error {
+			calls++
+			if calls < 3 {
+				return &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 3, calls)
+	})
+}
+
+func TestCloudEvents(t *testing.T) {
+	event := &CloudEvent{
+		Id:              "1",
+		Source:          "orders",
+		Type:            "order.created",
+		Subject:         "order-1",
+		Time:            time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		DataContentType: "application/json",
+		Data:            []byte(`{"total":10}`),
+		Extensions:      map[string]string{"tenant": "acme"},
+	}
+
+	for _, mode := range []ContentMode{ContentModeStructured, ContentModeBinary} {
+		t.Run(string(mode)+" events round trip", func(t *testing.T) {
+			header, body, err := EncodeCloudEvent(event, mode)
+			require.NoError(t, err)
+
+			decoded, err := DecodeCloudEvent(header, body)
+			require.NoError(t, err)
+			require.Equal(t, event.Id, decoded.Id)
+			require.Equal(t, event.Source, decoded.Source)
+			require.Equal(t, event.Type, decoded.Type)
+			require.Equal(t, event.Subject, decoded.Subject)
+			require.True(t, event.Time.Equal(decoded.Time))
+			require.Equal(t, event.DataContentType, decoded.DataContentType)
+			require.JSONEq(t, string(event.Data), string(decoded.Data))
+			require.Equal(t, event.Extensions, decoded.Extensions)
+		})
+	}
+
+	t.Run("structured events embed json data", func(t *testing.T) {
+		header, body, err := EncodeCloudEvent(event, ContentModeStructured)
+		require.NoError(t, err)
+		require.Equal(t, CloudEventsContentType, header[ContentTypeHeader])
+		require.Contains(t, string(body), `"data":{"total":10}`)
+	})
+
+	t.Run("structured events carry other data as base64", func(t *testing.T) {
+		_, body, err := EncodeCloudEvent(&CloudEvent{
+			Id:              "2",
+			Source:          "orders",
+			Type:            "order.created",
+			DataContentType: "text/plain",
+			Data:            []byte("hello"),
+		}, ContentModeStructured)
+		require.NoError(t, err)
+		require.Contains(t, string(body), `"data_base64":"aGVsbG8="`)
+
+		decoded, err := DecodeCloudEvent(nil, body)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello"), decoded.Data)
+	})
+
+	t.Run("binary headers are matched regardless of case", func(t *testing.T) {
+		decoded, err := DecodeCloudEvent(map[string]string{
+			"Ce-Specversion": "1.0",
+			"Ce-Id":          "3",
+			"Ce-Source":      "orders",
+			"Ce-Type":        "order.created",
+		}, []byte("{}"))
+		require.NoError(t, err)
+		require.Equal(t, "3", decoded.Id)
+	})
+
+	t.Run("other messages are not cloud events", func(t *testing.T) {
+		_, err := DecodeCloudEvent(nil, []byte(`{"total":10}`))
+		require.ErrorIs(t, err, ErrNotCloudEvent)
+
+		_, err = DecodeCloudEvent(nil, []byte("hello"))
+		require.ErrorIs(t, err, ErrNotCloudEvent)
+	})
+
+	t.Run("events need an id, source and type", func(t *testing.T) {
+		_, _, err := EncodeCloudEvent(&CloudEvent{Id: "4"}, ContentModeBinary)
+		require.ErrorIs(t, err, ErrInvalidCloudEvent)
+
+		_, err = DecodeCloudEvent(nil, []byte(`{"specversion":"1.0","id":"4"}`))
+		require.ErrorIs(t, err, ErrInvalidCloudEvent)
+
+		_, err = DecodeCloudEvent(nil, []byte(`{"specversion":"0.3","id":"4","source":"orders","type":"order.created"}`))
+		require.ErrorIs(t, err, ErrInvalidCloudEvent)
+	})
+
+	t.Run("a malformed time is rejected in both content modes", func(t *testing.T) {
+		_, err := DecodeCloudEvent(nil, []byte(`{"specversion":"1.0","id":"5","source":"orders","type":"order.created","time":"yesterday"}`))
+		require.ErrorIs(t, err, ErrInvalidCloudEvent)
+
+		_, err = DecodeCloudEvent(map[string]string{
+			"ce-specversion": "1.0",
+			"ce-id":          "5",
+			"ce-source":      "orders",
+			"ce-type":        "order.created",
+			"ce-time":        "yesterday",
+		}, []byte("{}"))
+		require.ErrorIs(t, err, ErrInvalidCloudEvent)
+	})
+}
+
+func TestSubscription(t *testing.T) {
+	options := NewSubscribeOptions(SubscribeWithTopic("orders"), SubscribeWithGroup("billing"))
+
+	require.Equal(t, "orders", SubscriptionTopic(options))
+	require.Equal(t, "billing", SubscriptionGroup(options, "sub-1"))
+
+	// subscribers that predate topics used the group as the topic
+	options = NewSubscribeOptions(SubscribeWithGroup("billing"))
+
+	require.Equal(t, "billing", SubscriptionTopic(options))
+
+	options = NewSubscribeOptions(SubscribeWithTopic("orders"))
+
+	require.Equal(t, "sub-1", SubscriptionGroup(options, "sub-1"))
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders.created.eu", false},
+		{"orders.*", "orders", false},
+		{"orders.>", "orders.created", true},
+		{"orders.>", "orders.created.eu", true},
+		{"orders.>", "orders", false},
+		{"*.created", "orders.created", true},
+		{"*.created", "orders.paid", false},
+		{"orders.created", "orders.created", true},
+		{">", "orders", true},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.match, MatchTopic(test.pattern, test.topic), "%s %s", test.pattern, test.topic)
+	}
+
+	require.True(t, IsTopicPattern("orders.*"))
+	require.True(t, IsTopicPattern("orders.>"))
+	require.False(t, IsTopicPattern("orders.created"))
+	require.False(t, IsTopicPattern("orders*"))
+}
+
+type recordingAcknowledger struct {
+	acks   int
+	nacks  int
+	defers int
+}
+
+func (a *recordingAcknowledger) Ack() error {
+	a.acks++
+	return nil
+}
+
+func (a *recordingAcknowledger) Nack(delay time.Duration) error {
+	a.nacks++
+	return nil
+}
+
+func (a *recordingAcknowledger) Defer(delay time.Duration) error {
+	a.defers++
+	return nil
+}
+
+func TestHandleMessage(t *testing.T) {
+	log.SetLogger(logmemory.NewLog(logmemory.LogWithBuffer(memoryutils.NewBuffer())))
+
+	errBoom := errors.New("boom")
+	errUnavailable := errors.New("dead-letter topic is unavailable")
+
+	tests := []struct {
+		name          string
+		options       SubscribeOptions
+		attempts      int
+		handlerErr    error
+		settle        bool
+		withRetry     bool
+		deadLetterErr error
+		err           error
+		called        bool
+		retried       bool
+		deadLetter    string
+		acks          int
+		defers        int
+	}{
+		{
+			name:     "success acks the message",
+			options:  NewSubscribeOptions(SubscribeWithMaxDeliveries(3)),
+			attempts: 1,
+			called:   true,
+			acks:     1,
+		},
+		{
+			name:     "a handler that settles the message is not acked again",
+			options:  NewSubscribeOptions(SubscribeWithMaxDeliveries(3)),
+			attempts: 1,
+			settle:   true,
+			called:   true,
+			acks:     1,
+		},
+		{
+			name:       "failures before the limit are retried",
+			options:    NewSubscribeOptions(SubscribeWithMaxDeliveries(3), SubscribeWithDeadLetterTopic("dlq")),
+			attempts:   2,
+			handlerErr: errBoom,
+			withRetry:  true,
+			err:        errBoom,
+			called:     true,
+			retried:    true,
+		},
+		{
+			name:       "failures without a limit are retried forever",
+			options:    NewSubscribeOptions(SubscribeWithDeadLetterTopic("dlq")),
+			attempts:   10,
+			handlerErr: errBoom,
+			withRetry:  true,
+			err:        errBoom,
+			called:     true,
+			retried:    true,
+		},
+		{
+			name:       "brokers without a retry leave the failure to the server",
+			options:    NewSubscribeOptions(SubscribeWithMaxDeliveries(3)),
+			attempts:   1,
+			handlerErr: errBoom,
+			err:        errBoom,
+			called:     true,
+		},
+		{
+			name:       "a failure on the last delivery is dead-lettered",
+			options:    NewSubscribeOptions(SubscribeWithMaxDeliveries(3), SubscribeWithDeadLetterTopic("dlq")),
+			attempts:   3,
+			handlerErr: errBoom,
+			withRetry:  true,
+			called:     true,
+			deadLetter: "boom",
+			acks:       1,
+		},
+		{
+			name:       "a failure on the last delivery without a dead-letter topic is dropped",
+			options:    NewSubscribeOptions(SubscribeWithMaxDeliveries(3)),
+			attempts:   3,
+			handlerErr: errBoom,
+			withRetry:  true,
+			called:     true,
+			acks:       1,
+		},
+		{
+			name:       "a duplicate of a message in flight is put off instead of dead-lettered on the last delivery",
+			options:    NewSubscribeOptions(SubscribeWithMaxDeliveries(3), SubscribeWithDeadLetterTopic("dlq")),
+			attempts:   3,
+			handlerErr: ErrMessageInFlight,
+			withRetry:  true,
+			err:        ErrMessageInFlight,
+			called:     true,
+			defers:     1,
+		},
+		{
+			name:       "messages past the limit are dead-lettered without being handled",
+			options:    NewSubscribeOptions(SubscribeWithMaxDeliveries(3), SubscribeWithDeadLetterTopic("dlq")),
+			attempts:   4,
+			deadLetter: "message exceeded 3 deliveries",
+			acks:       1,
+		},
+		{
+			name:          "a failed dead-letter leaves the message unsettled",
+			options:       NewSubscribeOptions(SubscribeWithMaxDeliveries(3), SubscribeWithDeadLetterTopic("dlq")),
+			attempts:      3,
+			handlerErr:    errBoom,
+			deadLetterErr: errUnavailable,
+			err:           errUnavailable,
+			called:        true,
+			deadLetter:    "boom",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ack := &recordingAcknowledger{}
+
+			msg := NewMessage(ack)
+			msg.Topic = "orders"
+			msg.Header["trace"] = "abc"
+			msg.Attempts = test.attempts
+
+			called := false
+
+			handler := func(msg *Message) error {
+				called = true
+				if test.settle {
+					msg.Ack()
+				}
+				return test.handlerErr
+			}
+
+			retried := false
+
+			var retry RetryFunc
+			if test.withRetry {
+				retry = func(msg *Message) error {
+					retried = true
+					return nil
+				}
+			}
+
+			var deadLetter map[string]string
+
+			err := HandleMessage(test.options, msg, handler, retry, func(topic string, msg *Message, header map[string]string) error {
+				require.Equal(t, "dlq", topic)
+				deadLetter = header
+				return test.deadLetterErr
+			})
+
+			require.Equal(t, test.err, err)
+			require.Equal(t, test.called, called)
+			require.Equal(t, test.retried, retried)
+			require.Equal(t, test.acks, ack.acks)
+			require.Zero(t, ack.nacks)
+			require.Equal(t, test.defers, ack.defers)
+
+			if len(test.deadLetter) == 0 {
+				require.Nil(t, deadLetter)
+				return
+			}
+
+			require.Equal(t, test.deadLetter, deadLetter[DeadLetterReasonHeader])
+			require.Equal(t, "orders", deadLetter[DeadLetterSourceHeader])
+			require.Equal(t, "abc", deadLetter["trace"])
+		})
+	}
+}
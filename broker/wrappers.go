@@ -0,0 +1,303 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/telemetry/log"
+	"github.com/w-h-a/pkg/telemetry/tracev2"
+)
+
+const (
+	idempotencyKeyPrefix = "broker/processed/"
+	processingValue      = "processing"
+	processedValue       = "processed"
+)
+
+type PublishWrapper func(PublishFunc) PublishFunc
+
+type PublishFunc func(data interface{}, options PublishOptions) error
+
+type BatchPublishFunc func(entries []BatchEntry) error
+
+type SubscriberWrapper func(HandlerFunc) HandlerFunc
+
+type HandlerFunc func(msg *Message) error
+
+// WrapPublish puts the broker's publish wrappers around publish so that the first one runs outermost
+func WrapPublish(options BrokerOptions, publish PublishFunc) PublishFunc {
+	for i := len(options.PublishWrappers); i > 0; i-- {
+		publish = options.PublishWrappers[i-1](publish)
+	}
+
+	return publish
+}
+
+// WrapPublishBatch runs every entry through the broker's publish wrappers and sends the entries that reach the end of the chain
+// in one call to publish, so that each wrapper sees the outcome of its own entry. Entries that a wrapper stops are left out of the
+// batch, and an entry that a wrapper publishes again after the batch went out is sent on its own.
+func WrapPublishBatch(options BrokerOptions, entries []BatchEntry, publish BatchPublishFunc) error {
+	if len(options.PublishWrappers) == 0 {
+		return publish(entries)
+	}
+
+	type staged struct {
+		index  int
+		entry  BatchEntry
+		result chan error
+	}
+
+	stage := make(chan staged)
+	skipped := make(chan struct{})
+	sent := make(chan struct{})
+
+	errs := make([]error, len(entries))
+
+	wg := sync.WaitGroup{}
+
+	for i, entry := range entries {
+		wg.Add(1)
+
+		go func(i int, entry BatchEntry) {
+			defer wg.Done()
+
+			reached := false
+
+			errs[i] = WrapPublish(options, func(data interface{}, opts PublishOptions) error {
+				s := staged{index: i, entry: BatchEntry{Data: data, Options: opts}, result: make(chan error, 1)}
+
+				if !reached {
+					reached = true
+
+					select {
+					case stage <- s:
+						return <-s.result
+					case <-sent:
+					}
+				}
+
+				return batchErrors(publish([]BatchEntry{s.entry}), 1)[0]
+			})(entry.Data, entry.Options)
+
+			if !reached {
+				skipped <- struct{}{}
+			}
+		}(i, entry)
+	}
+
+	batch := []staged{}
+
+	for pending := len(entries); pending > 0; pending-- {
+		select {
+		case s := <-stage:
+			batch = append(batch, s)
+		case <-skipped:
+		}
+	}
+
+	// the entries go out in the order they were given
+	sort.Slice(batch, func(i, j int) bool {
+		return batch[i].index < batch[j].index
+	})
+
+	batchEntries := make([]BatchEntry, len(batch))
+
+	for i, s := range batch {
+		batchEntries[i] = s.entry
+	}
+
+	var result []error
+	if len(batchEntries) > 0 {
+		result = batchErrors(publish(batchEntries), len(batchEntries))
+	}
+
+	close(sent)
+
+	for i, s := range batch {
+		s.result <- result[i]
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return &BatchError{Errors: errs}
+		}
+	}
+
+	return nil
+}
+
+// batchErrors lines up the error of a batch publish with its n entries
+func batchErrors(err error, n int) []error {
+	errs := make([]error, n)
+
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) && len(batchErr.Errors) == n {
+		copy(errs, batchErr.Errors)
+		return errs
+	}
+
+	for i := range errs {
+		errs[i] = err
+	}
+
+	return errs
+}
+
+// WrapHandler puts the broker's subscriber wrappers around handler so that the first one runs outermost
+func WrapHandler(options BrokerOptions, handler HandlerFunc) HandlerFunc {
+	for i := len(options.SubscriberWrappers); i > 0; i-- {
+		handler = options.SubscriberWrappers[i-1](handler)
+	}
+
+	return handler
+}
+
+// TracePublishWrapper starts a span for every publish
+func TracePublishWrapper(tr tracev2.Trace) PublishWrapper {
+	return func(fn PublishFunc) PublishFunc {
+		return func(data interface{}, options PublishOptions) error {
+			ctx := options.Context
+			if ctx == nil {
+				ctx = context.Background()
+			}
+
+			newCtx, spanId := tr.Start(ctx, fmt.Sprintf("%s.Publish", options.Topic))
+			defer tr.Finish(spanId)
+
+			tr.AddMetadata(spanId, map[string]string{
+				"topic": options.Topic,
+			})
+
+			options.Context = newCtx
+
+			if err := fn(data, options); err != nil {
+				tr.UpdateStatus(spanId, 1, err.Error())
+				return err
+			}
+
+			tr.UpdateStatus(spanId, 2, "success")
+
+			return nil
+		}
+	}
+}
+
+// TraceSubscriberWrapper starts a span for every delivery and hands it to the handler through the message's context
+func TraceSubscriberWrapper(tr tracev2.Trace) SubscriberWrapper {
+	return func(fn HandlerFunc) HandlerFunc {
+		return func(msg *Message) error {
+			ctx := msg.Context
+			if ctx == nil {
+				ctx = context.Background()
+			}
+
+			newCtx, spanId := tr.Start(ctx, fmt.Sprintf("%s.Handler", msg.Topic))
+			defer tr.Finish(spanId)
+
+			tr.AddMetadata(spanId, map[string]string{
+				"topic":    msg.Topic,
+				"id":       msg.Id,
+				"attempts": fmt.Sprintf("%d", msg.Attempts),
+			})
+
+			msg.Context = newCtx
+
+			if err := fn(msg); err != nil {
+				tr.UpdateStatus(spanId, 1, err.Error())
+				return err
+			}
+
+			tr.UpdateStatus(spanId, 2, "success")
+
+			return nil
+		}
+	}
+}
+
+// LogPublishWrapper logs the outcome of every publish
+func LogPublishWrapper() PublishWrapper {
+	return func(fn PublishFunc) PublishFunc {
+		return func(data interface{}, options PublishOptions) error {
+			if err := fn(data, options); err != nil {
+				log.Errorf("failed to publish message to topic %s: %v", options.Topic, err)
+				return err
+			}
+
+			log.Debugf("published message to topic %s", options.Topic)
+
+			return nil
+		}
+	}
+}
+
+// LogSubscriberWrapper logs the outcome of every delivery
+func LogSubscriberWrapper() SubscriberWrapper {
+	return func(fn HandlerFunc) HandlerFunc {
+		return func(msg *Message) error {
+			if err := fn(msg); err != nil {
+				log.Errorf("failed to handle message %s from topic %s on attempt %d: %v", msg.Id, msg.Topic, msg.Attempts, err)
+				return err
+			}
+
+			log.Debugf("handled message %s from topic %s on attempt %d", msg.Id, msg.Topic, msg.Attempts)
+
+			return nil
+		}
+	}
+}
+
+// IdempotentSubscriberWrapper skips messages that the group already handled by recording their ids in the store until the ttl passes.
+// A message is claimed atomically for the lease before the handler runs, so a duplicate that arrives while the original is
+// still being handled fails with ErrMessageInFlight and is redelivered later without being dead-lettered. Failed messages are released for redelivery and
+// the claim of a handler that died runs out with the lease, which should outlast the slowest handler.
+func IdempotentSubscriberWrapper(s store.Store, ttl, lease time.Duration) SubscriberWrapper {
+	return func(fn HandlerFunc) HandlerFunc {
+		return func(msg *Message) error {
+			// groups each handle every message, so they are deduplicated separately
+			key := idempotencyKeyPrefix + msg.Group + "/" + msg.Topic + "/" + msg.Id
+
+			err := s.Write(&store.Record{
+				Key:    key,
+				Value:  []byte(processingValue),
+				Expiry: lease,
+			}, store.WriteWithIfNotExists())
+
+			if errors.Is(err, store.ErrRecordExists) {
+				recs, err := s.Read(key)
+				if err == nil && len(recs) > 0 && string(recs[0].Value) == processedValue {
+					log.Debugf("skipping message %s from topic %s that was already handled", msg.Id, msg.Topic)
+					return nil
+				}
+				return ErrMessageInFlight
+			}
+
+			if err != nil {
+				return err
+			}
+
+			if err := fn(msg); err != nil {
+				if deleteErr := s.Delete(key); deleteErr != nil {
+					log.Errorf("failed to release message %s from topic %s: %v", msg.Id, msg.Topic, deleteErr)
+				}
+				return err
+			}
+
+			if err := s.Write(&store.Record{
+				Key:    key,
+				Value:  []byte(processedValue),
+				Expiry: ttl,
+			}); err != nil {
+				log.Errorf("failed to record message %s from topic %s as handled: %v", msg.Id, msg.Topic, err)
+			}
+
+			return nil
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/store/memory"
+	"github.com/w-h-a/pkg/telemetry/log"
+	logmemory "github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+)
+
+func TestIdempotentSubscriberWrapper(t *testing.T) {
+	log.SetLogger(logmemory.NewLog(logmemory.LogWithBuffer(memoryutils.NewBuffer())))
+
+	s := memory.NewStore()
+
+	calls := 0
+	fail := true
+
+	handler := IdempotentSubscriberWrapper(s, time.Minute, time.Minute)(func(msg *Message) error {
+		calls++
+		if fail {
+			return errors.New("boom")
+		}
+		return nil
+	})
+
+	msg := NewMessage(nil)
+	msg.Id = "1"
+	msg.Topic = "orders"
+
+	// failed messages are not recorded
+	require.Error(t, handler(msg))
+	require.Equal(t, 1, calls)
+
+	fail = false
+
+	require.NoError(t, handler(msg))
+	require.Equal(t, 2, calls)
+
+	// duplicates are skipped
+	require.NoError(t, handler(msg))
+	require.Equal(t, 2, calls)
+
+	// the same id on another topic is a different message
+	other := NewMessage(nil)
+	other.Id = "1"
+	other.Topic = "payments"
+
+	require.NoError(t, handler(other))
+	require.Equal(t, 3, calls)
+
+	// every group handles the message once
+	grouped := NewMessage(nil)
+	grouped.Id = "1"
+	grouped.Topic = "orders"
+	grouped.Group = "billing"
+
+	require.NoError(t, handler(grouped))
+	require.Equal(t, 4, calls)
+
+	require.NoError(t, handler(grouped))
+	require.Equal(t, 4, calls)
+
+	// duplicates that arrive while the original is being handled are redelivered later
+	inflight := NewMessage(nil)
+	inflight.Id = "2"
+	inflight.Topic = "orders"
+
+	var nested error
+
+	handler = IdempotentSubscriberWrapper(s, time.Minute, time.Minute)(func(msg *Message) error {
+		if msg == inflight {
+			nested = IdempotentSubscriberWrapper(s, time.Minute, time.Minute)(func(msg *Message) error {
+				return nil
+			})(msg)
+		}
+		return nil
+	})
+
+	require.NoError(t, handler(inflight))
+	require.ErrorIs(t, nested, ErrMessageInFlight)
+}
+
+func TestIdempotentSubscriberWrapperLease(t *testing.T) {
+	log.SetLogger(logmemory.NewLog(logmemory.LogWithBuffer(memoryutils.NewBuffer())))
+
+	s := memory.NewStore()
+
+	crash := true
+	calls := 0
+
+	handler := IdempotentSubscriberWrapper(s, time.Minute, 50*time.Millisecond)(func(msg *Message) error {
+		calls++
+		if crash {
+			panic("consumer died")
+		}
+		return nil
+	})
+
+	msg := NewMessage(nil)
+	msg.Id = "1"
+	msg.Topic = "orders"
+	msg.Group = "billing"
+
+	// the claim of the crashed handler is left behind
+	require.Panics(t, func() { handler(msg) })
+
+	crash = false
+
+	require.ErrorIs(t, handler(msg), ErrMessageInFlight)
+	require.Equal(t, 1, calls)
+
+	// once the lease runs out the redelivery is handled long before the ttl
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, handler(msg))
+	require.Equal(t, 2, calls)
+
+	require.NoError(t, handler(msg))
+	require.Equal(t, 2, calls)
+}
+
+func TestWrapPublishBatch(t *testing.T) {
+	boom := errors.New("boom")
+
+	// the wrapper publishes an entry again when the batch failed it
+	options := BrokerOptions{
+		PublishWrappers: []PublishWrapper{
+			func(fn PublishFunc) PublishFunc {
+				return func(data interface{}, options PublishOptions) error {
+					if err := fn(data, options); err != nil {
+						return fn(data, options)
+					}
+					return nil
+				}
+			},
+		},
+	}
+
+	calls := [][]interface{}{}
+
+	err := WrapPublishBatch(options, []BatchEntry{{Data: "a"}, {Data: "b"}, {Data: "c"}}, func(entries []BatchEntry) error {
+		data := []interface{}{}
+		for _, entry := range entries {
+			data = append(data, entry.Data)
+		}
+		calls = append(calls, data)
+
+		if len(entries) > 1 {
+			return &BatchError{Errors: []error{nil, boom, nil}}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, [][]interface{}{{"a", "b", "c"}, {"b"}}, calls)
+}
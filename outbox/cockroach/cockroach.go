@@ -0,0 +1,434 @@
+package cockroach
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/w-h-a/pkg/outbox"
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/telemetry/log"
+)
+
+const (
+	pruneInterval  = time.Minute
+	pruneBatchSize = int64(1000)
+)
+
+type cockroachOutbox struct {
+	options     outbox.OutboxOptions
+	client      *sql.DB
+	writeRecord *sql.Stmt
+	writeEvent  *sql.Stmt
+	claim       *sql.Stmt
+	markSent    *sql.Stmt
+	release     *sql.Stmt
+	prune       *sql.Stmt
+	exit        chan struct{}
+	done        chan struct{}
+	started     bool
+	mtx         sync.RWMutex
+}
+
+func (o *cockroachOutbox) Options() outbox.OutboxOptions {
+	return o.options
+}
+
+func (o *cockroachOutbox) Write(records []*store.Record, events ...*outbox.Event) error {
+	tx, err := o.client.Begin()
+	if err != nil {
+		return err
+	}
+
+	// rollback is a no-op once the transaction is committed
+	defer tx.Rollback()
+
+	writeRecord := tx.Stmt(o.writeRecord)
+
+	for _, rec := range records {
+		if rec.Expiry != 0 {
+			_, err = writeRecord.Exec(rec.Key, rec.Value, time.Now().Add(rec.Expiry))
+		} else {
+			_, err = writeRecord.Exec(rec.Key, rec.Value, nil)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	writeEvent := tx.Stmt(o.writeEvent)
+
+	for _, event := range events {
+		if len(event.Id) == 0 {
+			event.Id = uuid.New().String()
+		}
+
+		header, err := json.Marshal(event.Header)
+		if err != nil {
+			return err
+		}
+
+		if _, err := writeEvent.Exec(event.Id, event.Key, event.Topic, header, event.Body); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (o *cockroachOutbox) Run() error {
+	if o.options.Broker == nil {
+		return outbox.ErrBrokerRequired
+	}
+
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	if o.started {
+		return nil
+	}
+
+	o.exit = make(chan struct{})
+	o.done = make(chan struct{})
+	o.started = true
+
+	go o.run(o.exit, o.done)
+
+	return nil
+}
+
+func (o *cockroachOutbox) Stop() error {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	if !o.started {
+		return nil
+	}
+
+	close(o.exit)
+
+	<-o.done
+
+	o.started = false
+
+	return nil
+}
+
+func (o *cockroachOutbox) String() string {
+	return "cockroach"
+}
+
+func (o *cockroachOutbox) run(exit, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(o.options.PollInterval)
+	defer ticker.Stop()
+
+	pruned := time.Time{}
+
+	for {
+		// keep relaying while whole batches go out and wait for the next tick once the broker fails or the backlog is gone
+		for {
+			n, err := o.relay()
+			if err != nil {
+				log.Errorf("failed to relay outbox events: %v", err)
+				break
+			}
+
+			if n < o.options.BatchSize {
+				break
+			}
+
+			select {
+			case <-exit:
+				return
+			default:
+			}
+		}
+
+		if time.Since(pruned) >= pruneInterval {
+			if err := o.deleteSent(); err != nil {
+				log.Errorf("failed to delete sent outbox events: %v", err)
+			}
+			pruned = time.Now()
+		}
+
+		select {
+		case <-exit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// relay claims a batch of pending events for the lease, publishes them and returns how many were published.
+// The claim is its own statement, so no rows stay locked while the broker is called. Events that were not
+// published are released right away, so the next relay starts from them and their keys stay in order.
+func (o *cockroachOutbox) relay() (int, error) {
+	rows, err := o.claim.Query(o.options.BatchSize, o.options.Lease.Milliseconds())
+	if err != nil {
+		return 0, err
+	}
+
+	events := []*outbox.Event{}
+
+	seqs := map[string]int64{}
+
+	for rows.Next() {
+		event := &outbox.Event{}
+
+		var header []byte
+
+		var seq int64
+
+		if err := rows.Scan(&event.Id, &seq, &event.Key, &event.Topic, &header, &event.Body, &event.CreatedAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		if len(header) > 0 {
+			if err := json.Unmarshal(header, &event.Header); err != nil {
+				rows.Close()
+				return 0, err
+			}
+		}
+
+		seqs[event.Id] = seq
+
+		events = append(events, event)
+	}
+
+	if err := rows.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// returning does not keep the order of the claim
+	sort.Slice(events, func(i, j int) bool {
+		return seqs[events[i].Id] < seqs[events[j].Id]
+	})
+
+	published := outbox.Relay(o.options.Broker, events)
+
+	sent := map[string]bool{}
+
+	ids := make([]string, 0, len(published))
+
+	for _, event := range published {
+		sent[event.Id] = true
+		ids = append(ids, event.Id)
+	}
+
+	unsent := []string{}
+
+	for _, event := range events {
+		if !sent[event.Id] {
+			unsent = append(unsent, event.Id)
+		}
+	}
+
+	if len(ids) > 0 {
+		if _, err := o.markSent.Exec(pq.Array(ids)); err != nil {
+			return 0, err
+		}
+	}
+
+	// an unreleased claim runs out with the lease
+	if len(unsent) > 0 {
+		if _, err := o.release.Exec(pq.Array(unsent)); err != nil {
+			log.Errorf("failed to release outbox events: %v", err)
+		}
+	}
+
+	return len(published), nil
+}
+
+// deleteSent deletes the events that were sent longer ago than the retention
+func (o *cockroachOutbox) deleteSent() error {
+	for {
+		res, err := o.prune.Exec(o.options.Retention.Milliseconds(), pruneBatchSize)
+		if err != nil {
+			return err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if n < pruneBatchSize {
+			return nil
+		}
+	}
+}
+
+func (o *cockroachOutbox) configure() error {
+	if len(o.options.Nodes) == 0 {
+		return errors.New("database address is required")
+	}
+
+	reg, err := regexp.Compile("[^a-zA-Z0-9]+")
+	if err != nil {
+		return errors.New("failed to compile regex for database and table names")
+	}
+	o.options.Database = reg.ReplaceAllString(o.options.Database, "_")
+	o.options.Table = reg.ReplaceAllString(o.options.Table, "_")
+
+	source := o.options.Nodes[0]
+	if _, err := url.Parse(source); err != nil {
+		return err
+	}
+
+	client, err := sql.Open("postgres", source)
+	if err != nil {
+		return err
+	}
+
+	if err := client.Ping(); err != nil {
+		return err
+	}
+
+	o.client = client
+
+	return o.initDB()
+}
+
+func (o *cockroachOutbox) initDB() error {
+	if _, err := o.client.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s;", o.options.Database)); err != nil {
+		return err
+	}
+
+	if _, err := o.client.Exec(fmt.Sprintf("SET DATABASE = %s ;", o.options.Database)); err != nil {
+		return err
+	}
+
+	// the records table matches the cockroach store so that the store can read what the outbox writes
+	if _, err := o.client.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s
+	(
+		key text NOT NULL,
+		value bytea,
+		expiry timestamp with time zone,
+		CONSTRAINT %s_pkey PRIMARY KEY (key)
+	);`, o.options.Table, o.options.Table)); err != nil {
+		return err
+	}
+
+	outboxTable := o.options.Table + "_outbox"
+
+	// a sequence rather than a timestamp orders events that were written in the same transaction
+	if _, err := o.client.Exec(fmt.Sprintf("CREATE SEQUENCE IF NOT EXISTS %s_seq;", outboxTable)); err != nil {
+		return err
+	}
+
+	if _, err := o.client.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s
+	(
+		id text NOT NULL,
+		seq INT8 NOT NULL DEFAULT nextval('%s_seq'),
+		key text NOT NULL,
+		topic text NOT NULL,
+		header jsonb,
+		body bytea,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		sent_at timestamp with time zone,
+		CONSTRAINT %s_pkey PRIMARY KEY (id)
+	);`, outboxTable, outboxTable, outboxTable)); err != nil {
+		return err
+	}
+
+	// tables from before claims were leased get the column
+	if _, err := o.client.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS claimed_until timestamp with time zone;", outboxTable)); err != nil {
+		return err
+	}
+
+	if _, err := o.client.Exec(fmt.Sprintf(`CREATE INDEX IF NOT EXISTS "%s" ON %s.%s USING btree (sent_at, seq);`, "pending_index_"+outboxTable, o.options.Database, outboxTable)); err != nil {
+		return err
+	}
+
+	if _, err := o.client.Exec(fmt.Sprintf(`CREATE INDEX IF NOT EXISTS "%s" ON %s.%s USING btree (key, seq);`, "key_index_"+outboxTable, o.options.Database, outboxTable)); err != nil {
+		return err
+	}
+
+	writeRecord, err := o.client.Prepare(fmt.Sprintf(`INSERT INTO %s.%s(key, value, expiry)
+		VALUES ($1, $2::bytea, $3)
+		ON CONFLICT (key)
+		DO UPDATE
+		SET value = EXCLUDED.value, expiry = EXCLUDED.expiry;`, o.options.Database, o.options.Table))
+	if err != nil {
+		return err
+	}
+	o.writeRecord = writeRecord
+
+	writeEvent, err := o.client.Prepare(fmt.Sprintf(`INSERT INTO %s.%s(id, key, topic, header, body)
+		VALUES ($1, $2, $3, $4::jsonb, $5::bytea);`, o.options.Database, outboxTable))
+	if err != nil {
+		return err
+	}
+	o.writeEvent = writeEvent
+
+	// events whose key has an earlier event claimed by another relay wait for it so that the key stays in order
+	claim, err := o.client.Prepare(fmt.Sprintf(`UPDATE %s.%s AS e
+		SET claimed_until = now() + $2::INT8 * INTERVAL '1 millisecond'
+		WHERE e.sent_at IS NULL
+		AND (e.claimed_until IS NULL OR e.claimed_until < now())
+		AND (e.key = '' OR NOT EXISTS (
+			SELECT 1 FROM %s.%s AS p
+			WHERE p.key = e.key AND p.seq < e.seq AND p.sent_at IS NULL AND p.claimed_until >= now()
+		))
+		ORDER BY e.seq
+		LIMIT $1
+		RETURNING e.id, e.seq, e.key, e.topic, e.header, e.body, e.created_at;`, o.options.Database, outboxTable, o.options.Database, outboxTable))
+	if err != nil {
+		return err
+	}
+	o.claim = claim
+
+	markSent, err := o.client.Prepare(fmt.Sprintf("UPDATE %s.%s SET sent_at = now(), claimed_until = NULL WHERE id = ANY($1);", o.options.Database, outboxTable))
+	if err != nil {
+		return err
+	}
+	o.markSent = markSent
+
+	release, err := o.client.Prepare(fmt.Sprintf("UPDATE %s.%s SET claimed_until = NULL WHERE id = ANY($1) AND sent_at IS NULL;", o.options.Database, outboxTable))
+	if err != nil {
+		return err
+	}
+	o.release = release
+
+	prune, err := o.client.Prepare(fmt.Sprintf(`DELETE FROM %s.%s
+		WHERE sent_at < now() - $1::INT8 * INTERVAL '1 millisecond'
+		ORDER BY sent_at
+		LIMIT $2;`, o.options.Database, outboxTable))
+	if err != nil {
+		return err
+	}
+	o.prune = prune
+
+	return nil
+}
+
+func NewOutbox(opts ...outbox.OutboxOption) outbox.Outbox {
+	options := outbox.NewOutboxOptions(opts...)
+
+	o := &cockroachOutbox{
+		options: options,
+		mtx:     sync.RWMutex{},
+	}
+
+	if err := o.configure(); err != nil {
+		log.Fatal(err)
+	}
+
+	return o
+}
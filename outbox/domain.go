@@ -0,0 +1,13 @@
+package outbox
+
+import "time"
+
+type Event struct {
+	Id string
+	// Key is the aggregate that the event belongs to and events of the same key are relayed in order
+	Key       string
+	Topic     string
+	Header    map[string]string
+	Body      []byte
+	CreatedAt time.Time
+}
@@ -0,0 +1,89 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"github.com/w-h-a/pkg/broker"
+)
+
+type OutboxOption func(o *OutboxOptions)
+
+type OutboxOptions struct {
+	Nodes        []string
+	Database     string
+	Table        string
+	Broker       broker.Broker
+	PollInterval time.Duration
+	BatchSize    int
+	Lease        time.Duration
+	Retention    time.Duration
+	Context      context.Context
+}
+
+func OutboxWithNodes(addrs ...string) OutboxOption {
+	return func(o *OutboxOptions) {
+		o.Nodes = addrs
+	}
+}
+
+func OutboxWithDatabase(db string) OutboxOption {
+	return func(o *OutboxOptions) {
+		o.Database = db
+	}
+}
+
+// OutboxWithTable sets the table of the records, which should be the table of the store that reads them
+func OutboxWithTable(tbl string) OutboxOption {
+	return func(o *OutboxOptions) {
+		o.Table = tbl
+	}
+}
+
+func OutboxWithBroker(b broker.Broker) OutboxOption {
+	return func(o *OutboxOptions) {
+		o.Broker = b
+	}
+}
+
+func OutboxWithPollInterval(d time.Duration) OutboxOption {
+	return func(o *OutboxOptions) {
+		o.PollInterval = d
+	}
+}
+
+func OutboxWithBatchSize(n int) OutboxOption {
+	return func(o *OutboxOptions) {
+		o.BatchSize = n
+	}
+}
+
+// OutboxWithLease sets how long a relay holds on to the events it claimed, which should outlast publishing a batch
+func OutboxWithLease(d time.Duration) OutboxOption {
+	return func(o *OutboxOptions) {
+		o.Lease = d
+	}
+}
+
+// OutboxWithRetention sets how long sent events are kept before they are deleted
+func OutboxWithRetention(d time.Duration) OutboxOption {
+	return func(o *OutboxOptions) {
+		o.Retention = d
+	}
+}
+
+func NewOutboxOptions(opts ...OutboxOption) OutboxOptions {
+	options := OutboxOptions{
+		PollInterval: defaultPollInterval,
+		BatchSize:    defaultBatchSize,
+		Lease:        defaultLease,
+		Retention:    defaultRetention,
+		Context:      context.Background(),
+	}
+
+	for _, fn := range opts {
+		fn(&options)
+	}
+
+	return options
+}
@@ -0,0 +1,28 @@
+package outbox
+
+import (
+	"errors"
+	"time"
+
+	"github.com/w-h-a/pkg/store"
+)
+
+var (
+	ErrBrokerRequired = errors.New("a broker is required to relay events")
+)
+
+var (
+	defaultPollInterval = time.Second
+	defaultBatchSize    = 100
+	defaultLease        = 30 * time.Second
+	defaultRetention    = 24 * time.Hour
+)
+
+// Outbox writes records and the events that describe them in one transaction and relays the events to a broker
+type Outbox interface {
+	Options() OutboxOptions
+	Write(records []*store.Record, events ...*Event) error
+	Run() error
+	Stop() error
+	String() string
+}
@@ -0,0 +1,43 @@
+package outbox
+
+import (
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/telemetry/log"
+)
+
+// Relay publishes the events in order and returns the ones that were published.
+// Once an event fails, the later events of its key are held back so that they are not published ahead of it.
+// Events without a key have no ordering to keep.
+func Relay(b broker.Broker, events []*Event) []*Event {
+	published := []*Event{}
+
+	failed := map[string]bool{}
+
+	for _, event := range events {
+		if failed[event.Key] {
+			continue
+		}
+
+		opts := []broker.PublishOption{
+			broker.PublishWithTopic(event.Topic),
+			broker.PublishWithKey(event.Key),
+			broker.PublishWithDeduplicationId(event.Id),
+		}
+
+		for k, v := range event.Header {
+			opts = append(opts, broker.PublishWithHeader(k, v))
+		}
+
+		if err := b.Publish(event.Body, broker.NewPublishOptions(opts...)); err != nil {
+			log.Errorf("failed to relay event %s to topic %s: %v", event.Id, event.Topic, err)
+			if len(event.Key) > 0 {
+				failed[event.Key] = true
+			}
+			continue
+		}
+
+		published = append(published, event)
+	}
+
+	return published
+}
@@ -0,0 +1,52 @@
+package outbox
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/broker"
+	"github.com/w-h-a/pkg/broker/memory"
+	"github.com/w-h-a/pkg/telemetry/log"
+	logmemory "github.com/w-h-a/pkg/telemetry/log/memory"
+	"github.com/w-h-a/pkg/utils/memoryutils"
+)
+
+func TestRelay(t *testing.T) {
+	log.SetLogger(logmemory.NewLog(logmemory.LogWithBuffer(memoryutils.NewBuffer())))
+
+	sent := []broker.PublishOptions{}
+
+	b := memory.NewBroker(
+		broker.BrokerWithPublishWrappers(func(publish broker.PublishFunc) broker.PublishFunc {
+			return func(data interface{}, options broker.PublishOptions) error {
+				if string(data.([]byte)) == "fail" {
+					return errors.New("boom")
+				}
+				sent = append(sent, options)
+				return publish(data, options)
+			}
+		}),
+	)
+
+	events := []*Event{
+		{Id: "1", Key: "order-1", Topic: "orders", Body: []byte("created"), Header: map[string]string{"foo": "bar"}},
+		{Id: "2", Key: "order-2", Topic: "orders", Body: []byte("fail")},
+		{Id: "3", Key: "order-2", Topic: "orders", Body: []byte("paid")},
+		{Id: "4", Key: "order-1", Topic: "orders", Body: []byte("paid")},
+		{Id: "5", Topic: "audit", Body: []byte("fail")},
+		{Id: "6", Topic: "audit", Body: []byte("logged")},
+	}
+
+	published := Relay(b, events)
+
+	// the event after the failed one of order-2 is held back while the others go out
+	require.Equal(t, []*Event{events[0], events[3], events[5]}, published)
+
+	require.Len(t, sent, 3)
+	require.Equal(t, "orders", sent[0].Topic)
+	require.Equal(t, "order-1", sent[0].Key)
+	require.Equal(t, "1", sent[0].DeduplicationId)
+	require.Equal(t, "bar", sent[0].Header["foo"])
+	require.Equal(t, "audit", sent[2].Topic)
+}
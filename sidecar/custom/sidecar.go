@@ -2,8 +2,8 @@ package custom
 
 import (
 	"context"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -163,14 +163,6 @@ func (s *customSidecar) WriteEventToBroker(ctx context.Context, event *sidecar.E
 	newCtx, spanId := s.options.Tracer.Start(ctx, "customSidecar.WriteEventToBroker")
 	defer s.options.Tracer.Finish(spanId)
 
-	if traceId, foundTrace := tracev2.TraceIdFromContext(newCtx); foundTrace {
-		if spanId, foundSpan := tracev2.SpanIdFromContext(newCtx); foundSpan {
-			if _, ok := event.Payload[tracev2.TraceParentKey].(string); !ok {
-				event.Payload[tracev2.TraceParentKey] = fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(traceId[:]), hex.EncodeToString(spanId[:]))
-			}
-		}
-	}
-
 	payload, _ := json.Marshal(event.Payload)
 
 	s.options.Tracer.AddMetadata(spanId, map[string]string{
@@ -185,7 +177,38 @@ func (s *customSidecar) WriteEventToBroker(ctx context.Context, event *sidecar.E
 		return sidecar.ErrComponentNotFound
 	}
 
-	if err := bk.Publish(event.Payload, *bk.Options().PublishOptions); err != nil {
+	// the trace context travels in the message headers rather than in the payload
+	options := *bk.Options().PublishOptions
+	options.Header = broker.InjectTraceHeaders(newCtx, options.Header)
+
+	var data interface{} = event.Payload
+
+	if len(s.options.CloudEventsMode) > 0 {
+		source := s.options.CloudEventsSource
+		if len(source) == 0 {
+			source = s.options.ServiceName
+		}
+
+		ce, err := sidecar.ToCloudEvent(event, source)
+		if err != nil {
+			s.options.Tracer.UpdateStatus(spanId, 1, err.Error())
+			return err
+		}
+
+		header, body, err := broker.EncodeCloudEvent(ce, s.options.CloudEventsMode)
+		if err != nil {
+			s.options.Tracer.UpdateStatus(spanId, 1, err.Error())
+			return err
+		}
+
+		for k, v := range header {
+			options.Header[k] = v
+		}
+
+		data = body
+	}
+
+	if err := bk.Publish(data, options); err != nil {
 		s.options.Tracer.UpdateStatus(spanId, 1, err.Error())
 		return err
 	}
@@ -222,37 +245,50 @@ func (s *customSidecar) ReadEventsFromBroker(ctx context.Context, brokerId strin
 
 	s.mtx.RUnlock()
 
-	sub := bk.Subscribe(func(b []byte) error {
-		var payload map[string]interface{}
+	sub := bk.Subscribe(func(msg *broker.Message) error {
+		event := &sidecar.Event{
+			EventName: brokerId,
+		}
 
-		if err := json.Unmarshal(b, &payload); err != nil {
+		// cloud events are accepted in either content mode alongside plain json payloads
+		ce, err := broker.DecodeCloudEvent(msg.Header, msg.Body)
+		switch {
+		case err == nil:
+			event, err = sidecar.FromCloudEvent(brokerId, ce)
+			if err != nil {
+				s.options.Tracer.UpdateStatus(spanId, 1, err.Error())
+				return err
+			}
+		case errors.Is(err, broker.ErrNotCloudEvent):
+			if err := json.Unmarshal(msg.Body, &event.Payload); err != nil {
+				s.options.Tracer.UpdateStatus(spanId, 1, err.Error())
+				return err
+			}
+		default:
 			s.options.Tracer.UpdateStatus(spanId, 1, err.Error())
 			return err
 		}
 
-		var spanId string
-
-		var newCtx context.Context
+		ctx := msg.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
 
-		if encoded, ok := payload[tracev2.TraceParentKey].(string); ok {
-			ctx, _ := tracev2.ContextWithTraceParent(context.Background(), encoded)
-			newCtx, spanId = s.options.Tracer.Start(ctx, fmt.Sprintf("%s.Handler", brokerId))
-		} else {
-			newCtx, spanId = s.options.Tracer.Start(context.Background(), fmt.Sprintf("%s.Handler", brokerId))
+		// events from publishers that predate trace headers carry the trace parent in the payload
+		if _, ok := msg.Header[tracev2.TraceParentKey]; !ok {
+			if encoded, ok := event.Payload[tracev2.TraceParentKey].(string); ok {
+				ctx, _ = tracev2.ContextWithTraceParent(ctx, encoded)
+			}
 		}
 
+		newCtx, spanId := s.options.Tracer.Start(ctx, fmt.Sprintf("%s.Handler", brokerId))
 		defer s.options.Tracer.Finish(spanId)
 
 		s.options.Tracer.AddMetadata(spanId, map[string]string{
 			"brokerId": brokerId,
-			"payload":  string(b),
+			"payload":  string(msg.Body),
 		})
 
-		event := &sidecar.Event{
-			EventName: brokerId,
-			Payload:   payload,
-		}
-
 		s.options.Tracer.UpdateStatus(spanId, 2, "success")
 
 		return s.sendEventToService(newCtx, event)
@@ -285,7 +321,7 @@ func (s *customSidecar) UnsubscribeFromBroker(ctx context.Context, brokerId stri
 
 	s.mtx.RUnlock()
 
-	if err := sub.Unsubscribe(); err != nil {
+	if err := sub.Unsubscribe(ctx); err != nil {
 		s.options.Tracer.UpdateStatus(spanId, 1, err.Error())
 		return err
 	}
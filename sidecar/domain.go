@@ -1,8 +1,17 @@
 package sidecar
 
+import "time"
+
+// Event is published as a cloud event when the sidecar is configured for it, and the attributes are filled in from received cloud events
 type Event struct {
-	EventName string                 `json:"eventName,omitempty"`
-	Payload   map[string]interface{} `json:"payload,omitempty"`
+	EventName       string                 `json:"eventName,omitempty"`
+	Payload         map[string]interface{} `json:"payload,omitempty"`
+	Id              string                 `json:"id,omitempty"`
+	Source          string                 `json:"source,omitempty"`
+	Type            string                 `json:"type,omitempty"`
+	Subject         string                 `json:"subject,omitempty"`
+	Time            *time.Time             `json:"time,omitempty"`
+	DataContentType string                 `json:"datacontenttype,omitempty"`
 }
 
 type State struct {
@@ -13,16 +13,18 @@ import (
 type SidecarOption func(o *SidecarOptions)
 
 type SidecarOptions struct {
-	ServiceName string
-	HttpPort    Port
-	GrpcPort    Port
-	ServicePort Port
-	Client      client.Client
-	Stores      map[string]store.Store
-	Brokers     map[string]broker.Broker
-	Secrets     map[string]secret.Secret
-	Tracer      tracev2.Trace
-	Context     context.Context
+	ServiceName       string
+	HttpPort          Port
+	GrpcPort          Port
+	ServicePort       Port
+	Client            client.Client
+	Stores            map[string]store.Store
+	Brokers           map[string]broker.Broker
+	Secrets           map[string]secret.Secret
+	Tracer            tracev2.Trace
+	CloudEventsMode   broker.ContentMode
+	CloudEventsSource string
+	Context           context.Context
 }
 
 type Port struct {
@@ -84,6 +86,20 @@ func SidecarWithTracer(tr tracev2.Trace) SidecarOption {
 	}
 }
 
+// SidecarWithCloudEvents publishes events as cloud events in the given content mode
+func SidecarWithCloudEvents(mode broker.ContentMode) SidecarOption {
+	return func(o *SidecarOptions) {
+		o.CloudEventsMode = mode
+	}
+}
+
+// SidecarWithCloudEventsSource sets the source of published cloud events, which defaults to the service name
+func SidecarWithCloudEventsSource(source string) SidecarOption {
+	return func(o *SidecarOptions) {
+		o.CloudEventsSource = source
+	}
+}
+
 func NewSidecarOptions(opts ...SidecarOption) SidecarOptions {
 	options := SidecarOptions{
 		Stores:  map[string]store.Store{},
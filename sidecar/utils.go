@@ -2,7 +2,10 @@ package sidecar
 
 import (
 	"encoding/json"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/w-h-a/pkg/broker"
 	pb "github.com/w-h-a/pkg/proto/sidecar"
 )
 
@@ -14,3 +17,71 @@ func SerializeEvent(event *Event) (*pb.Event, error) {
 		Payload:   bs,
 	}, nil
 }
+
+// ToCloudEvent fills in the attributes the event leaves out, with the event name as the type and the payload as json data
+func ToCloudEvent(event *Event, source string) (*broker.CloudEvent, error) {
+	data, err := json.Marshal(event.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	ce := &broker.CloudEvent{
+		Id:              event.Id,
+		Source:          event.Source,
+		Type:            event.Type,
+		Subject:         event.Subject,
+		Time:            time.Now(),
+		DataContentType: event.DataContentType,
+		Data:            data,
+	}
+
+	if len(ce.Id) == 0 {
+		ce.Id = uuid.New().String()
+	}
+
+	if len(ce.Source) == 0 {
+		ce.Source = source
+	}
+
+	if len(ce.Type) == 0 {
+		ce.Type = event.EventName
+	}
+
+	if event.Time != nil {
+		ce.Time = *event.Time
+	}
+
+	if len(ce.DataContentType) == 0 {
+		ce.DataContentType = "application/json"
+	}
+
+	return ce, nil
+}
+
+// FromCloudEvent expects json data since the payload of an event is a json object
+func FromCloudEvent(eventName string, ce *broker.CloudEvent) (*Event, error) {
+	var payload map[string]interface{}
+
+	if len(ce.Data) > 0 {
+		if err := json.Unmarshal(ce.Data, &payload); err != nil {
+			return nil, err
+		}
+	}
+
+	event := &Event{
+		EventName:       eventName,
+		Payload:         payload,
+		Id:              ce.Id,
+		Source:          ce.Source,
+		Type:            ce.Type,
+		Subject:         ce.Subject,
+		DataContentType: ce.DataContentType,
+	}
+
+	if !ce.Time.IsZero() {
+		t := ce.Time
+		event.Time = &t
+	}
+
+	return event, nil
+}
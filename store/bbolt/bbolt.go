@@ -0,0 +1,391 @@
+package bbolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/telemetry/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	defaultTable         = "default"
+	defaultSweepInterval = time.Minute
+	openTimeout          = 5 * time.Second
+)
+
+var (
+	// bolt locks the file, so stores for different tables of one file share the handle
+	dbs    = map[string]*sharedDB{}
+	dbsMtx = sync.Mutex{}
+)
+
+type sharedDB struct {
+	db   *bolt.DB
+	refs int
+}
+
+type bboltStore struct {
+	options store.StoreOptions
+	db      *bolt.DB
+	bucket  []byte
+	exit    chan struct{}
+	once    sync.Once
+}
+
+func (s *bboltStore) Options() store.StoreOptions {
+	return s.options
+}
+
+func (s *bboltStore) Write(rec *store.Record, opts ...store.WriteOption) error {
+	options := store.NewWriteOptions(opts...)
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return put(tx.Bucket(s.bucket), rec, options)
+	})
+}
+
+func (s *bboltStore) Read(key string, opts ...store.ReadOption) ([]*store.Record, error) {
+	options := store.NewReadOptions(opts...)
+
+	records := []*store.Record{}
+
+	if !options.Prefix && !options.Suffix {
+		err := s.db.View(func(tx *bolt.Tx) error {
+			v := tx.Bucket(s.bucket).Get([]byte(key))
+			if v == nil || expired(v) {
+				return store.ErrRecordNotFound
+			}
+
+			records = append(records, decode([]byte(key), v))
+
+			return nil
+		})
+
+		return records, err
+	}
+
+	prefix := ""
+	if options.Prefix {
+		prefix = key
+	}
+
+	suffix := ""
+	if options.Suffix {
+		suffix = key
+	}
+
+	err := s.scan(prefix, suffix, options.Limit, options.Offset, func(k, v []byte) {
+		records = append(records, decode(k, v))
+	})
+
+	return records, err
+}
+
+func (s *bboltStore) List(opts ...store.ListOption) ([]string, error) {
+	options := store.NewListOptions(opts...)
+
+	keys := []string{}
+
+	err := s.scan(options.Prefix, options.Suffix, options.Limit, options.Offset, func(k, v []byte) {
+		keys = append(keys, string(k))
+	})
+
+	return keys, err
+}
+
+func (s *bboltStore) Delete(key string, opts ...store.DeleteOption) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Delete([]byte(key))
+	})
+}
+
+// Txn stages the writes and deletes and then applies them in one bolt transaction, which is rolled back when any of them fails.
+// fn runs outside of the bolt transaction, so it may read from the store.
+func (s *bboltStore) Txn(fn func(txn store.Txn) error) error {
+	txn := &bboltTxn{}
+
+	if err := fn(txn); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+
+		for _, op := range txn.ops {
+			if op.rec == nil {
+				if err := b.Delete([]byte(op.key)); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := put(b, op.rec, op.options); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Close stops the sweeper and closes the file once no other store of it is open
+func (s *bboltStore) Close() error {
+	var err error
+
+	s.once.Do(func() {
+		close(s.exit)
+
+		dbsMtx.Lock()
+		defer dbsMtx.Unlock()
+
+		shared, ok := dbs[s.options.Database]
+		if !ok {
+			return
+		}
+
+		shared.refs--
+
+		if shared.refs > 0 {
+			return
+		}
+
+		delete(dbs, s.options.Database)
+
+		err = shared.db.Close()
+	})
+
+	return err
+}
+
+func (s *bboltStore) String() string {
+	return "bbolt"
+}
+
+// scan walks the unexpired keys in order, seeking straight to the prefix when there is one
+func (s *bboltStore) scan(prefix, suffix string, limit, offset uint, fn func(k, v []byte)) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(s.bucket).Cursor()
+
+		skipped := uint(0)
+		found := uint(0)
+
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			if !strings.HasSuffix(string(k), suffix) || expired(v) {
+				continue
+			}
+
+			if skipped < offset {
+				skipped++
+				continue
+			}
+
+			// bolt reuses the memory once the transaction ends
+			fn(bytes.Clone(k), v)
+
+			found++
+
+			if limit > 0 && found == limit {
+				return nil
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *bboltStore) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.exit:
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.deleteExpired(); err != nil {
+			log.Errorf("failed to delete expired records from %s: %v", s.options.Database, err)
+		}
+	}
+}
+
+func (s *bboltStore) deleteExpired() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+
+		keys := [][]byte{}
+
+		if err := b.ForEach(func(k, v []byte) error {
+			if expired(v) {
+				keys = append(keys, bytes.Clone(k))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *bboltStore) configure() error {
+	if len(s.options.Database) == 0 {
+		return fmt.Errorf("a database file is required")
+	}
+
+	table := s.options.Table
+	if len(table) == 0 {
+		table = defaultTable
+	}
+
+	s.bucket = []byte(table)
+
+	dbsMtx.Lock()
+	defer dbsMtx.Unlock()
+
+	shared, ok := dbs[s.options.Database]
+	if !ok {
+		db, err := bolt.Open(s.options.Database, 0600, &bolt.Options{Timeout: openTimeout})
+		if err != nil {
+			return err
+		}
+
+		shared = &sharedDB{db: db}
+
+		dbs[s.options.Database] = shared
+	}
+
+	shared.refs++
+
+	s.db = shared.db
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(s.bucket)
+		return err
+	})
+}
+
+func put(b *bolt.Bucket, rec *store.Record, options store.WriteOptions) error {
+	if options.IfNotExists {
+		if v := b.Get([]byte(rec.Key)); v != nil && !expired(v) {
+			return store.ErrRecordExists
+		}
+	}
+
+	return b.Put([]byte(rec.Key), encode(rec))
+}
+
+// encode puts the expiry as unix nanos (zero for none) in front of the value
+func encode(rec *store.Record) []byte {
+	v := make([]byte, 8+len(rec.Value))
+
+	if rec.Expiry > 0 {
+		binary.BigEndian.PutUint64(v, uint64(time.Now().Add(rec.Expiry).UnixNano()))
+	}
+
+	copy(v[8:], rec.Value)
+
+	return v
+}
+
+func decode(k, v []byte) *store.Record {
+	record := &store.Record{
+		Key:   string(k),
+		Value: bytes.Clone(v[8:]),
+	}
+
+	if expiresAt := expiresAt(v); !expiresAt.IsZero() {
+		record.Expiry = time.Until(expiresAt)
+	}
+
+	return record
+}
+
+func expiresAt(v []byte) time.Time {
+	if len(v) < 8 {
+		return time.Time{}
+	}
+
+	nanos := binary.BigEndian.Uint64(v)
+	if nanos == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, int64(nanos))
+}
+
+func expired(v []byte) bool {
+	expiresAt := expiresAt(v)
+	return !expiresAt.IsZero() && !expiresAt.After(time.Now())
+}
+
+func NewStore(opts ...store.StoreOption) store.Store {
+	options := store.NewStoreOptions(opts...)
+
+	s := &bboltStore{
+		options: options,
+		exit:    make(chan struct{}),
+	}
+
+	if err := s.configure(); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(options.Seed) != 0 {
+		for _, rec := range options.Seed {
+			if err := s.Write(rec); err != nil {
+				log.Fatalf("failed to seed database: %v", err)
+			}
+		}
+	}
+
+	interval := defaultSweepInterval
+	if d, ok := GetSweepIntervalFromContext(options.Context); ok && d > 0 {
+		interval = d
+	}
+
+	go s.sweep(interval)
+
+	return s
+}
+
+type operation struct {
+	key     string
+	rec     *store.Record
+	options store.WriteOptions
+}
+
+type bboltTxn struct {
+	ops []operation
+}
+
+func (t *bboltTxn) Write(rec *store.Record, opts ...store.WriteOption) error {
+	// copy the record so that later changes by the caller are not committed
+	r := &store.Record{
+		Key:    rec.Key,
+		Value:  bytes.Clone(rec.Value),
+		Expiry: rec.Expiry,
+	}
+
+	t.ops = append(t.ops, operation{key: rec.Key, rec: r, options: store.NewWriteOptions(opts...)})
+
+	return nil
+}
+
+func (t *bboltTxn) Delete(key string, opts ...store.DeleteOption) error {
+	t.ops = append(t.ops, operation{key: key})
+	return nil
+}
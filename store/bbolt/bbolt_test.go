@@ -0,0 +1,150 @@
+package bbolt
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/store/storetest"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "store.db")
+
+	st := NewStore(
+		store.StoreWithDatabase(file),
+		store.StoreWithTable("tokens"),
+		BboltWithSweepInterval(10*time.Millisecond),
+	)
+
+	t.Run("write and read", func(t *testing.T) {
+		err := st.Write(&store.Record{Key: "a", Value: []byte("1")})
+		require.NoError(t, err)
+
+		recs, err := st.Read("a")
+		require.NoError(t, err)
+		require.Len(t, recs, 1)
+		require.Equal(t, "a", recs[0].Key)
+		require.Equal(t, []byte("1"), recs[0].Value)
+		require.Zero(t, recs[0].Expiry)
+
+		_, err = st.Read("missing")
+		require.ErrorIs(t, err, store.ErrRecordNotFound)
+
+		err = st.Write(&store.Record{Key: "a", Value: []byte("2")}, store.WriteWithIfNotExists())
+		require.ErrorIs(t, err, store.ErrRecordExists)
+	})
+
+	t.Run("tables of one file are separate buckets", func(t *testing.T) {
+		other := NewStore(
+			store.StoreWithDatabase(file),
+			store.StoreWithTable("sessions"),
+		)
+
+		_, err := other.Read("a")
+		require.ErrorIs(t, err, store.ErrRecordNotFound)
+	})
+
+	t.Run("expired records are hidden and then swept", func(t *testing.T) {
+		err := st.Write(&store.Record{Key: "session", Value: []byte("x"), Expiry: 50 * time.Millisecond})
+		require.NoError(t, err)
+
+		recs, err := st.Read("session")
+		require.NoError(t, err)
+		require.Greater(t, recs[0].Expiry, time.Duration(0))
+
+		require.Eventually(t, func() bool {
+			found := false
+
+			st.(*bboltStore).db.View(func(tx *bolt.Tx) error {
+				found = tx.Bucket([]byte("tokens")).Get([]byte("session")) != nil
+				return nil
+			})
+
+			return !found
+		}, time.Second, 10*time.Millisecond)
+
+		_, err = st.Read("session")
+		require.ErrorIs(t, err, store.ErrRecordNotFound)
+
+		err = st.Write(&store.Record{Key: "session", Value: []byte("y")}, store.WriteWithIfNotExists())
+		require.NoError(t, err)
+	})
+
+	t.Run("prefix and suffix reads honour limit and offset", func(t *testing.T) {
+		for _, key := range []string{"user/1/token", "user/2/token", "user/3/token", "user/3/profile"} {
+			err := st.Write(&store.Record{Key: key, Value: []byte(key)})
+			require.NoError(t, err)
+		}
+
+		recs, err := st.Read("user/", store.ReadWithPrefix())
+		require.NoError(t, err)
+		require.Len(t, recs, 4)
+
+		recs, err = st.Read("/token", store.ReadWithSuffix(), store.ReadWithLimit(2), store.ReadWithOffset(1))
+		require.NoError(t, err)
+		require.Len(t, recs, 2)
+		require.Equal(t, "user/2/token", recs[0].Key)
+		require.Equal(t, "user/3/token", recs[1].Key)
+
+		keys, err := st.List(store.ListWithPrefix("user/3/"))
+		require.NoError(t, err)
+		require.Equal(t, []string{"user/3/profile", "user/3/token"}, keys)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		err := st.Delete("a")
+		require.NoError(t, err)
+
+		_, err = st.Read("a")
+		require.ErrorIs(t, err, store.ErrRecordNotFound)
+	})
+}
+
+func TestTxn(t *testing.T) {
+	st := NewStore(
+		store.StoreWithDatabase(filepath.Join(t.TempDir(), "store.db")),
+		store.StoreWithTable("authz"),
+	)
+
+	storetest.TestTxn(t, st)
+}
+
+func TestClose(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "store.db")
+
+	tokens := NewStore(
+		store.StoreWithDatabase(file),
+		store.StoreWithTable("tokens"),
+	)
+
+	sessions := NewStore(
+		store.StoreWithDatabase(file),
+		store.StoreWithTable("sessions"),
+	)
+
+	require.NoError(t, tokens.(io.Closer).Close())
+	require.NoError(t, tokens.(io.Closer).Close())
+
+	// the file stays open for the other table
+	err := sessions.Write(&store.Record{Key: "a", Value: []byte("1")})
+	require.NoError(t, err)
+
+	require.NoError(t, sessions.(io.Closer).Close())
+
+	// the file is released, so it can be opened again
+	reopened := NewStore(
+		store.StoreWithDatabase(file),
+		store.StoreWithTable("sessions"),
+	)
+
+	recs, err := reopened.Read("a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), recs[0].Value)
+
+	require.NoError(t, reopened.(io.Closer).Close())
+}
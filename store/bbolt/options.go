@@ -0,0 +1,22 @@
+package bbolt
+
+import (
+	"context"
+	"time"
+
+	"github.com/w-h-a/pkg/store"
+)
+
+type sweepIntervalKey struct{}
+
+// BboltWithSweepInterval sets how often expired records are deleted from the file
+func BboltWithSweepInterval(d time.Duration) store.StoreOption {
+	return func(o *store.StoreOptions) {
+		o.Context = context.WithValue(o.Context, sweepIntervalKey{}, d)
+	}
+}
+
+func GetSweepIntervalFromContext(ctx context.Context) (time.Duration, bool) {
+	d, ok := ctx.Value(sweepIntervalKey{}).(time.Duration)
+	return d, ok
+}
@@ -17,6 +17,7 @@ type cockroachStore struct {
 	options    store.StoreOptions
 	client     *sql.DB
 	write      *sql.Stmt
+	writeNew   *sql.Stmt
 	readOne    *sql.Stmt
 	readMany   *sql.Stmt
 	readOffset *sql.Stmt
@@ -35,18 +36,43 @@ func (s *cockroachStore) Options() store.StoreOptions {
 **  else, keep looping
  */
 func (s *cockroachStore) Write(rec *store.Record, opts ...store.WriteOption) error {
+	return write(s.write, s.writeNew, rec, store.NewWriteOptions(opts...))
+}
+
+func write(upsert, insert *sql.Stmt, rec *store.Record, options store.WriteOptions) error {
+	stmt := upsert
+	if options.IfNotExists {
+		stmt = insert
+	}
+
+	var result sql.Result
+
 	var err error
 
 	if rec.Expiry != 0 {
-		_, err = s.write.Exec(rec.Key, rec.Value, time.Now().Add(rec.Expiry))
+		result, err = stmt.Exec(rec.Key, rec.Value, time.Now().Add(rec.Expiry))
 	} else {
-		_, err = s.write.Exec(rec.Key, rec.Value, nil)
+		result, err = stmt.Exec(rec.Key, rec.Value, nil)
+	}
+
+	if err != nil {
+		return err
 	}
 
+	if !options.IfNotExists {
+		return nil
+	}
+
+	// nothing is written when an unexpired record holds the key
+	n, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
 
+	if n == 0 {
+		return store.ErrRecordExists
+	}
+
 	return nil
 }
 
@@ -214,6 +240,31 @@ func (s *cockroachStore) Delete(key string, opts ...store.DeleteOption) error {
 	return nil
 }
 
+// Txn runs the writes and deletes in one sql transaction and rolls it back when fn or any of them fails
+func (s *cockroachStore) Txn(fn func(txn store.Txn) error) error {
+	tx, err := s.client.Begin()
+	if err != nil {
+		return err
+	}
+
+	txn := &cockroachTxn{store: s, tx: tx}
+
+	err = fn(txn)
+	if err == nil {
+		// a failed write rolls back the transaction even if fn carried on
+		err = txn.err
+	}
+
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			log.Errorf("failed to roll back transaction: %v", rollbackErr)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
 func (s *cockroachStore) String() string {
 	return "cockroach"
 }
@@ -278,6 +329,17 @@ func (s *cockroachStore) initDB() error {
 	}
 	s.write = write
 
+	writeNew, err := s.client.Prepare(fmt.Sprintf(`INSERT INTO %s.%s(key, value, expiry)
+		VALUES ($1, $2::bytea, $3)
+		ON CONFLICT (key)
+		DO UPDATE
+		SET value = EXCLUDED.value, expiry = EXCLUDED.expiry
+		WHERE %s.expiry IS NOT NULL AND %s.expiry < now();`, s.options.Database, s.options.Table, s.options.Table, s.options.Table))
+	if err != nil {
+		return err
+	}
+	s.writeNew = writeNew
+
 	readOne, err := s.client.Prepare(fmt.Sprintf("SELECT key, value, expiry FROM %s.%s WHERE key = $1;", s.options.Database, s.options.Table))
 	if err != nil {
 		return err
@@ -324,3 +386,27 @@ func NewStore(opts ...store.StoreOption) store.Store {
 
 	return s
 }
+
+type cockroachTxn struct {
+	store *cockroachStore
+	tx    *sql.Tx
+	err   error
+}
+
+func (t *cockroachTxn) Write(rec *store.Record, opts ...store.WriteOption) error {
+	if err := write(t.tx.Stmt(t.store.write), t.tx.Stmt(t.store.writeNew), rec, store.NewWriteOptions(opts...)); err != nil {
+		t.err = err
+		return err
+	}
+
+	return nil
+}
+
+func (t *cockroachTxn) Delete(key string, opts ...store.DeleteOption) error {
+	if _, err := t.tx.Stmt(t.store.delete).Exec(key); err != nil {
+		t.err = err
+		return err
+	}
+
+	return nil
+}
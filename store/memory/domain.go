@@ -1,9 +1,19 @@
 package memory
 
-import "time"
+import (
+	"time"
+
+	"github.com/w-h-a/pkg/store"
+)
 
 type InternalRecord struct {
 	Key       string
 	Value     []byte
 	ExpiresAt time.Time
 }
+
+type operation struct {
+	key     string
+	rec     *store.Record
+	options store.WriteOptions
+}
@@ -2,6 +2,7 @@ package memory
 
 import (
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/patrickmn/go-cache"
@@ -12,6 +13,7 @@ import (
 type memoryStore struct {
 	options store.StoreOptions
 	store   *cache.Cache
+	mtx     sync.RWMutex
 }
 
 func (s *memoryStore) Options() store.StoreOptions {
@@ -19,14 +21,17 @@ func (s *memoryStore) Options() store.StoreOptions {
 }
 
 func (s *memoryStore) Write(rec *store.Record, opts ...store.WriteOption) error {
+	options := store.NewWriteOptions(opts...)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.write(rec, options)
+}
+
+func (s *memoryStore) write(rec *store.Record, options store.WriteOptions) error {
 	// get the key correct
-	key := rec.Key
-	if len(s.options.Table) > 0 {
-		key = s.options.Table + "/" + key
-	}
-	if len(s.options.Database) > 0 {
-		key = s.options.Database + "/" + key
-	}
+	key := s.key(rec.Key)
 
 	// copy the incoming record and then convert the expiry to timestamp
 	i := &InternalRecord{
@@ -38,6 +43,14 @@ func (s *memoryStore) Write(rec *store.Record, opts ...store.WriteOption) error
 		i.ExpiresAt = time.Now().Add(rec.Expiry)
 	}
 
+	// add only succeeds when there is no unexpired item under the key
+	if options.IfNotExists {
+		if err := s.store.Add(key, i, rec.Expiry); err != nil {
+			return store.ErrRecordExists
+		}
+		return nil
+	}
+
 	// set
 	s.store.Set(key, i, rec.Expiry)
 
@@ -47,6 +60,9 @@ func (s *memoryStore) Write(rec *store.Record, opts ...store.WriteOption) error
 func (s *memoryStore) Read(key string, opts ...store.ReadOption) ([]*store.Record, error) {
 	options := store.NewReadOptions(opts...)
 
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
 	keys := []string{key}
 
 	if options.Prefix || options.Suffix {
@@ -61,12 +77,7 @@ func (s *memoryStore) Read(key string, opts ...store.ReadOption) ([]*store.Recor
 		}
 
 		// TODO: limit and offset
-		ks, err := s.List(opts...)
-		if err != nil {
-			return nil, err
-		}
-
-		keys = ks
+		keys = s.keys(store.NewListOptions(opts...))
 	}
 
 	records := []*store.Record{}
@@ -84,12 +95,7 @@ func (s *memoryStore) Read(key string, opts ...store.ReadOption) ([]*store.Recor
 
 func (s *memoryStore) read(key string) (*store.Record, error) {
 	// get the key correct
-	if len(s.options.Table) > 0 {
-		key = s.options.Table + "/" + key
-	}
-	if len(s.options.Database) > 0 {
-		key = s.options.Database + "/" + key
-	}
+	key = s.key(key)
 
 	// get the record
 	r, found := s.store.Get(key)
@@ -119,6 +125,13 @@ func (s *memoryStore) read(key string) (*store.Record, error) {
 func (s *memoryStore) List(opts ...store.ListOption) ([]string, error) {
 	options := store.NewListOptions(opts...)
 
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.keys(options), nil
+}
+
+func (s *memoryStore) keys(options store.ListOptions) []string {
 	allKeys := s.list(options.Limit, options.Offset)
 
 	if len(options.Prefix) > 0 {
@@ -141,7 +154,7 @@ func (s *memoryStore) List(opts ...store.ListOption) ([]string, error) {
 		allKeys = suffixKeys
 	}
 
-	return allKeys, nil
+	return allKeys
 }
 
 func (s *memoryStore) list(_, _ uint) []string {
@@ -168,7 +181,65 @@ func (s *memoryStore) list(_, _ uint) []string {
 }
 
 func (s *memoryStore) Delete(key string, opts ...store.DeleteOption) error {
-	// get the key correct
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// delete
+	s.store.Delete(s.key(key))
+
+	return nil
+}
+
+// Txn stages the writes and deletes and then applies them under the store's lock, checking every conditional write before applying any of them
+func (s *memoryStore) Txn(fn func(txn store.Txn) error) error {
+	txn := &memoryTxn{}
+
+	if err := fn(txn); err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// keys written or deleted earlier in the transaction shadow what is in the cache
+	staged := map[string]bool{}
+
+	for _, op := range txn.ops {
+		key := s.key(op.key)
+
+		if op.rec == nil {
+			staged[key] = false
+			continue
+		}
+
+		exists, ok := staged[key]
+		if !ok {
+			_, exists = s.store.Get(key)
+		}
+
+		if op.options.IfNotExists && exists {
+			return store.ErrRecordExists
+		}
+
+		staged[key] = true
+	}
+
+	for _, op := range txn.ops {
+		if op.rec == nil {
+			s.store.Delete(s.key(op.key))
+			continue
+		}
+
+		if err := s.write(op.rec, op.options); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// key puts the database and table in front of the key
+func (s *memoryStore) key(key string) string {
 	if len(s.options.Table) > 0 {
 		key = s.options.Table + "/" + key
 	}
@@ -176,10 +247,7 @@ func (s *memoryStore) Delete(key string, opts ...store.DeleteOption) error {
 		key = s.options.Database + "/" + key
 	}
 
-	// delete
-	s.store.Delete(key)
-
-	return nil
+	return key
 }
 
 func (s *memoryStore) String() string {
@@ -192,6 +260,7 @@ func NewStore(opts ...store.StoreOption) store.Store {
 	s := &memoryStore{
 		options: options,
 		store:   cache.New(cache.NoExpiration, 5*time.Minute),
+		mtx:     sync.RWMutex{},
 	}
 
 	if len(options.Seed) != 0 {
@@ -0,0 +1,12 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/store/storetest"
+)
+
+func TestTxn(t *testing.T) {
+	storetest.TestTxn(t, NewStore(store.StoreWithTable("authz")))
+}
@@ -0,0 +1,26 @@
+package memory
+
+import "github.com/w-h-a/pkg/store"
+
+type memoryTxn struct {
+	ops []operation
+}
+
+func (t *memoryTxn) Write(rec *store.Record, opts ...store.WriteOption) error {
+	// copy the record so that later changes by the caller are not committed
+	r := &store.Record{
+		Key:    rec.Key,
+		Expiry: rec.Expiry,
+	}
+	r.Value = make([]byte, len(rec.Value))
+	copy(r.Value, rec.Value)
+
+	t.ops = append(t.ops, operation{key: rec.Key, rec: r, options: store.NewWriteOptions(opts...)})
+
+	return nil
+}
+
+func (t *memoryTxn) Delete(key string, opts ...store.DeleteOption) error {
+	t.ops = append(t.ops, operation{key: key})
+	return nil
+}
@@ -52,7 +52,16 @@ func NewStoreOptions(opts ...StoreOption) StoreOptions {
 
 type WriteOption func(o *WriteOptions)
 
-type WriteOptions struct{}
+type WriteOptions struct {
+	IfNotExists bool
+}
+
+// WriteWithIfNotExists only writes the record when the key is absent or expired and returns ErrRecordExists otherwise
+func WriteWithIfNotExists() WriteOption {
+	return func(o *WriteOptions) {
+		o.IfNotExists = true
+	}
+}
 
 func NewWriteOptions(opts ...WriteOption) WriteOptions {
 	options := WriteOptions{}
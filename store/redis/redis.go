@@ -0,0 +1,279 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/w-h-a/pkg/store"
+	"github.com/w-h-a/pkg/telemetry/log"
+)
+
+const (
+	scanCount = int64(100)
+)
+
+type redisStore struct {
+	options store.StoreOptions
+	client  goredis.UniversalClient
+	prefix  string
+}
+
+func (s *redisStore) Options() store.StoreOptions {
+	return s.options
+}
+
+func (s *redisStore) Write(rec *store.Record, opts ...store.WriteOption) error {
+	options := store.NewWriteOptions(opts...)
+
+	ctx := context.Background()
+
+	// redis expires the key itself
+	if options.IfNotExists {
+		ok, err := s.client.SetNX(ctx, s.prefix+rec.Key, rec.Value, rec.Expiry).Result()
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return store.ErrRecordExists
+		}
+
+		return nil
+	}
+
+	return s.client.Set(ctx, s.prefix+rec.Key, rec.Value, rec.Expiry).Err()
+}
+
+func (s *redisStore) Read(key string, opts ...store.ReadOption) ([]*store.Record, error) {
+	options := store.NewReadOptions(opts...)
+
+	if !options.Prefix && !options.Suffix {
+		records, err := s.read([]string{key})
+		if err != nil {
+			return nil, err
+		}
+
+		if len(records) == 0 {
+			return records, store.ErrRecordNotFound
+		}
+
+		return records, nil
+	}
+
+	match := "*"
+
+	if options.Prefix {
+		match = escape(key) + match
+	}
+
+	if options.Suffix {
+		match = match + escape(key)
+	}
+
+	keys, err := s.scan(match)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.read(page(keys, options.Limit, options.Offset))
+}
+
+// read gets the values and ttls of the keys in one round trip and skips keys that expired in the meantime
+func (s *redisStore) read(keys []string) ([]*store.Record, error) {
+	records := []*store.Record{}
+
+	if len(keys) == 0 {
+		return records, nil
+	}
+
+	ctx := context.Background()
+
+	gets := make([]*goredis.StringCmd, len(keys))
+	ttls := make([]*goredis.DurationCmd, len(keys))
+
+	if _, err := s.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		for i, key := range keys {
+			gets[i] = pipe.Get(ctx, s.prefix+key)
+			ttls[i] = pipe.PTTL(ctx, s.prefix+key)
+		}
+		return nil
+	}); err != nil && !errors.Is(err, goredis.Nil) {
+		return nil, err
+	}
+
+	for i, key := range keys {
+		value, err := gets[i].Bytes()
+		if errors.Is(err, goredis.Nil) {
+			continue
+		}
+
+		if err != nil {
+			return records, err
+		}
+
+		record := &store.Record{
+			Key:   key,
+			Value: value,
+		}
+
+		// keys without a ttl report a negative duration
+		if ttl := ttls[i].Val(); ttl > 0 {
+			record.Expiry = ttl
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func (s *redisStore) List(opts ...store.ListOption) ([]string, error) {
+	options := store.NewListOptions(opts...)
+
+	match := escape(options.Prefix) + "*"
+
+	if len(options.Suffix) > 0 {
+		match = match + escape(options.Suffix)
+	}
+
+	keys, err := s.scan(match)
+	if err != nil {
+		return nil, err
+	}
+
+	return page(keys, options.Limit, options.Offset), nil
+}
+
+func (s *redisStore) Delete(key string, opts ...store.DeleteOption) error {
+	return s.client.Del(context.Background(), s.prefix+key).Err()
+}
+
+func (s *redisStore) String() string {
+	return "redis"
+}
+
+// scan walks the keyspace (every master of a cluster) for the database and table and returns the sorted keys without their prefix
+func (s *redisStore) scan(match string) ([]string, error) {
+	ctx := context.Background()
+
+	keys := []string{}
+
+	mtx := sync.Mutex{}
+
+	scan := func(ctx context.Context, client goredis.UniversalClient) error {
+		iter := client.Scan(ctx, 0, escape(s.prefix)+match, scanCount).Iterator()
+
+		for iter.Next(ctx) {
+			mtx.Lock()
+			keys = append(keys, strings.TrimPrefix(iter.Val(), s.prefix))
+			mtx.Unlock()
+		}
+
+		return iter.Err()
+	}
+
+	var err error
+
+	if cluster, ok := s.client.(*goredis.ClusterClient); ok {
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, client *goredis.Client) error {
+			return scan(ctx, client)
+		})
+	} else {
+		err = scan(ctx, s.client)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// scan can return a key more than once
+	sort.Strings(keys)
+
+	unique := []string{}
+
+	for i, key := range keys {
+		if i > 0 && keys[i-1] == key {
+			continue
+		}
+		unique = append(unique, key)
+	}
+
+	return unique, nil
+}
+
+func (s *redisStore) configure() error {
+	if len(s.options.Nodes) == 0 {
+		return fmt.Errorf("store addresses are required")
+	}
+
+	// the database and table namespace the keys like they do in the memory store
+	if len(s.options.Database) > 0 {
+		s.prefix = s.options.Database + "/"
+	}
+
+	if len(s.options.Table) > 0 {
+		s.prefix = s.prefix + s.options.Table + "/"
+	}
+
+	s.client = goredis.NewUniversalClient(&goredis.UniversalOptions{
+		Addrs: s.options.Nodes,
+	})
+
+	return s.client.Ping(context.Background()).Err()
+}
+
+// escape keeps the glob characters of a key from being read as part of a match pattern
+func escape(key string) string {
+	var b strings.Builder
+
+	for _, r := range key {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+func page(keys []string, limit, offset uint) []string {
+	if offset >= uint(len(keys)) {
+		return []string{}
+	}
+
+	keys = keys[offset:]
+
+	if limit > 0 && limit < uint(len(keys)) {
+		keys = keys[:limit]
+	}
+
+	return keys
+}
+
+func NewStore(opts ...store.StoreOption) store.Store {
+	options := store.NewStoreOptions(opts...)
+
+	s := &redisStore{
+		options: options,
+	}
+
+	if err := s.configure(); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(options.Seed) != 0 {
+		for _, rec := range options.Seed {
+			if err := s.Write(rec); err != nil {
+				log.Fatalf("failed to seed database: %v", err)
+			}
+		}
+	}
+
+	return s
+}
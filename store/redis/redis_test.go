@@ -0,0 +1,95 @@
+package redis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/store"
+)
+
+func TestStore(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	st := NewStore(
+		store.StoreWithNodes(s.Addr()),
+		store.StoreWithDatabase("auth"),
+		store.StoreWithTable("tokens"),
+	)
+
+	t.Run("records are namespaced by database and table", func(t *testing.T) {
+		err := st.Write(&store.Record{Key: "a", Value: []byte("1")})
+		require.NoError(t, err)
+
+		require.True(t, s.Exists("auth/tokens/a"))
+
+		recs, err := st.Read("a")
+		require.NoError(t, err)
+		require.Len(t, recs, 1)
+		require.Equal(t, "a", recs[0].Key)
+		require.Equal(t, []byte("1"), recs[0].Value)
+		require.Zero(t, recs[0].Expiry)
+
+		_, err = st.Read("missing")
+		require.ErrorIs(t, err, store.ErrRecordNotFound)
+	})
+
+	t.Run("expiry is a native ttl", func(t *testing.T) {
+		err := st.Write(&store.Record{Key: "session", Value: []byte("x"), Expiry: time.Minute})
+		require.NoError(t, err)
+
+		recs, err := st.Read("session")
+		require.NoError(t, err)
+		require.InDelta(t, time.Minute, recs[0].Expiry, float64(time.Second))
+
+		err = st.Write(&store.Record{Key: "session", Value: []byte("y")}, store.WriteWithIfNotExists())
+		require.ErrorIs(t, err, store.ErrRecordExists)
+
+		s.FastForward(2 * time.Minute)
+
+		_, err = st.Read("session")
+		require.ErrorIs(t, err, store.ErrRecordNotFound)
+
+		err = st.Write(&store.Record{Key: "session", Value: []byte("y")}, store.WriteWithIfNotExists())
+		require.NoError(t, err)
+	})
+
+	t.Run("prefix and suffix reads honour limit and offset", func(t *testing.T) {
+		for _, key := range []string{"user/1/token", "user/2/token", "user/3/token", "user/3/profile", "user*"} {
+			err := st.Write(&store.Record{Key: key, Value: []byte(key)})
+			require.NoError(t, err)
+		}
+
+		recs, err := st.Read("user/", store.ReadWithPrefix())
+		require.NoError(t, err)
+		require.Len(t, recs, 4)
+
+		recs, err = st.Read("/token", store.ReadWithSuffix(), store.ReadWithLimit(2), store.ReadWithOffset(1))
+		require.NoError(t, err)
+		require.Len(t, recs, 2)
+		require.Equal(t, "user/2/token", recs[0].Key)
+		require.Equal(t, "user/3/token", recs[1].Key)
+
+		// glob characters in keys are matched literally
+		recs, err = st.Read("user*", store.ReadWithPrefix())
+		require.NoError(t, err)
+		require.Len(t, recs, 1)
+
+		keys, err := st.List(store.ListWithPrefix("user/3/"))
+		require.NoError(t, err)
+		require.Equal(t, []string{"user/3/profile", "user/3/token"}, keys)
+
+		keys, err = st.List(store.ListWithSuffix("token"), store.ListWithLimit(1))
+		require.NoError(t, err)
+		require.Equal(t, []string{"user/1/token"}, keys)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		err := st.Delete("a")
+		require.NoError(t, err)
+
+		_, err = st.Read("a")
+		require.ErrorIs(t, err, store.ErrRecordNotFound)
+	})
+}
@@ -4,6 +4,7 @@ import "errors"
 
 var (
 	ErrRecordNotFound = errors.New("record not found")
+	ErrRecordExists   = errors.New("record already exists")
 )
 
 type Store interface {
@@ -14,3 +15,15 @@ type Store interface {
 	Delete(key string, opts ...DeleteOption) error
 	String() string
 }
+
+// Txn stages writes and deletes so that they are applied together
+type Txn interface {
+	Write(rec *Record, opts ...WriteOption) error
+	Delete(key string, opts ...DeleteOption) error
+}
+
+// Transactor is implemented by stores that apply many writes and deletes atomically.
+// Nothing is applied when fn or any of its writes fails.
+type Transactor interface {
+	Txn(fn func(txn Txn) error) error
+}
@@ -0,0 +1,105 @@
+package storetest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/w-h-a/pkg/store"
+)
+
+// TestTxn checks that a store applies transactions the way store.Transactor promises.
+// The store should be empty under the txn/ prefix.
+func TestTxn(t *testing.T, s store.Store) {
+	txr, ok := s.(store.Transactor)
+	require.True(t, ok, "%s store does not support transactions", s)
+
+	t.Run("writes and deletes are applied together", func(t *testing.T) {
+		err := s.Write(&store.Record{Key: "txn/stale", Value: []byte("x")})
+		require.NoError(t, err)
+
+		err = txr.Txn(func(txn store.Txn) error {
+			if err := txn.Write(&store.Record{Key: "txn/grant/admin", Value: []byte("1")}); err != nil {
+				return err
+			}
+			if err := txn.Write(&store.Record{Key: "txn/index/admin", Value: []byte("txn/grant/admin")}); err != nil {
+				return err
+			}
+			return txn.Delete("txn/stale")
+		})
+		require.NoError(t, err)
+
+		keys, err := s.List(store.ListWithPrefix("txn/"))
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"txn/grant/admin", "txn/index/admin"}, keys)
+	})
+
+	t.Run("a conflicting write applies nothing", func(t *testing.T) {
+		err := txr.Txn(func(txn store.Txn) error {
+			txn.Write(&store.Record{Key: "txn/grant/user", Value: []byte("1")})
+			txn.Write(&store.Record{Key: "txn/grant/admin", Value: []byte("2")}, store.WriteWithIfNotExists())
+			return nil
+		})
+		require.ErrorIs(t, err, store.ErrRecordExists)
+
+		_, err = s.Read("txn/grant/user")
+		require.ErrorIs(t, err, store.ErrRecordNotFound)
+	})
+
+	t.Run("a write after a delete of the same key does not conflict", func(t *testing.T) {
+		err := txr.Txn(func(txn store.Txn) error {
+			txn.Delete("txn/grant/admin")
+			return txn.Write(&store.Record{Key: "txn/grant/admin", Value: []byte("3")}, store.WriteWithIfNotExists())
+		})
+		require.NoError(t, err)
+
+		recs, err := s.Read("txn/grant/admin")
+		require.NoError(t, err)
+		require.Equal(t, []byte("3"), recs[0].Value)
+	})
+
+	t.Run("an error from fn applies nothing", func(t *testing.T) {
+		boom := errors.New("boom")
+
+		err := txr.Txn(func(txn store.Txn) error {
+			txn.Delete("txn/index/admin")
+			return boom
+		})
+		require.ErrorIs(t, err, boom)
+
+		_, err = s.Read("txn/index/admin")
+		require.NoError(t, err)
+	})
+
+	t.Run("fn may use the store", func(t *testing.T) {
+		err := txr.Txn(func(txn store.Txn) error {
+			recs, err := s.Read("txn/grant/admin")
+			if err != nil {
+				return err
+			}
+			return txn.Write(&store.Record{Key: "txn/copy/admin", Value: recs[0].Value})
+		})
+		require.NoError(t, err)
+
+		recs, err := s.Read("txn/copy/admin")
+		require.NoError(t, err)
+		require.Equal(t, []byte("3"), recs[0].Value)
+	})
+
+	t.Run("records changed after they are staged are committed as staged", func(t *testing.T) {
+		rec := &store.Record{Key: "txn/staged", Value: []byte("before")}
+
+		err := txr.Txn(func(txn store.Txn) error {
+			if err := txn.Write(rec); err != nil {
+				return err
+			}
+			copy(rec.Value, "after!")
+			return nil
+		})
+		require.NoError(t, err)
+
+		recs, err := s.Read("txn/staged")
+		require.NoError(t, err)
+		require.Equal(t, []byte("before"), recs[0].Value)
+	})
+}
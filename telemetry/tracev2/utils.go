@@ -10,6 +10,7 @@ import (
 
 const (
 	TraceParentKey = "traceparent"
+	TraceStateKey  = "tracestate"
 )
 
 func ContextWithTraceParent(ctx context.Context, traceparent string) (context.Context, error) {